@@ -0,0 +1,176 @@
+/*
+  A consumer of changelog topics
+
+  A changelog topic is a compacted topic holding the latest value of
+  each key. A message with a nil Value (a tombstone) deletes its key.
+  The common way to use one is to read the whole topic into a table,
+  wait until the table is complete, and then keep the table up to date
+  by applying the changes which follow.
+
+  Copyright 2017 MistSys
+*/
+
+package changelog
+
+import (
+	"sync"
+
+	"github.com/Shopify/sarama"
+	consumer "github.com/mistsys/sarama-consumer"
+)
+
+// Apply is called with each message of the changelog, in offset order within each partition. A message with a nil
+// Value is a tombstone, and its key should be deleted. Since kafka keeps each key in one partition, applying every
+// message over the previous value of its key leaves the latest value of each key. Apply is called from a single
+// goroutine. Once it returns the message is Done(), and its offset will be committed.
+type Apply func(msg *sarama.ConsumerMessage)
+
+// Consumer reads a changelog topic, passing each message to an Apply function. It bootstraps by reading each
+// partition assigned to it up to the partition's high-water mark, and then signals the table is ready and tails the
+// changes which follow. The offsets of the applied messages are committed, so a restart resumes where it left off.
+// That suits a table which outlives the process; an in-memory table should be read using a consumer group of its own
+// which never commits, or whose offsets are reset at startup.
+//
+// Only committed records should be applied, so when the topic is written by transactional producers the sarama.Client
+// should be configured with Consumer.IsolationLevel = sarama.ReadCommitted. The last offsets of such a partition can be
+// transaction markers, which are never delivered. The partition is caught up all the same once no more messages are
+// found (see consumer.Config.CaughtUpNotification).
+type Consumer struct {
+	client   consumer.Client
+	consumer consumer.Consumer
+	apply    Apply
+	tracker  tracker
+	kick     chan struct{} // poked (without blocking) whenever a partition catches up
+	ready    chan struct{} // closed once all the assigned partitions have caught up
+	exited   chan struct{} // closed once run exits
+}
+
+// New creates a Consumer of the changelog topic, which is consumed by a new consumer.Client in the consumer group
+// group_name. config can be nil to use the defaults. It isn't modified; the Client uses a copy with InOrderDone set,
+// MessagesBufferSize set to unbuffered, and CaughtUpNotification wrapped.
+func New(group_name, topic string, config *consumer.Config, sarama_client sarama.Client, apply Apply) (*Consumer, error) {
+	if config == nil {
+		config = consumer.NewConfig()
+	}
+	c := &Consumer{
+		apply:  apply,
+		kick:   make(chan struct{}, 1),
+		ready:  make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	cfg := *config
+	// each message is Done() once it has been applied, which commits it and all the messages before it
+	cfg.InOrderDone = true
+	// the CaughtUpNotification is called once the last message has been delivered. Without a buffer that message is in
+	// the hands of run, which finishes applying it before it looks at c.kick
+	cfg.MessagesBufferSize = -1
+	caught_up := config.CaughtUpNotification
+	cfg.CaughtUpNotification = func(t string, p int32) {
+		if caught_up != nil {
+			caught_up(t, p)
+		}
+		// this can be called by the Consumer's goroutine, so it mustn't block
+		c.tracker.caughtUp(p)
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	client, err := consumer.NewClient(group_name, &cfg, sarama_client)
+	if err != nil {
+		return nil, err
+	}
+	con, err := client.Consume(topic)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	c.client = client
+	c.consumer = con
+	go c.run()
+	return c, nil
+}
+
+// Ready returns a channel which is closed once every partition assigned to the Consumer has been read up to the
+// high-water mark it had when it was assigned, and all those messages have been applied.
+func (c *Consumer) Ready() <-chan struct{} { return c.ready }
+
+// Errors returns the channel of errors of the Consumer's Client. See consumer.Client.Errors().
+func (c *Consumer) Errors() <-chan error { return c.client.Errors() }
+
+// Close closes the Consumer and its Client, committing the offsets of the messages which have been applied.
+func (c *Consumer) Close() {
+	c.client.Close()
+	<-c.exited
+}
+
+// apply the messages, and watch for the partitions catching up
+func (c *Consumer) run() {
+	defer close(c.exited)
+	msgs := c.consumer.Messages()
+	assignments := c.consumer.AssignmentChanges()
+	ready := false
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			c.apply(msg)
+			c.consumer.Done(msg)
+		case a, ok := <-assignments:
+			if !ok {
+				assignments = nil
+				continue
+			}
+			c.tracker.assign(a.Partitions)
+		case <-c.kick:
+		}
+		if !ready && c.tracker.ready() {
+			ready = true
+			close(c.ready)
+		}
+	}
+}
+
+// tracker tracks which of the assigned partitions have caught up
+type tracker struct {
+	lock      sync.Mutex
+	caught_up map[int32]bool // partitions which have caught up
+	assigned  map[int32]bool // the partitions currently assigned, or nil before the first assignment
+}
+
+func (t *tracker) caughtUp(p int32) {
+	t.lock.Lock()
+	if t.caught_up == nil {
+		t.caught_up = make(map[int32]bool)
+	}
+	t.caught_up[p] = true
+	t.lock.Unlock()
+}
+
+func (t *tracker) assign(partitions []int32) {
+	t.lock.Lock()
+	t.assigned = make(map[int32]bool, len(partitions))
+	for _, p := range partitions {
+		t.assigned[p] = true
+	}
+	t.lock.Unlock()
+}
+
+// ready returns true once there has been an assignment, and all the assigned partitions have caught up
+func (t *tracker) ready() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.assigned == nil {
+		return false
+	}
+	for p := range t.assigned {
+		if !t.caught_up[p] {
+			return false
+		}
+	}
+	return true
+}
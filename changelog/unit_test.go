@@ -0,0 +1,153 @@
+/*
+  Tests of the changelog consumer
+
+  Copyright 2017 MistSys
+*/
+
+package changelog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	consumer "github.com/mistsys/sarama-consumer"
+	"github.com/mistsys/sarama-consumer/roundrobin"
+)
+
+func TestTracker(t *testing.T) {
+	var tr tracker
+	if tr.ready() {
+		t.Error("ready before any assignment")
+	}
+
+	// a partition can catch up before the assignment which includes it is seen
+	tr.caughtUp(1)
+	tr.assign([]int32{0, 1, 2})
+	if tr.ready() {
+		t.Error("ready with partitions 0 and 2 not caught up")
+	}
+	tr.caughtUp(0)
+	tr.caughtUp(2)
+	if !tr.ready() {
+		t.Error("not ready once all the partitions have caught up")
+	}
+
+	// a new partition has to catch up too
+	tr.assign([]int32{0, 1, 2, 3})
+	if tr.ready() {
+		t.Error("ready with partition 3 not caught up")
+	}
+
+	// an empty assignment is ready immediately
+	var tr2 tracker
+	tr2.assign(nil)
+	if !tr2.ready() {
+		t.Error("not ready with nothing assigned")
+	}
+}
+
+// newMockClient returns a mock broker, where partition 0 of "topic" has the high-water mark start_hwm when it is
+// assigned, and then holds msgs at offsets 0 to msgs-1 and has the high-water mark hwm. The group "group" always
+// assigns it to us. Along with the broker it returns a sarama.Client of the broker
+func newMockClient(t *testing.T, start_hwm, msgs, hwm int64) (*sarama.MockBroker, sarama.Client) {
+	broker := sarama.NewMockBroker(t, 1)
+	fetch := sarama.NewMockFetchResponse(t, 10).SetVersion(1).SetHighWaterMark("topic", 0, hwm)
+	for offset := int64(0); offset < msgs; offset++ {
+		fetch.SetMessage("topic", 0, offset, sarama.StringEncoder(fmt.Sprintf("value %d", offset)))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("topic", 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGenerationId(1).
+			SetGroupProtocol(string(roundrobin.RoundRobin)).
+			SetMemberId("member").
+			SetLeaderId("leader"),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).
+			SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{
+				Version: 1,
+				Topics:  map[string][]int32{"topic": []int32{0}},
+			}),
+		"HeartbeatRequest":  sarama.NewMockHeartbeatResponse(t),
+		"LeaveGroupRequest": sarama.NewMockLeaveGroupResponse(t),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "topic", 0, -1, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("topic", 0, sarama.OffsetOldest, 0).
+			SetOffset("topic", 0, sarama.OffsetNewest, start_hwm),
+		"FetchRequest": fetch,
+	})
+
+	sconfig := consumer.NewSaramaConfig()
+	sconfig.Version = consumer.MinVersion // the version of the mock fetch and offset responses
+	sconfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, sconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker, sclient
+}
+
+// testConsumer bootstraps from the mock broker, expecting the Consumer to be ready once offsets up to ready_after have
+// been applied, and then to apply the rest of the msgs
+func testConsumer(t *testing.T, start_hwm, msgs, hwm int64, ready_after int64) {
+	broker, sclient := newMockClient(t, start_hwm, msgs, hwm)
+	defer broker.Close()
+	defer sclient.Close()
+
+	config := consumer.NewConfig()
+	config.SidechannelTopic = ""
+	config.JoinOnlyWhenConsuming = true
+	applied := make(chan int64, msgs)
+	c, err := New("group", "topic", config, sclient, func(msg *sarama.ConsumerMessage) {
+		applied <- msg.Offset
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	expect := func(from, to int64) {
+		for exp := from; exp <= to; exp++ {
+			select {
+			case offset := <-applied:
+				if offset != exp {
+					t.Fatalf("applied offset %d; expected %d", offset, exp)
+				}
+			case err := <-c.Errors():
+				t.Fatal(err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("offset %d wasn't applied", exp)
+			}
+		}
+	}
+
+	// bootstrap
+	expect(0, ready_after)
+	select {
+	case <-c.Ready():
+	case err := <-c.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not ready after bootstrapping")
+	}
+
+	// and tail
+	expect(ready_after+1, msgs-1)
+}
+
+func TestConsumer(t *testing.T) {
+	// offsets 0 to 2 are there when the partition is assigned, and offsets 3 and 4 follow
+	testConsumer(t, 3, 5, 5, 2)
+}
+
+func TestConsumerTransactionMarkers(t *testing.T) {
+	// offset 3 is a transaction marker, which is never delivered
+	testConsumer(t, 4, 3, 4, 2)
+}
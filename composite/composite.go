@@ -0,0 +1,365 @@
+/*
+  A partitioner which delegates each topic to a partitioner of its own
+
+  A client consuming several topics might want, say, round-robin for
+  one topic and a stable assignment for another. The group has one
+  protocol, so the composite partitioner is that protocol, and inside
+  it each sub-partitioner does its usual work on its own topics.
+
+  Each member sends, in the UserData of its JoinGroup metadata, the
+  metadata each sub-partitioner prepared, along with the topics the
+  sub-partitioner is responsible for. The leader has each
+  sub-partitioner partition its topics, and sends each member, in the
+  UserData of its assignment, the assignment of each sub-partitioner.
+  Every member decodes its part with the same sub-partitioner.
+
+  So every member of the group must be configured with the same
+  composite: the same sub-partitioner (by protocol name) for each
+  topic. The leader returns an error if the members disagree about a
+  topic. The sub-partitioners must have distinct names.
+
+  Copyright 2016 MistSys
+*/
+
+package composite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Shopify/sarama"
+)
+
+// name of the protocol
+const name = "composite"
+
+// Partitioner is the interface of the sub-partitioners (it matches consumer.Partitioner)
+type Partitioner interface {
+	Name() string
+	PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current_assignments map[string][]int32)
+	Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error
+	ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error)
+}
+
+// a partitioner which partitions each topic using the sub-partitioner configured for it
+type compositePartitioner struct {
+	by_topic map[string]Partitioner // map of topic -> its sub-partitioner
+	other    Partitioner            // sub-partitioner of the topics not in by_topic
+}
+
+// New returns a partitioner which partitions each topic in by_topic using its partitioner, and any other topic using other.
+// other may be nil, in which case any other topic (and any topic whose partitioner is nil) is never assigned to anyone.
+func New(by_topic map[string]Partitioner, other Partitioner) *compositePartitioner {
+	cp := &compositePartitioner{
+		by_topic: make(map[string]Partitioner, len(by_topic)),
+		other:    other,
+	}
+	for t, p := range by_topic {
+		cp.by_topic[t] = p
+	}
+	return cp
+}
+
+func (*compositePartitioner) Name() string { return name }
+
+// partitioner returns the sub-partitioner of topic, or nil
+func (cp *compositePartitioner) partitioner(topic string) Partitioner {
+	if p, ok := cp.by_topic[topic]; ok {
+		return p
+	}
+	return cp.other
+}
+
+// lookup returns the sub-partitioner with the protocol name, or nil
+func (cp *compositePartitioner) lookup(name string) Partitioner {
+	if cp.other != nil && cp.other.Name() == name {
+		return cp.other
+	}
+	for _, p := range cp.by_topic {
+		if p != nil && p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// PrepareJoin has each sub-partitioner prepare the metadata of its topics, and packs them into the UserData
+func (cp *compositePartitioner) PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current_assignments map[string][]int32) {
+	// group the topics by sub-partitioner
+	by_name := make(map[string][]string)
+	for _, t := range topics {
+		p := cp.partitioner(t)
+		if p == nil {
+			// no one partitions t, so leave it out
+			continue
+		}
+		n := p.Name()
+		by_name[n] = append(by_name[n], t)
+	}
+	names := make([]string, 0, len(by_name))
+	for n := range by_name {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	entries := make([]entry, 0, len(names))
+	for _, n := range names {
+		p := cp.lookup(n)
+		current := make(map[string][]int32)
+		for _, t := range by_name[n] {
+			if parts, ok := current_assignments[t]; ok {
+				current[t] = parts
+			}
+		}
+		var sub sarama.JoinGroupRequest
+		p.PrepareJoin(&sub, by_name[n], current)
+		// use the sub-partitioner's protocol of the same name, or else the one it prefers
+		var metadata []byte
+		for i, gp := range sub.OrderedGroupProtocols {
+			if i == 0 || gp.Name == n {
+				metadata = gp.Metadata
+			}
+		}
+		entries = append(entries, entry{name: n, topics: by_name[n], data: metadata})
+	}
+
+	jreq.AddGroupProtocolMetadata(name,
+		&sarama.ConsumerGroupMemberMetadata{
+			Version:  1,
+			Topics:   topics,
+			UserData: encode(entries),
+		})
+}
+
+// Partition has each sub-partitioner partition its topics, and packs the results into each member's assignment
+func (cp *compositePartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error {
+	by_member, err := jresp.GetMembers() // map of member to metadata
+	if err != nil {
+		return err
+	}
+
+	// split the JoinGroupResponse into one for each sub-partitioner
+	subs := make(map[string]*sarama.JoinGroupResponse) // map of sub-partitioner name -> its JoinGroupResponse
+	owners := make(map[string]string)                  // map of topic -> name of its sub-partitioner
+	for member, request := range by_member {
+		if request.Version != 1 {
+			// skip unsupported versions, just like the other partitioners
+			continue
+		}
+		entries, err := decode(request.UserData)
+		if err != nil {
+			return fmt.Errorf("member %q: %v", member, err)
+		}
+		for _, e := range entries {
+			for _, t := range e.topics {
+				if n, ok := owners[t]; ok && n != e.name {
+					return fmt.Errorf("members of the group partition topic %q with both %q and %q; they must all be configured with the same composite partitioner", t, n, e.name)
+				}
+				owners[t] = e.name
+			}
+			jr, ok := subs[e.name]
+			if !ok {
+				jr = &sarama.JoinGroupResponse{
+					Version:       jresp.Version,
+					GenerationId:  jresp.GenerationId,
+					GroupProtocol: e.name,
+					LeaderId:      jresp.LeaderId,
+					MemberId:      jresp.MemberId,
+					Members:       make(map[string][]byte),
+				}
+				subs[e.name] = jr
+			}
+			jr.Members[member] = e.data
+		}
+	}
+
+	names := make([]string, 0, len(subs))
+	for n := range subs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	assigned := make(map[string][]entry, len(by_member))               // map of member -> the assignment of each sub-partitioner
+	assignments := make(map[string]map[string][]int32, len(by_member)) // map of member -> topic -> partitions (for the benefit of anyone inspecting the group)
+	for _, n := range names {
+		p := cp.lookup(n)
+		if p == nil {
+			return fmt.Errorf("no sub-partitioner %q; all the members must be configured with the same composite partitioner", n)
+		}
+		sr := &sarama.SyncGroupRequest{
+			GroupId:      sreq.GroupId,
+			GenerationId: sreq.GenerationId,
+			MemberId:     sreq.MemberId,
+		}
+		err := p.Partition(sr, subs[n], client)
+		if err != nil {
+			return err
+		}
+		for member, data := range sr.GroupAssignments {
+			assigned[member] = append(assigned[member], entry{name: n, data: data})
+			a, err := p.ParseSync(&sarama.SyncGroupResponse{MemberAssignment: data})
+			if err != nil {
+				return err
+			}
+			topics, ok := assignments[member]
+			if !ok {
+				topics = make(map[string][]int32, len(a))
+				assignments[member] = topics
+			}
+			for t, parts := range a {
+				topics[t] = parts
+			}
+		}
+	}
+
+	for member := range by_member {
+		err := sreq.AddGroupAssignmentMember(member,
+			&sarama.ConsumerGroupMemberAssignment{
+				Version:  1,
+				Topics:   assignments[member],
+				UserData: encode(assigned[member]),
+			})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseSync has each sub-partitioner parse its part of the assignment, and combines the results
+func (cp *compositePartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	if len(sresp.MemberAssignment) == 0 {
+		// we asked for no topics, and got nothing back
+		return nil, nil
+	}
+	ma, err := sresp.GetMemberAssignment()
+	if err != nil {
+		return nil, err
+	}
+	if ma.Version != 1 {
+		return nil, fmt.Errorf("unsupported MemberAssignment version %d", ma.Version)
+	}
+	entries, err := decode(ma.UserData)
+	if err != nil {
+		return nil, err
+	}
+	assignments := make(map[string][]int32)
+	for _, e := range entries {
+		p := cp.lookup(e.name)
+		if p == nil {
+			return nil, fmt.Errorf("no sub-partitioner %q; all the members must be configured with the same composite partitioner", e.name)
+		}
+		a, err := p.ParseSync(&sarama.SyncGroupResponse{MemberAssignment: e.data})
+		if err != nil {
+			return nil, err
+		}
+		for t, parts := range a {
+			assignments[t] = parts
+		}
+	}
+	return assignments, nil
+}
+
+// ----------------------------------
+
+// an entry is one sub-partitioner's part of the metadata (in which case topics lists its topics) or of an assignment
+type entry struct {
+	name   string   // protocol name of the sub-partitioner
+	topics []string // topics the sub-partitioner partitions
+	data   []byte   // the sub-partitioner's metadata or assignment
+}
+
+// encode the entries. the encoding is an int32 count of entries, followed by each entry's name, count of topics,
+// topics, and data. the strings are prefixed with their int16 length, and the data with its int32 length, like kafka does
+func encode(entries []entry) []byte {
+	buf := make([]byte, 0, 64)
+	buf = appendUint32(buf, uint32(len(entries)))
+	for _, e := range entries {
+		buf = appendString(buf, e.name)
+		buf = appendUint32(buf, uint32(len(e.topics)))
+		for _, t := range e.topics {
+			buf = appendString(buf, t)
+		}
+		buf = appendUint32(buf, uint32(len(e.data)))
+		buf = append(buf, e.data...)
+	}
+	return buf
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return append(buf, b[:]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(len(s)))
+	buf = append(buf, b[:]...)
+	return append(buf, s...)
+}
+
+var errTruncated = errors.New("truncated composite partitioner data")
+
+// decode the encoding of encode()
+func decode(buf []byte) ([]entry, error) {
+	d := decoder{buf: buf}
+	n := d.uint32()
+	if d.err == nil && int(n) > len(buf) { // sanity check before we allocate
+		return nil, errTruncated
+	}
+	entries := make([]entry, 0, n)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		var e entry
+		e.name = d.string()
+		nt := d.uint32()
+		if d.err == nil && int(nt) > len(d.buf) {
+			return nil, errTruncated
+		}
+		for j := uint32(0); j < nt && d.err == nil; j++ {
+			e.topics = append(e.topics, d.string())
+		}
+		e.data = d.bytes(int(d.uint32()))
+		entries = append(entries, e)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return entries, nil
+}
+
+// decoder consumes buf, recording the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errTruncated
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := 0
+	if b := d.bytes(2); b != nil {
+		n = int(binary.BigEndian.Uint16(b))
+	}
+	return string(d.bytes(n))
+}
@@ -0,0 +1,101 @@
+/*
+  A simple kafka consumer-group client
+
+  Copyright 2016 MistSys
+*/
+
+package composite_test
+
+import (
+	"reflect"
+	"testing"
+
+	consumer "github.com/mistsys/sarama-consumer"
+	"github.com/mistsys/sarama-consumer/composite"
+	"github.com/mistsys/sarama-consumer/consistenthash"
+	"github.com/mistsys/sarama-consumer/partitiontest"
+	"github.com/mistsys/sarama-consumer/roundrobin"
+)
+
+func TestComposite(t *testing.T) {
+	members := map[string][]string{
+		"member0": []string{"topic1", "topic2"},
+		"member1": []string{"topic1", "topic2"},
+		"member2": []string{"topic1"},
+	}
+	partitions := map[string][]int32{
+		"topic1": []int32{0, 1, 2, 3, 4, 5, 6},
+		"topic2": []int32{0, 1, 2, 3},
+	}
+	cp := composite.New(map[string]composite.Partitioner{"topic1": roundrobin.RoundRobin}, consistenthash.ConsistentHash)
+	act, err := partitiontest.Partition(cp, members, partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("composite assignments:\n%s", partitiontest.Format(act))
+
+	// each topic must be assigned exactly as its sub-partitioner would assign it alone
+	for topic, p := range map[string]composite.Partitioner{"topic1": roundrobin.RoundRobin, "topic2": consistenthash.ConsistentHash} {
+		only := make(map[string][]string)
+		for m, topics := range members {
+			for _, t := range topics {
+				if t == topic {
+					only[m] = []string{topic}
+				}
+			}
+		}
+		exp, err := partitiontest.Partition(p, only, partitions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for m := range only {
+			if !reflect.DeepEqual(act[m][topic], exp[m][topic]) {
+				t.Errorf("%s %q assignment %v; expected %v", m, topic, act[m][topic], exp[m][topic])
+			}
+		}
+	}
+}
+
+func TestCompositeMismatch(t *testing.T) {
+	// member1 is configured to partition topic1 differently from member0 (the leader)
+	members := map[string][]string{
+		"member0": []string{"topic1"},
+		"member1": []string{"topic1"},
+	}
+	partitions := map[string][]int32{"topic1": []int32{0, 1}}
+	leader := composite.New(map[string]composite.Partitioner{"topic1": roundrobin.RoundRobin}, consistenthash.ConsistentHash)
+	other := composite.New(nil, consistenthash.ConsistentHash)
+	if _, err := partitiontest.Partition(leader, members, partitions); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := partitiontest.PartitionEach(map[string]consumer.Partitioner{"member0": leader, "member1": other}, members, partitions); err == nil {
+		t.Error("members configured with different composites didn't cause an error")
+	}
+}
+
+func TestCompositeNoOther(t *testing.T) {
+	// topic2 has no sub-partitioner, so it is never assigned
+	members := map[string][]string{
+		"member0": []string{"topic1", "topic2"},
+		"member1": []string{"topic1", "topic2"},
+	}
+	partitions := map[string][]int32{
+		"topic1": []int32{0, 1, 2},
+		"topic2": []int32{0, 1},
+	}
+	cp := composite.New(map[string]composite.Partitioner{"topic1": roundrobin.RoundRobin}, nil)
+	act, err := partitiontest.Partition(cp, members, partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for m, a := range act {
+		if len(a["topic2"]) != 0 {
+			t.Errorf("%s was assigned topic2 %v", m, a["topic2"])
+		}
+		n += len(a["topic1"])
+	}
+	if n != len(partitions["topic1"]) {
+		t.Errorf("%d partitions of topic1 were assigned; expected %d", n, len(partitions["topic1"]))
+	}
+}
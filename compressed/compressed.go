@@ -0,0 +1,163 @@
+/*
+  A partitioner which wraps another partitioner and gzip compresses
+  the member assignments the group's leader sends in its SyncGroup
+  request. With thousands of partitions the assignments can be large,
+  and the leader's SyncGroup request is the sum of all of them.
+
+  Compression is negotiated using the protocol name. Each member
+  proposes "<name>+gzip" ahead of the wrapped partitioner's "<name>",
+  so the compressed protocol is used only when every member of the
+  group supports it. Otherwise the wrapped partitioner works as it
+  does alone. Either way the members' JoinGroup metadata is not
+  compressed (and in fact is sent twice, once for each protocol).
+
+  When parsing its assignment a member recognizes a compressed
+  assignment by the gzip header, which can't be confused with the
+  start of an uncompressed sarama.ConsumerGroupMemberAssignment.
+
+  Copyright 2016 MistSys
+*/
+
+package compressed
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// the suffix added to the wrapped partitioner's protocol name
+const suffix = "+gzip"
+
+// Partitioner is the interface of the wrapped partitioner (it matches consumer.Partitioner)
+type Partitioner interface {
+	Name() string
+	PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current_assignments map[string][]int32)
+	Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error
+	ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error)
+}
+
+// userDataPartitioner is the optional interface of wrapped partitioners which return the UserData (it matches consumer.UserDataPartitioner)
+type userDataPartitioner interface {
+	ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error)
+}
+
+// a partitioner which compresses the assignments of the partitioner it wraps
+type compressedPartitioner struct {
+	p Partitioner
+}
+
+// New wraps p in a partitioner which compresses the member assignments whenever every member of the group supports it
+func New(p Partitioner) *compressedPartitioner {
+	return &compressedPartitioner{p: p}
+}
+
+func (cp *compressedPartitioner) Name() string { return cp.p.Name() + suffix }
+
+// PrepareJoin proposes the compressed version of each protocol the wrapped partitioner proposes, in preference to the uncompressed protocol
+func (cp *compressedPartitioner) PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current_assignments map[string][]int32) {
+	n := len(jreq.OrderedGroupProtocols)
+	cp.p.PrepareJoin(jreq, topics, current_assignments)
+	added := jreq.OrderedGroupProtocols[n:]
+
+	protocols := make([]*sarama.GroupProtocol, 0, n+2*len(added))
+	protocols = append(protocols, jreq.OrderedGroupProtocols[:n]...)
+	for _, gp := range added {
+		protocols = append(protocols, &sarama.GroupProtocol{
+			Name:     gp.Name + suffix,
+			Metadata: gp.Metadata,
+		})
+	}
+	protocols = append(protocols, added...)
+	jreq.OrderedGroupProtocols = protocols
+}
+
+// Partition has the wrapped partitioner compute the assignments, and then compresses them if the compressed protocol was chosen
+func (cp *compressedPartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error {
+	if !strings.HasSuffix(jresp.GroupProtocol, suffix) {
+		// some member doesn't support compression
+		return cp.p.Partition(sreq, jresp, client)
+	}
+
+	// present the wrapped partitioner with the protocol it expects
+	jr := *jresp
+	jr.GroupProtocol = strings.TrimSuffix(jresp.GroupProtocol, suffix)
+	err := cp.p.Partition(sreq, &jr, client)
+	if err != nil {
+		return err
+	}
+
+	for member, assignment := range sreq.GroupAssignments {
+		compressed, err := compress(assignment)
+		if err != nil {
+			return err
+		}
+		sreq.GroupAssignments[member] = compressed
+	}
+	return nil
+}
+
+func (cp *compressedPartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	sr, err := decompressed(sresp)
+	if err != nil {
+		return nil, err
+	}
+	return cp.p.ParseSync(sr)
+}
+
+// ParseSyncUserData is ParseSync, plus it returns the UserData of the member assignment, if the wrapped partitioner can
+func (cp *compressedPartitioner) ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error) {
+	sr, err := decompressed(sresp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if udp, ok := cp.p.(userDataPartitioner); ok {
+		return udp.ParseSyncUserData(sr)
+	}
+	assignments, err := cp.p.ParseSync(sr)
+	return assignments, nil, err
+}
+
+// ----------------------------------
+
+// the first bytes of any gzip stream. an uncompressed sarama.ConsumerGroupMemberAssignment starts with a small int16 version instead
+var gzip_magic = []byte{0x1f, 0x8b}
+
+// decompressed returns sresp with its MemberAssignment decompressed, or sresp itself if it isn't compressed
+func decompressed(sresp *sarama.SyncGroupResponse) (*sarama.SyncGroupResponse, error) {
+	if !bytes.HasPrefix(sresp.MemberAssignment, gzip_magic) {
+		return sresp, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(sresp.MemberAssignment))
+	if err != nil {
+		return nil, err
+	}
+	assignment, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sr := *sresp
+	sr.MemberAssignment = assignment
+	return &sr, nil
+}
+
+// compress an encoded member assignment
+func compress(assignment []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(assignment)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,238 @@
+/*
+  A simple kafka consumer-group client
+
+  Copyright 2016 MistSys
+*/
+
+package compressed_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	consumer "github.com/mistsys/sarama-consumer"
+	"github.com/mistsys/sarama-consumer/compressed"
+	"github.com/mistsys/sarama-consumer/roundrobin"
+)
+
+// join n members, some of which compress and some of which don't, and return the partitioned SyncGroupRequest and the members
+func partition(t testing.TB, n int, plain int, mock_client *mockClient) (*sarama.SyncGroupRequest, []consumer.Partitioner, []string) {
+	var topics = make([]string, 0, len(mock_client.partitions))
+	for topic := range mock_client.partitions {
+		topics = append(topics, topic)
+	}
+
+	var partitioners = make([]consumer.Partitioner, n)
+	var jreqs = make([]sarama.JoinGroupRequest, n)
+	var members = make([]string, n)
+	for i := range jreqs {
+		if i < plain {
+			partitioners[i] = roundrobin.RoundRobin
+		} else {
+			partitioners[i] = compressed.New(roundrobin.RoundRobin)
+		}
+		members[i] = fmt.Sprintf("member%d", i)
+		jreqs[i].GroupId = "group"
+		jreqs[i].MemberId = members[i]
+		jreqs[i].ProtocolType = "consumer"
+		partitioners[i].PrepareJoin(&jreqs[i], topics, nil)
+	}
+
+	// choose the first protocol of the leader which every member supports, as the broker would
+	var jresp = sarama.JoinGroupResponse{
+		GenerationId: 1,
+		Members:      make(map[string][]byte),
+	}
+protocols:
+	for _, gp := range jreqs[0].OrderedGroupProtocols {
+		for i := range jreqs[1:] {
+			found := false
+			for _, gp2 := range jreqs[1+i].OrderedGroupProtocols {
+				found = found || gp2.Name == gp.Name
+			}
+			if !found {
+				continue protocols
+			}
+		}
+		jresp.GroupProtocol = gp.Name
+		break
+	}
+	for i := range jreqs {
+		for _, gp := range jreqs[i].OrderedGroupProtocols {
+			if gp.Name == jresp.GroupProtocol {
+				jresp.Members[jreqs[i].MemberId] = gp.Metadata
+			}
+		}
+	}
+
+	var sreq = sarama.SyncGroupRequest{
+		GroupId:      "group",
+		GenerationId: 1,
+		MemberId:     members[0],
+	}
+	err := partitioners[0].Partition(&sreq, &jresp, mock_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sreq, partitioners, members
+}
+
+func TestCompressed(t *testing.T) {
+	var mock_client = mockClient{
+		config: sarama.NewConfig(),
+		partitions: map[string][]int32{
+			"topic1": []int32{0, 1, 2, 3, 4, 5, 6, 7},
+		},
+	}
+
+	for _, plain := range []int{0, 1} {
+		sreq, partitioners, members := partition(t, 3, plain, &mock_client)
+
+		var total int
+		for i, member := range members {
+			assignment := sreq.GroupAssignments[member]
+			is_compressed := len(assignment) >= 2 && assignment[0] == 0x1f && assignment[1] == 0x8b
+			if is_compressed != (plain == 0) {
+				t.Errorf("with %d plain members, assignment of %s compressed = %v", plain, member, is_compressed)
+			}
+
+			act, err := partitioners[i].ParseSync(&sarama.SyncGroupResponse{MemberAssignment: assignment})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("%s assignment %v\n", member, act)
+			total += len(act["topic1"])
+		}
+		if total != 8 {
+			t.Errorf("with %d plain members, %d partitions were assigned", plain, total)
+		}
+	}
+}
+
+// the UserData of the assignment passes through the compression
+func TestCompressedUserData(t *testing.T) {
+	var sreq sarama.SyncGroupRequest
+	err := sreq.AddGroupAssignmentMember("member0",
+		&sarama.ConsumerGroupMemberAssignment{
+			Version:  1,
+			Topics:   map[string][]int32{"topic1": []int32{0, 2}},
+			UserData: []byte("framework data"),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// have the compressing partitioner compress the assignment by partitioning nothing
+	var cp = compressed.New(roundrobin.RoundRobin)
+	var jresp = sarama.JoinGroupResponse{GroupProtocol: cp.Name()}
+	err = cp.Partition(&sreq, &jresp, &mockClient{config: sarama.NewConfig()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	act, user_data, err := cp.ParseSyncUserData(&sarama.SyncGroupResponse{MemberAssignment: sreq.GroupAssignments["member0"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(act, map[string][]int32{"topic1": []int32{0, 2}}) {
+		t.Errorf("Unexpected assignment %v", act)
+	}
+	if string(user_data) != "framework data" {
+		t.Errorf("Unexpected UserData %q", user_data)
+	}
+}
+
+// measure the size of the SyncGroupRequest's assignments with and without compression
+func BenchmarkAssignmentSize(b *testing.B) {
+	for _, parts := range []int{100, 1000, 10000} {
+		for _, members := range []int{3, 30} {
+			var mock_client = mockClient{
+				config:     sarama.NewConfig(),
+				partitions: make(map[string][]int32),
+			}
+			for t := 0; t < 4; t++ {
+				p := make([]int32, parts/4)
+				for i := range p {
+					p[i] = int32(i)
+				}
+				mock_client.partitions[fmt.Sprintf("topic%d", t)] = p
+			}
+
+			b.Run(fmt.Sprintf("partitions=%d/members=%d", parts, members), func(b *testing.B) {
+				var plain_size, compressed_size int
+				for i := 0; i < b.N; i++ {
+					sreq, _, _ := partition(b, members, members, &mock_client)
+					plain_size = 0
+					for _, a := range sreq.GroupAssignments {
+						plain_size += len(a)
+					}
+					sreq, _, _ = partition(b, members, 0, &mock_client)
+					compressed_size = 0
+					for _, a := range sreq.GroupAssignments {
+						compressed_size += len(a)
+					}
+				}
+				b.ReportMetric(float64(plain_size), "plain-bytes")
+				b.ReportMetric(float64(compressed_size), "gzip-bytes")
+			})
+		}
+	}
+}
+
+// mock sarama.Client which implements the metadata API sufficiently for our unit test purposes
+type mockClient struct {
+	config     *sarama.Config
+	partitions map[string][]int32
+}
+
+func (mc *mockClient) Config() *sarama.Config {
+	return mc.config
+}
+
+func (mc *mockClient) Brokers() []*sarama.Broker {
+	return nil
+}
+
+func (mc *mockClient) Topics() ([]string, error) {
+	var topics = make([]string, 0, len(mc.partitions))
+	for t := range mc.partitions {
+		topics = append(topics, t)
+	}
+	return topics, nil
+}
+
+func (mc *mockClient) Partitions(topic string) ([]int32, error) {
+	if p, ok := mc.partitions[topic]; ok {
+		return p, nil
+	}
+	return nil, sarama.ErrUnknownTopicOrPartition
+}
+
+func (mc *mockClient) WritablePartitions(topic string) ([]int32, error) {
+	return mc.Partitions(topic)
+}
+
+func (*mockClient) Leader(topic string, part int32) (*sarama.Broker, error) {
+	return nil, sarama.ErrBrokerNotAvailable
+}
+func (*mockClient) Replicas(topic string, part int32) ([]int32, error) {
+	return nil, sarama.ErrNotEnoughReplicas
+}
+func (*mockClient) RefreshMetadata(topics ...string) error                        { return nil }
+func (*mockClient) GetOffset(topic string, part int32, time int64) (int64, error) { return 0, nil }
+func (*mockClient) Coordinator(group string) (*sarama.Broker, error) {
+	return nil, sarama.ErrBrokerNotAvailable
+}
+func (*mockClient) RefreshCoordinator(group string) error { return nil }
+func (*mockClient) Close() error                          { return nil }
+func (*mockClient) Closed() bool                          { return false }
+func (*mockClient) InSyncReplicas(string, int32) ([]int32, error) {
+	return nil, sarama.ErrNotEnoughReplicas
+}
+func (*mockClient) Controller() (*sarama.Broker, error)                              { return nil, nil }
+func (*mockClient) RefreshController() (*sarama.Broker, error)                       { return nil, nil }
+func (*mockClient) InitProducerID() (*sarama.InitProducerIDResponse, error)          { return nil, nil }
+func (*mockClient) OfflineReplicas(topic string, partitionID int32) ([]int32, error) { return nil, nil }
+func (*mockClient) RefreshBrokers(addrs []string) error                              { return nil }
@@ -0,0 +1,238 @@
+/*
+ A partitioner which assigns partitions using a consistent hash ring
+
+ Each member is placed on a ring at many points, and each partition
+ is assigned to the member whose point follows the hash of the
+ partition's topic and number. The assignment depends only on the
+ set of members and the partitions, not on the order in which the
+ members joined, nor on any previous assignment. When a member joins
+ or leaves only the partitions near its points move.
+
+ Pure consistent hashing can be quite unbalanced, so the load of each
+ member is bounded to 25% over the average. A partition whose member
+ is full goes to the next member around the ring.
+
+ By default the members are identified by their kafka member ids.
+ Those are assigned by the coordinating broker and change each time
+ a process starts. To keep the same partitions across restarts each
+ member can instead be constructed with a stable instance id (like
+ its hostname), which it sends to the leader in its UserData. The
+ instance ids must be unique within the group.
+
+  Copyright 2016 MistSys
+*/
+
+package consistenthash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+)
+
+// a partitioner which assigns partitions using a consistent hash of the members' ids
+type consistentHashPartitioner struct {
+	instance_id string // "", or the id of this member which is stable across restarts
+}
+
+// name of the protocol
+const name = "consistenthash"
+
+// # of points on the ring per member. more points make the load more even, at the cost of cpu when partitioning
+const points_per_member = 64
+
+// how much over the average load any member can be assigned (in percent)
+const overload = 25
+
+// global instance of the partitioner, which identifies members by their kafka member ids
+var ConsistentHash = New("")
+
+// New returns a consistent hash partitioner. If instance_id is not "" then it identifies this member on the hash ring,
+// in place of the member id kafka assigns.
+func New(instance_id string) *consistentHashPartitioner {
+	return &consistentHashPartitioner{instance_id: instance_id}
+}
+
+func (*consistentHashPartitioner) Name() string { return name }
+
+func (chp *consistentHashPartitioner) PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current map[string][]int32) {
+	var user_data []byte
+	if chp.instance_id != "" {
+		user_data = []byte(chp.instance_id)
+	}
+	jreq.AddGroupProtocolMetadata(name,
+		&sarama.ConsumerGroupMemberMetadata{
+			Version:  1,
+			Topics:   topics,
+			UserData: user_data,
+		})
+}
+
+// for each topic in jresp, assign the topic's partitions to the members requesting the topic using a bounded-load consistent hash
+func (*consistentHashPartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error {
+	by_member, err := jresp.GetMembers() // map of member to metadata
+	if err != nil {
+		return err
+	}
+	// invert the data, so we have the requests grouped by topic, and note each member's key on the ring
+	by_topic := make(map[string][]member) // map of topic to members requesting the topic
+	for member_id, request := range by_member {
+		if request.Version != 1 {
+			// skip unsupported versions, just like the roundrobin partitioner
+			continue
+		}
+		key := member_id
+		if len(request.UserData) != 0 {
+			key = string(request.UserData)
+		}
+		for _, topic := range request.Topics {
+			by_topic[topic] = append(by_topic[topic], member{id: member_id, key: key})
+		}
+	}
+
+	// make sure we have fresh metadata for all these topics
+	if len(by_topic) != 0 {
+		topics := make([]string, 0, len(by_topic))
+		for t := range by_topic {
+			topics = append(topics, t)
+		}
+		err = client.RefreshMetadata(topics...)
+		if err != nil {
+			return err
+		}
+	}
+
+	assignments := make(map[string]map[string][]int32, len(by_member)) // map of member to topics, and topic to partitions
+	for topic, members := range by_topic {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		for member_id, parts := range assign(topic, partitions, members) {
+			topics, ok := assignments[member_id]
+			if !ok {
+				topics = make(map[string][]int32, len(by_topic))
+				assignments[member_id] = topics
+			}
+			topics[topic] = parts
+		}
+	}
+
+	// and encode the assignments in the sync request
+	for member_id, topics := range assignments {
+		sreq.AddGroupAssignmentMember(member_id,
+			&sarama.ConsumerGroupMemberAssignment{
+				Version: 1,
+				Topics:  topics,
+			})
+	}
+
+	return nil
+}
+
+func (chp *consistentHashPartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	assignments, _, err := chp.ParseSyncUserData(sresp)
+	return assignments, err
+}
+
+// ParseSyncUserData is ParseSync, plus it returns the UserData of the member assignment (which this partitioner doesn't use itself, but some other member might have put there)
+func (*consistentHashPartitioner) ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error) {
+	if len(sresp.MemberAssignment) == 0 {
+		// we asked for no topics, and got nothing back
+		return nil, nil, nil
+	}
+	ma, err := sresp.GetMemberAssignment()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ma.Version != 1 {
+		return nil, nil, fmt.Errorf("unsupported MemberAssignment version %d", ma.Version)
+	}
+	return ma.Topics, ma.UserData, nil
+}
+
+// ----------------------------------
+
+// a member of the group
+type member struct {
+	id  string // kafka's member id
+	key string // the member's key on the ring
+}
+
+// a point on the hash ring
+type point struct {
+	hash   uint64
+	member int // index of the member
+}
+
+type ring []point
+
+func (r ring) Len() int      { return len(r) }
+func (r ring) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r ring) Less(i, j int) bool {
+	if r[i].hash != r[j].hash {
+		return r[i].hash < r[j].hash
+	}
+	return r[i].member < r[j].member // (collisions are astronomically unlikely, but let's be deterministic anyway)
+}
+
+// hash a string to a point on the ring
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv alone doesn't spread similar strings like "topic/1" and "topic/2" around the ring, so finish with murmur3's mixer
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// assign the partitions of topic to the members. returns a map of member id -> partitions
+func assign(topic string, partitions []int32, members []member) map[string][]int32 {
+	if len(members) == 0 || len(partitions) == 0 {
+		return nil
+	}
+	// sort the members so the result is independent of the order in which they arrived
+	sort.Slice(members, func(i, j int) bool { return members[i].key < members[j].key })
+
+	r := make(ring, 0, len(members)*points_per_member)
+	for i, m := range members {
+		for p := 0; p < points_per_member; p++ {
+			r = append(r, point{hash(m.key + "#" + strconv.Itoa(p)), i})
+		}
+	}
+	sort.Sort(r)
+
+	// assign the partitions in a fixed order, so that when the load limits come into play the results are still deterministic
+	sorted := make([]int32, len(partitions))
+	copy(sorted, partitions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	max_load := (len(sorted)*(100+overload) + len(members)*100 - 1) / (len(members) * 100) // ceil(average load * (1+overload%))
+	loads := make([]int, len(members))
+	assignment := make(map[string][]int32, len(members))
+	for _, p := range sorted {
+		h := hash(topic + "/" + strconv.Itoa(int(p)))
+		i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+		// walk around the ring to the first member with room for another partition. since max_load*len(members) >= len(partitions) there always is one
+		for {
+			if i == len(r) {
+				i = 0
+			}
+			m := r[i].member
+			if loads[m] < max_load {
+				loads[m]++
+				assignment[members[m].id] = append(assignment[members[m].id], p)
+				break
+			}
+			i++
+		}
+	}
+	return assignment
+}
@@ -0,0 +1,199 @@
+/*
+  A simple kafka consumer-group client
+
+  Copyright 2016 MistSys
+*/
+
+package consistenthash_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	consumer "github.com/mistsys/sarama-consumer"
+	"github.com/mistsys/sarama-consumer/consistenthash"
+)
+
+// join the members, in the given order, and return each member's assignment
+func partition(t *testing.T, members []string, instance_ids []string, mock_client *mockClient) map[string]map[string][]int32 {
+	var jresp = sarama.JoinGroupResponse{
+		GenerationId:  1,
+		GroupProtocol: consistenthash.ConsistentHash.Name(),
+		Members:       make(map[string][]byte),
+	}
+	for i, member := range members {
+		var p consumer.Partitioner = consistenthash.ConsistentHash
+		if instance_ids != nil {
+			p = consistenthash.New(instance_ids[i])
+		}
+		jreq := sarama.JoinGroupRequest{
+			GroupId:      "group",
+			MemberId:     member,
+			ProtocolType: "consumer",
+		}
+		p.PrepareJoin(&jreq, []string{"topic1", "topic2"}, nil)
+		jresp.Members[member] = jreq.OrderedGroupProtocols[0].Metadata
+	}
+
+	var sreq = sarama.SyncGroupRequest{
+		GroupId:      "group",
+		GenerationId: 1,
+		MemberId:     members[0],
+	}
+	err := consistenthash.ConsistentHash.Partition(&sreq, &jresp, mock_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assignments := make(map[string]map[string][]int32)
+	for _, member := range members {
+		a, err := consistenthash.ConsistentHash.ParseSync(&sarama.SyncGroupResponse{MemberAssignment: sreq.GroupAssignments[member]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignments[member] = a
+	}
+	return assignments
+}
+
+func newMockClient() *mockClient {
+	mc := &mockClient{
+		config:     sarama.NewConfig(),
+		partitions: map[string][]int32{"topic1": nil, "topic2": nil},
+	}
+	for i := 0; i < 64; i++ {
+		mc.partitions["topic1"] = append(mc.partitions["topic1"], int32(i))
+	}
+	for i := 0; i < 7; i++ {
+		mc.partitions["topic2"] = append(mc.partitions["topic2"], int32(i))
+	}
+	return mc
+}
+
+func TestConsistentHashReordered(t *testing.T) {
+	mc := newMockClient()
+	a := partition(t, []string{"m0", "m1", "m2", "m3", "m4"}, nil, mc)
+	b := partition(t, []string{"m3", "m1", "m4", "m0", "m2"}, nil, mc)
+	t.Logf("assignments %v", a)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("reordering the members changed the assignments from %v to %v", a, b)
+	}
+
+	// every partition is assigned exactly once, and the load is bounded
+	for topic, parts := range mc.partitions {
+		assigned := make(map[int32]bool)
+		for member, topics := range a {
+			if n := len(topics[topic]); n > (len(parts)*125+499)/500 {
+				t.Errorf("%s was assigned %d of the %d partitions of %s", member, n, len(parts), topic)
+			}
+			for _, p := range topics[topic] {
+				if assigned[p] {
+					t.Errorf("%s partition %d assigned twice", topic, p)
+				}
+				assigned[p] = true
+			}
+		}
+		if len(assigned) != len(parts) {
+			t.Errorf("%d of the %d partitions of %s were assigned", len(assigned), len(parts), topic)
+		}
+	}
+}
+
+// when a member leaves only some of the partitions move
+func TestConsistentHashStable(t *testing.T) {
+	mc := newMockClient()
+	a := partition(t, []string{"m0", "m1", "m2", "m3", "m4"}, nil, mc)
+	b := partition(t, []string{"m0", "m1", "m2", "m3"}, nil, mc)
+
+	moved := 0
+	for member, topics := range b {
+		for topic, parts := range topics {
+			had := make(map[int32]bool)
+			for _, p := range a[member][topic] {
+				had[p] = true
+			}
+			for _, p := range parts {
+				if !had[p] {
+					moved++
+				}
+			}
+		}
+	}
+	t.Logf("%d partitions moved", moved)
+	// m4 had ~1/5th of the 71 partitions. the bounded load causes a few more to move, but far from a complete reshuffle
+	if moved > 71/2 {
+		t.Errorf("%d of 71 partitions moved when 1 of 5 members left", moved)
+	}
+}
+
+// with instance ids the assignments survive a change of member ids (as happens when processes restart)
+func TestConsistentHashInstanceIds(t *testing.T) {
+	mc := newMockClient()
+	instances := []string{"host0", "host1", "host2"}
+	a := partition(t, []string{"m0", "m1", "m2"}, instances, mc)
+	b := partition(t, []string{"x0", "x1", "x2"}, instances, mc)
+	for i := range instances {
+		am, bm := a[fmt.Sprintf("m%d", i)], b[fmt.Sprintf("x%d", i)]
+		if !reflect.DeepEqual(am, bm) {
+			t.Errorf("instance %s was assigned %v, and after restarting %v", instances[i], am, bm)
+		}
+	}
+}
+
+// mock sarama.Client which implements the metadata API sufficiently for our unit test purposes
+type mockClient struct {
+	config     *sarama.Config
+	partitions map[string][]int32
+}
+
+func (mc *mockClient) Config() *sarama.Config {
+	return mc.config
+}
+
+func (mc *mockClient) Brokers() []*sarama.Broker {
+	return nil
+}
+
+func (mc *mockClient) Topics() ([]string, error) {
+	var topics = make([]string, 0, len(mc.partitions))
+	for t := range mc.partitions {
+		topics = append(topics, t)
+	}
+	return topics, nil
+}
+
+func (mc *mockClient) Partitions(topic string) ([]int32, error) {
+	if p, ok := mc.partitions[topic]; ok {
+		return p, nil
+	}
+	return nil, sarama.ErrUnknownTopicOrPartition
+}
+
+func (mc *mockClient) WritablePartitions(topic string) ([]int32, error) {
+	return mc.Partitions(topic)
+}
+
+func (*mockClient) Leader(topic string, part int32) (*sarama.Broker, error) {
+	return nil, sarama.ErrBrokerNotAvailable
+}
+func (*mockClient) Replicas(topic string, part int32) ([]int32, error) {
+	return nil, sarama.ErrNotEnoughReplicas
+}
+func (*mockClient) RefreshMetadata(topics ...string) error                        { return nil }
+func (*mockClient) GetOffset(topic string, part int32, time int64) (int64, error) { return 0, nil }
+func (*mockClient) Coordinator(group string) (*sarama.Broker, error) {
+	return nil, sarama.ErrBrokerNotAvailable
+}
+func (*mockClient) RefreshCoordinator(group string) error { return nil }
+func (*mockClient) Close() error                          { return nil }
+func (*mockClient) Closed() bool                          { return false }
+func (*mockClient) InSyncReplicas(string, int32) ([]int32, error) {
+	return nil, sarama.ErrNotEnoughReplicas
+}
+func (*mockClient) Controller() (*sarama.Broker, error)                              { return nil, nil }
+func (*mockClient) RefreshController() (*sarama.Broker, error)                       { return nil, nil }
+func (*mockClient) InitProducerID() (*sarama.InitProducerIDResponse, error)          { return nil, nil }
+func (*mockClient) OfflineReplicas(topic string, partitionID int32) ([]int32, error) { return nil, nil }
+func (*mockClient) RefreshBrokers(addrs []string) error                              { return nil }
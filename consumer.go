@@ -8,11 +8,17 @@ package consumer
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"reflect"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Shopify/sarama"
@@ -52,6 +58,18 @@ func msgf(fmt string, msg *sarama.ConsumerMessage) {
 // minimum kafka API version required. Use this when constructing the sarama.Client's sarama.Config.MinVersion
 var MinVersion = sarama.V0_9_0_0
 
+// NewSaramaConfig returns a sarama.Config suitable for the sarama.Client passed to NewClient. It is sarama.NewConfig()
+// with the Version raised to at least MinVersion, and Consumer.Return.Errors enabled so that ErrOffsetOutOfRange is
+// handled by Config.OffsetOutOfRange. The caller can customize it further.
+func NewSaramaConfig() *sarama.Config {
+	cfg := sarama.NewConfig()
+	if !cfg.Version.IsAtLeast(MinVersion) {
+		cfg.Version = MinVersion
+	}
+	cfg.Consumer.Return.Errors = true
+	return cfg
+}
+
 // Error holds the errors generated by this package
 type Error struct {
 	Err       error    // underlying error
@@ -72,13 +90,22 @@ func (err *Error) Error() string {
 	return fmt.Sprintf("consumer-group %q: Error %s: %s", err.cl.group_name, err.Context, err.Err)
 }
 
+// Unwrap returns the underlying error, so errors.Is and errors.As see through an *Error
+func (err *Error) Unwrap() error { return err.Err }
+
+// ErrTopicAlreadyConsumed is the underlying error (see Error.Unwrap) returned by Consume and its variants when the
+// Client already has a Consumer of the topic. The existing Consumer can be used instead.
+var ErrTopicAlreadyConsumed = errors.New("topic is already being consumed")
+
 // Config is the configuration of a Client. Typically you'd create a default configuration with
 // NewConfig, modify any fields of interest, and pass it to NewClient. Once passed to NewClient the
 // Config must not be modified. (doing so leads to data races, and may caused bugs as well).
 //
 // In addition to this config, consumer's code also looks at the sarama.Config of the sarama.Client
 // supplied to NewClient, especially at the Consumer.Offsets settings, Version, Metadata.Retry.Backoff,
-// Metadata.RefreshFrequency and ChannelBufferSize.
+// Metadata.RefreshFrequency and ChannelBufferSize. In particular a partition with no committed offset (for instance
+// in a new consumer group) is consumed starting at Consumer.Offsets.Initial, which is sarama.OffsetOldest or
+// sarama.OffsetNewest (the default). A custom StartingOffset hook can override that.
 type Config struct {
 	Session struct {
 		// The allowed session timeout for registered consumers (defaults to 30s).
@@ -90,11 +117,92 @@ type Config struct {
 		// Must be within the allowed server range. Only functions if sarama.Config.Version >= 0.10.1
 		// Otherwise Session.Timeout is used for rebalancing too.
 		Timeout time.Duration
+
+		// SettleDelay is how long to wait after a rebalance before fetching the committed offsets of newly
+		// assigned partitions and starting to consume them (defaults to 0, which does not wait). Waiting
+		// gives the partitions' previous owners time to commit their final offsets, which reduces the number
+		// of messages processed twice across a rebalance. Meanwhile the partitions which stay assigned carry on,
+		// and an added partition which a later rebalance takes away again is never started. A small value, like
+		// 1s, is recommended. It should be well below Session.Timeout.
+		SettleDelay time.Duration
+
+		// Limit and Window form a circuit breaker which damps rebalance storms (Limit defaults to 0, which disables it).
+		// Once this client has joined Limit generations of the group within Window, adding or removing a Consumer no
+		// longer causes an immediate rejoin. Instead the rejoin waits until the oldest of those generations is Window
+		// old, and all the Consumers added and removed in the meantime are batched into that one rejoin. A warning is
+		// delivered on Client.Errors() when a rejoin is deferred. Rebalances started by other members are unaffected.
+		Limit  int
+		Window time.Duration
+
+		// Notify is an optional callback called whenever a rebalance changes the partitions assigned to a Consumer, with
+		// the partitions the Consumer gained and lost. It is called from the Consumer's goroutine after the lost partitions
+		// have stopped and their offsets have been committed, and before the gained partitions start. So no message of the
+		// gained partitions is delivered before it, and no message of the lost partitions is delivered after it (though
+		// messages delivered earlier can still be buffered in the Messages channel). That makes it the place to flush and
+		// rebuild per-partition state. It must not block for long, since meanwhile the Consumer doesn't
+		// respond to the client's requests (see also Consumer.AssignmentChanges(), which never holds up the Consumer).
+		Notify RebalanceNotification
 	}
 	Heartbeat struct {
 		// Interval between each heartbeat (defaults to 3s). It should be no more
 		// than 1/3rd of the Group.Session.Timout setting
 		Interval time.Duration
+		// InitialDelay is added to Interval before the first heartbeat of each generation (defaults to 0). With some
+		// brokers a heartbeat sent before the rebalance has fully completed returns ErrRebalanceInProgress, causing an
+		// unnecessary rejoin. Delaying the first heartbeat avoids that race. Interval+InitialDelay must stay well
+		// below Session.Timeout.
+		InitialDelay time.Duration
+		// Notification is an optional callback called with the outcome of every heartbeat, typically to feed metrics
+		// which show when and why the group's session expired. err is nil if the heartbeat succeeded. It is called
+		// from the client's goroutine, so it must not block.
+		Notification HeartbeatNotification
+	}
+	Errors struct {
+		// BufferSize is the capacity of the channel returned by Client.Errors() (defaults to 0, unbuffered).
+		// A buffer absorbs bursts of errors while the caller is slow to read them. With ErrorsBlock, the default,
+		// no error is ever lost but a caller which doesn't read Client.Errors() eventually stalls the client (a larger
+		// buffer only postpones that). With ErrorsDrop or ErrorsLatest the client never stalls, but errors which
+		// don't fit are lost.
+		BufferSize int
+		// Overflow is what happens to an error when the channel returned by Client.Errors() is full (defaults to ErrorsBlock).
+		// Errors are always logged with Logf, so even dropped errors can be seen in the log.
+		Overflow ErrorOverflow
+	}
+	CommitRetry struct {
+		// Max is how many times a failed commit of the final offsets of the partitions a Consumer stops consuming is
+		// retried (defaults to 0, which doesn't retry). Only failures which might be transient are retried: I/O errors,
+		// and errors saying the coordinator has moved or is unavailable. Each retry looks up the group's coordinator
+		// afresh. Offsets rejected because the group is rebalancing aren't retried; they are published to the side-channel
+		// instead. The retries are made in the background, as a member of the group's generation at the time (by then
+		// usually the generation which followed the rebalance). Offsets which still can't be committed are passed to
+		// CommitFailedNotification.
+		Max int
+		// Backoff determines how long to wait before each retry (defaults to nil, which waits
+		// sarama.Config.Metadata.Retry.Backoff). It is called concurrently by the Consumers, so it must be safe for that.
+		// Closing the Consumer cuts the wait short; one last retry is made at once, so Close() isn't delayed by the backoff.
+		Backoff Backoff
+	}
+	Metadata struct {
+		// RefreshInterval is how often the client refreshes the metadata of the topics it consumes (defaults to 0, which
+		// relies on sarama's own periodic refresh every sarama.Config.Metadata.RefreshFrequency). Whenever the number of
+		// partitions of a topic changes the client rejoins the group, so new partitions get assigned promptly.
+		RefreshInterval time.Duration
+	}
+	Close struct {
+		// GracePeriod is how long a closing Consumer waits for Done() to be called for the messages it has already delivered
+		// before it commits its final offsets (defaults to 0, which does not wait). A graceful shutdown can then commit the
+		// work which was nearly finished, rather than have it be replayed by the partitions' next owner. After the grace
+		// period the consumer commits whatever has been Done(). While a Client is closing it does not heartbeat, so
+		// GracePeriod should be well below Session.Timeout.
+		GracePeriod time.Duration
+
+		// Barrier makes closing a Client a two phase process (defaults to false, where each Consumer commits as soon as it
+		// has stopped). In the first phase every Consumer stops delivering messages and waits out GracePeriod for the
+		// messages in flight to be Done(). Only once all the Consumers have quiesced does the second phase start, where
+		// they commit their final offsets and the client leaves the group. This gives a consistent snapshot of the offsets
+		// across all the topics, for applications which keep invariants spanning several topics. It applies when the
+		// Client is closed, not when an individual Consumer is.
+		Barrier bool
 	}
 
 	// the partitioner used to map partitions to consumer group members (defaults to a round-robin partitioner)
@@ -125,6 +233,12 @@ type Config struct {
 	// partition assignment.
 	AssignmentNotification AssignmentNotification
 
+	// AssignmentUserDataNotification is an optional callback to pass the UserData which the group's leader included in
+	// this client's partition assignment to the client code. It is called after AssignmentNotification, every time the
+	// client gets a new partition assignment. It requires a Partitioner which implements UserDataPartitioner. With other
+	// Partitioners the UserData is always nil.
+	AssignmentUserDataNotification AssignmentUserDataNotification
+
 	// InOrderDone disables extra processing which permits Done() to be called out of ordera.
 	// If InOrderDone is true then Done() does not have to be be called for every message.
 	// The caller can wait and call Done() once to indicate that processing is complete for
@@ -132,6 +246,27 @@ type Config struct {
 	// This is not the historical behavior, so it is disabled by default.
 	InOrderDone bool
 
+	// MaxInFlightBytes caps the total size (the sum of the lengths of the Keys and Values) of the messages a Consumer has
+	// delivered which are not yet Done() (defaults to 0, which means no cap). Once the cap is reached the Consumer stops
+	// delivering messages until enough are Done(). A single message larger than the cap is still delivered when nothing
+	// else is in flight. This bounds memory far better than counting messages when message sizes vary. It is not used
+	// when InOrderDone is set, since then Done() isn't called for each message.
+	MaxInFlightBytes int64
+
+	// MaxOutstandingSpan caps how far, in offsets, a partition's messages are delivered beyond its oldest message which is
+	// not yet Done() (defaults to 0, which means no cap). The consumer keeps a little bookkeeping for every 128 offsets
+	// in that span, so without a cap a single message which is never Done() makes it grow without limit as consuming
+	// continues. Once the cap is reached the partition stops delivering messages, and a warning is logged, until the
+	// oldest messages are Done(). The other partitions are unaffected. It is not used when InOrderDone is set.
+	MaxOutstandingSpan int64
+
+	// StrictOrderDone makes the consumer check that Done() is called in offset order within each partition, and deliver an
+	// error whenever it is not. Pipelines which must process each partition's messages in order can use it to detect bugs.
+	// Out of order Done()s are still counted as done. Without InOrderDone each delivered message must be Done() before the
+	// next one (which is why this mode shouldn't be combined with Nack()). With InOrderDone the offsets passed to Done()
+	// must increase.
+	StrictOrderDone bool
+
 	// NoMessages disables fetching and receiving sarama.ConsumerMessage. So the consumer group participation is performed,
 	// but fetching the kafka messages is left to the caller's code (presumably using sarama.Broker.Fetch or similar low level API)
 	// NoMessages requires InOrderDone, since without seeing the messages ingress the group consumer cannot keep track of which
@@ -141,19 +276,276 @@ type Config struct {
 	// PartitionStartNotification is an optional callback to inform client code of the (partition,offset) at which we've
 	// started consuming (or, if NoMessages, at which we think the caller should start consuming)
 	PartitionStartNotification PartitionStartNotification
+
+	// PartitionBufferSize is the capacity of the queue between the goroutines consuming each partition and the goroutine
+	// tracking the offsets of the messages of the topic (defaults to 0, which means sarama.Config.ChannelBufferSize).
+	// A larger buffer keeps the partitions from waiting while the topic's goroutine is busy handling Done()s and rebalances.
+	// It is not used when InOrderDone is set, since then the partitions deliver their messages directly.
+	PartitionBufferSize int
+
+	// DeliveryOrder is the order in which the messages of different partitions are delivered (defaults to DeliverAsArrived,
+	// the cheapest). The other orders gather the messages which have already arrived from the partitions, up to
+	// PartitionBufferSize of them, and deliver that batch in the chosen order. Each partition's messages are always delivered
+	// in offset order. It is not used when InOrderDone is set, since then the partitions deliver their messages directly.
+	DeliveryOrder DeliveryOrder
+
+	// MessagesBufferSize is the capacity of the channel returned by Consumer.Messages() (defaults to 0, which means
+	// sarama.Config.ChannelBufferSize; a negative value makes the channel unbuffered, so each message is handed directly
+	// to the reader). A buffer smooths the delivery to bursty readers. Buffering doesn't affect which offsets are
+	// committed: a message counts as outstanding from the moment the Consumer puts it in the channel (when InOrderDone is
+	// not set, from the moment the topic's goroutine receives it from its partition), until it is Done(). So messages
+	// sitting unread in the buffer are never committed, and if the Consumer is closed they are redelivered by the
+	// partitions' next owner.
+	MessagesBufferSize int
+
+	// CaughtUpNotification is an optional callback to inform client code that consuming a partition has caught up.
+	// When a partition is assigned to this client its high-water mark is noted. Once the message just before the high-water
+	// mark has been delivered (or immediately if there was nothing to consume) the callback is called. The last offsets
+	// before the high-water mark can be transaction markers, which are never delivered; then the callback is called once
+	// sarama's fetches have reached the high-water mark and found nothing more to deliver for two sarama.Config.Consumer.MaxWaitTimes.
+	// From then on the partition is tailing live messages. This is useful to know when an in-memory state rebuilt from the topic is warm.
+	// It is called again each time the partition is reassigned to this client. It is not called if NoMessages is set.
+	CaughtUpNotification CaughtUpNotification
+
+	// ShareSaramaConsumer causes all the Consumers of a Client to share a single sarama.Consumer. Otherwise each call
+	// to Client.Consume creates its own sarama.Consumer (and each call to Client.ConsumeMany creates one sarama.Consumer
+	// for its topics). Sharing reduces the overhead of consuming many topics. The shared sarama.Consumer is closed
+	// when the Client is closed.
+	ShareSaramaConsumer bool
+
+	// OnDeliver is an optional hook called with each message just before it is sent on the Messages channel. It is
+	// intended for instrumentation, like extracting a tracing context from the message's headers and starting a span.
+	// It must not block, since it is called from the goroutine which delivers the topic's messages.
+	OnDeliver func(*sarama.ConsumerMessage)
+
+	// OnMessageAge is an optional metrics callback called with the age of each message (the time elapsed since the
+	// message's timestamp) just before the message is sent on the Messages channel. It measures the freshness of the
+	// consumed messages without code in every message handler. Messages without a timestamp (those produced to brokers
+	// older than kafka 0.10) are skipped. Like OnDeliver it must not block.
+	OnMessageAge OnMessageAge
+
+	// JoinOnlyWhenConsuming keeps the client out of the consumer group while it has no Consumers (defaults to false, where
+	// the client joins the group as soon as it is created, and remains a member with no topics once its last Consumer is
+	// closed). With it set, NewClient returns without joining, and the client joins when the first Consumer is created,
+	// and leaves the group when the last one is closed. That avoids pointless group membership, and the rebalances of the
+	// group it causes, for clients which are often idle. Note that NewClient then can't report a failure to reach the
+	// group's coordinator; such errors are delivered on Errors() once the client joins.
+	JoinOnlyWhenConsuming bool
+
+	// LazyStartInterval enables starting empty partitions lazily, and is how often they are checked for new messages
+	// (defaults to 0, which starts every assigned partition immediately). A partition is empty when its starting offset
+	// is its high-water mark. Consuming an empty partition is deferred until messages arrive, which saves the idle fetches
+	// of topics with many mostly empty partitions. Messages arriving in a deferred partition are delayed by up to
+	// LazyStartInterval. It is not used when NoMessages is set.
+	LazyStartInterval time.Duration
+
+	// MaxConcurrentPartitionStarts limits how many newly assigned partitions of a topic are started concurrently (defaults
+	// to 0, which means no limit). Starting a partition requires a few round trips to the kafka brokers. When hundreds of
+	// partitions are assigned at once a limit avoids a thundering herd of requests.
+	MaxConcurrentPartitionStarts int
+
+	// PartitionErrorThreshold is the number of consecutive errors from a partition's sarama.PartitionConsumer after which
+	// the partition consumer is closed and restarted at the offset following the last message it delivered (defaults to 0,
+	// which never restarts). This heals partitions which are stuck returning errors, for instance after a botched
+	// reassignment of the partition's leader. ErrOffsetOutOfRange isn't counted; it is handled by OffsetOutOfRange. If the
+	// partition consumer can't be restarted the partition is given up and the client rejoins the consumer group.
+	PartitionErrorThreshold int
+
+	// PartitionRateLimit caps the rate at which messages of each partition are delivered, in messages per second (defaults
+	// to 0, which means no limit). It is the initial limit of every Consumer. Consumer.SetRateLimit changes it for one
+	// Consumer. It is useful when a downstream dependency is rate limited. It is not used when NoMessages is set.
+	PartitionRateLimit float64
+
+	// CommitStallTimeout enables a watchdog which reports partitions whose committable offset hasn't advanced for longer
+	// than CommitStallTimeout while messages are outstanding (defaults to 0, which disables the watchdog). That is the
+	// symptom of a message which is never passed to Done(), which otherwise silently stops the partition's commits.
+	// Each stall is reported once, as an error on Client.Errors() and to the optional CommitStalledNotification.
+	// The partitions are checked every CommitStallTimeout/2, so a stall is reported up to 1.5*CommitStallTimeout after it began.
+	CommitStallTimeout time.Duration
+
+	// CommitFailedNotification is an optional callback called with the final offsets of partitions which a Consumer
+	// stopped consuming but could not commit to kafka, even after retrying as configured by CommitRetry. The offsets, a
+	// map of partition -> offset of the next message to consume, can be persisted elsewhere for manual recovery.
+	// Otherwise the partitions' next owner starts at their older committed offsets and reprocesses messages.
+	CommitFailedNotification CommitFailedNotification
+
+	// CommitStalledNotification is an optional callback to inform client code, typically its metrics, that the watchdog
+	// enabled by CommitStallTimeout found a stalled partition.
+	CommitStalledNotification CommitStalledNotification
+
+	// Filter is an optional predicate which selects the messages to deliver. Messages for which it returns false are
+	// never delivered on the Messages channel. Instead they are passed to Done() automatically, so the committed offsets
+	// advance past them as usual. This saves the caller the work of receiving and Done()ing messages it doesn't want.
+	// In Stats() filtered messages count as both Delivered and Done. Filter is called from the goroutines which deliver
+	// messages, so it must be fast and must not block. A panic in Filter is recovered and reported on Client.Errors(),
+	// and the message is delivered. It is not used when NoMessages is set.
+	Filter func(*sarama.ConsumerMessage) bool
+
+	// IdleTimeout closes Consumers which have had no partitions assigned for IdleTimeout (defaults to 0, which never
+	// closes them). The idle Consumer is AsyncClose()ed exactly as if the caller had done so, which frees its sarama.Consumer
+	// and causes the client to rejoin the group without the topic. Like any change of membership, that causes the consumer
+	// group to rebalance. The clock starts once the Consumer receives its first assignment, so a Consumer which is waiting
+	// for the group to form isn't idle. The idle state is checked every IdleTimeout/2.
+	IdleTimeout time.Duration
+
+	// TickInterval is how often each Consumer sends the time to the channel returned by Consumer.Ticks() (defaults to 0,
+	// which never ticks). It gives a handler which selects on Messages() a timer in the same loop, so it can flush or
+	// checkpoint derived state periodically even when its partitions are idle. Setting it to the commit interval
+	// (sarama.Config.Consumer.Offsets.AutoCommit.Interval) aligns that work with the commits. Like a time.Ticker, ticks
+	// which aren't read in time are dropped.
+	TickInterval time.Duration
+
+	// Deduplicate suppresses delivering messages which were already passed to Done() earlier in this process's lifetime.
+	// For each partition the consumer remembers the offset below which all messages were Done() when it stopped consuming
+	// the partition. If the partition is later assigned to this client again and starts at an older offset (because the
+	// final commit was rejected during the rebalance, for example) the messages up to that offset are skipped. It costs
+	// one offset per partition. It only helps within a process; nothing is remembered across restarts. The offset is
+	// forgotten when the partition's committed offset is older and isn't the last offset this client committed, since
+	// then someone else moved it (an operator resetting the group's offsets, for example), or the topic was recreated.
+	Deduplicate bool
+
+	// ResumeLocalOffsets makes a partition which is assigned to this client again resume at the offset where this process
+	// stopped consuming it, when that is beyond the partition's committed offset (and beyond what the side-channel knows).
+	// The offset is the one below which all messages were Done(), as with Deduplicate. Where Deduplicate fetches the
+	// messages again but doesn't deliver them, ResumeLocalOffsets doesn't fetch them at all. That matters with sticky
+	// assignments, where a member often regains the partitions it just lost, and the final commit of those partitions
+	// raced with the rebalance or failed. Like Deduplicate it only helps within a process. A committed offset which isn't
+	// the last one this client committed is always honored, so resetting the group's offsets backwards still works.
+	ResumeLocalOffsets bool
+
+	// Backoff determines how long the client pauses after a failure before it tries again (defaults to an ExponentialBackoff
+	// from 250ms to 10s). If it is nil the client always pauses for sarama.Config.Metadata.Retry.Backoff.
+	// If the Backoff has state then each Client needs its own.
+	Backoff Backoff
+
+	// NackDelay is how long Consumer.Nack() waits before redelivering a message (defaults to 1s)
+	NackDelay time.Duration
+
+	// FetchedOffsetNotification is an optional callback to inform client code of the committed offset, and the metadata
+	// string committed alongside it, which were fetched from kafka when a partition is assigned to this client. This is
+	// useful for recovering a checkpoint, or for forensics about which instance last committed the partition.
+	// If the offset was learned from the side-channel then the metadata is "".
+	FetchedOffsetNotification FetchedOffsetNotification
+
+	// OffsetResetNotification is an optional callback to inform client code that no committed offset was found for a
+	// partition assigned to this client, and so consuming starts at the offset returned by the StartingOffset hook
+	// (by default sarama.Config.Consumer.Offsets.Initial). This happens the first time a consumer group consumes a
+	// topic, but also when the group's offsets are lost because they expired or because the topic was recreated.
+	OffsetResetNotification OffsetResetNotification
+
+	// LogAssignments is a diagnostic flag. When it is set and this client is the group's leader it logs the complete
+	// member->topic->partitions matrix computed by the Partitioner at each rebalance. It works with any Partitioner
+	// whose assignments are sarama.ConsumerGroupMemberAssignments.
+	LogAssignments bool
+
+	// AssignmentPublisher is an optional callback through which the group's leader publishes the complete assignment it
+	// computed each generation, before sending it to the members. It is intended for publishing the authoritative
+	// assignment to an external store for dashboards and tooling. Only the leader calls it, so in a group where every
+	// member sets it, it is called once per generation. It is called from the goroutine managing the group membership,
+	// so it must not block for long.
+	AssignmentPublisher AssignmentPublisher
+
+	// MemberMetadataNotification is an optional callback through which the group's leader receives the metadata every
+	// member advertised when joining the group, each generation. Application code running on the leader can base
+	// decisions on what the members advertise in their UserData, piggybacking on the group protocol rather than needing
+	// a channel of its own. Only the leader calls it. It is called before the Partitioner partitions the group, from the
+	// goroutine managing the group membership, so it must not block for long.
+	MemberMetadataNotification MemberMetadataNotification
+
+	// CommitLastConsumed selects the convention of the offsets committed to kafka. Kafka's own convention, which the java
+	// client follows and which is the default, is to commit the offset of the next message to consume (the last consumed
+	// offset+1). Some other clients commit the offset of the last consumed message instead. Set CommitLastConsumed to
+	// interoperate with them in the same consumer group. The offsets are converted only on their way to and from kafka.
+	// Every offset seen by the rest of the API (the StartingOffset hook, Commit(), the notifications and Stats()) is the
+	// next offset to consume, and the side-channel always uses kafka's convention. Note that with CommitLastConsumed
+	// nothing is committed for a partition until at least one of its messages has been consumed.
+	CommitLastConsumed bool
 }
 
+// ErrorOverflow is the strategy for handling errors which don't fit in the channel returned by Client.Errors()
+type ErrorOverflow int
+
+const (
+	// ErrorsBlock waits until the error can be delivered. No error is ever lost, but the goroutine which had the error
+	// (which might be the one heartbeating) is blocked until the caller reads from Client.Errors(). This is the historical behavior.
+	ErrorsBlock ErrorOverflow = iota
+	// ErrorsDrop drops the new error
+	ErrorsDrop
+	// ErrorsLatest drops the oldest buffered error to make room for the new error, so the most recent errors are always
+	// available. It requires Config.Errors.BufferSize > 0; with an unbuffered channel it behaves like ErrorsDrop.
+	ErrorsLatest
+)
+
+// DeliveryOrder is the order in which a Consumer delivers the messages of different partitions
+type DeliveryOrder int
+
+const (
+	// DeliverAsArrived delivers each message as soon as it arrives from its partition. When several partitions have messages
+	// waiting the choice between them is random. This is the historical behavior.
+	DeliverAsArrived DeliveryOrder = iota
+	// DeliverRoundRobin takes turns between the partitions which have messages waiting, so a busy partition can't starve the others
+	DeliverRoundRobin
+	// DeliverByTimestamp delivers the waiting message with the oldest sarama.ConsumerMessage.Timestamp first
+	DeliverByTimestamp
+)
+
 // types of the functions in the Config
 type StartingOffset func(topic string, partition int32, committed_offset int64, client sarama.Client) (offset int64, err error)
 type OffsetOutOfRange func(topic string, partition int32, client sarama.Client) (offset int64, err error)
-type AssignmentNotification func(assignments map[string][]int32)                  // assignments is a map from topic -> list of partitions
-type PartitionStartNotification func(topic string, partition int32, offset int64) // position at which we're going to start consuming from the partition
+type AssignmentNotification func(assignments map[string][]int32)                                        // assignments is a map from topic -> list of partitions
+type AssignmentUserDataNotification func(user_data []byte)                                              // user_data is the UserData of the member assignment
+type PartitionStartNotification func(topic string, partition int32, offset int64)                       // position at which we're going to start consuming from the partition
+type FetchedOffsetNotification func(topic string, partition int32, offset int64, metadata string)       // committed offset and metadata fetched from kafka
+type CaughtUpNotification func(topic string, partition int32)                                           // partition has caught up with its high-water mark
+type OffsetResetNotification func(topic string, partition int32, offset int64)                          // offset at which we're starting since there was no committed offset
+type AssignmentPublisher func(generation_id int32, assignments map[string]map[string][]int32)           // assignments is a map from member -> topic -> list of partitions
+type CommitStalledNotification func(topic string, partition int32, offset int64, stalled time.Duration) // committable offset which hasn't advanced for the stalled duration
+type CommitFailedNotification func(topic string, offsets map[int32]int64, err error)                    // offsets which couldn't be committed, and the last error
+type OnMessageAge func(topic string, partition int32, age time.Duration)                                // age of a message about to be delivered
+type HeartbeatNotification func(generation_id int32, latency time.Duration, err error)                  // outcome and round trip time of a heartbeat
+type RebalanceNotification func(topic string, added, removed []int32)                                   // partitions gained and lost by a Consumer in a rebalance
+
+// members is a map from member id -> the metadata the member sent in its JoinGroupRequest
+type MemberMetadataNotification func(generation_id int32, members map[string]sarama.ConsumerGroupMemberMetadata)
 
 // default implementation of Config.OffsetOutOfRange jumps to the current head of the partition.
 func DefaultOffsetOutOfRange(topic string, partition int32, client sarama.Client) (int64, error) {
 	return sarama.OffsetNewest, nil
 }
 
+// Backoff computes how long the client pauses before retrying after a failure (to join the group, contact the
+// coordinating broker, heartbeat, and so on).
+type Backoff interface {
+	// NextDelay returns how long to pause before the attempt'th consecutive retry. attempt starts at 0.
+	NextDelay(attempt int) time.Duration
+	// Reset is called once the client has successfully joined the group, so stateful implementations can start over.
+	Reset()
+}
+
+// ExponentialBackoff is a Backoff which doubles the delay with each attempt, from Min up to Max, and randomly
+// shortens each delay by up to half so that clients which fail together don't all retry together.
+// It has no state, so it can be shared.
+type ExponentialBackoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (eb ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	delay := eb.Min
+	for i := 0; i < attempt && delay < eb.Max; i++ {
+		delay *= 2
+	}
+	if delay > eb.Max {
+		delay = eb.Max
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+func (ExponentialBackoff) Reset() {}
+
 // default implementation of Config.StartingOffset starts at the committed offset, or at sarama.Config.Consumer.Offsets.Initial
 // if there is no committed offset.
 func DefaultStartingOffset(topic string, partition int32, offset int64, client sarama.Client) (int64, error) {
@@ -173,6 +565,8 @@ func NewConfig() *Config {
 	cfg.OffsetOutOfRange = DefaultOffsetOutOfRange
 	cfg.StartingOffset = DefaultStartingOffset
 	cfg.SidechannelTopic = "sarama-consumer-sidechannel-offsets"
+	cfg.Backoff = ExponentialBackoff{Min: 250 * time.Millisecond, Max: 10 * time.Second}
+	cfg.NackDelay = time.Second
 	return cfg
 }
 
@@ -190,13 +584,42 @@ func NewConfig() *Config {
   The supplied sarama.Client should have been constructed with a sarama.Config
   where sarama.Config.Version is >= consumer.MinVersion, and if full handling of
   ErrOffsetOutOfRange is desired, sarama.Config.Consumer.Return.Errors = true.
+  NewSaramaConfig returns such a sarama.Config.
 
   In addition, this package uses the settings in sarama.Config.Consumer.Offsets
   and sarama.Config.Metadata.RefreshFrequency
+
+  To be a member of several consumer groups call NewClient once per group, passing
+  the same sarama.Client each time. There is no need for a separate sarama.Client
+  per group. The Clients share sarama's metadata, its broker connections, and its
+  cache of coordinators. That cache is keyed by group name, so the RefreshCoordinator
+  of one group doesn't invalidate the coordinator of another, and Clients of the same
+  group which refresh their coordinator at the same moment share a single refresh. Each Client costs one
+  manager goroutine and, unless Config.ShareSaramaConsumer is set, one sarama.Consumer
+  per Consume. The one interference between the groups is that when a Client loses
+  its connection to its coordinator it closes and reopens the connection to that broker,
+  which interrupts the requests in flight of every other user of that broker, including
+  the other groups' Clients. They retry, as they would after any network error.
 */
 func NewClient(group_name string, config *Config, sarama_client sarama.Client) (Client, error) {
+	return NewClientContext(context.Background(), group_name, config, sarama_client)
+}
+
+// NewClientContext is NewClient, except that if ctx is done before the client has made contact with the group's
+// coordinator it gives up and returns ctx.Err(). Services which must fail fast at startup (say when the coordinator is
+// unreachable) can bound the wait with a context.WithTimeout. Once NewClientContext has returned, ctx has no effect.
+// A request to kafka which is in flight when ctx is done can't be interrupted, so the abandoned client finishes
+// shutting down in the background.
+func NewClientContext(ctx context.Context, group_name string, config *Config, sarama_client sarama.Client) (Client, error) {
+
+	if config == nil {
+		config = NewConfig()
+	}
 
-	// sanity check
+	// sanity checks
+	if v := sarama_client.Config().Version; !v.IsAtLeast(MinVersion) {
+		return nil, fmt.Errorf("invalid sarama.Config: .Version %v is too old; consumer groups require at least consumer.MinVersion %v (see consumer.NewSaramaConfig)", v, MinVersion)
+	}
 	if config.NoMessages && !config.InOrderDone {
 		return nil, fmt.Errorf("invalid sarama-consumer.Config: .NoMessages requires .InOrderDone")
 	}
@@ -206,20 +629,35 @@ func NewClient(group_name string, config *Config, sarama_client sarama.Client) (
 		config:     config,
 		group_name: group_name,
 
-		errors: make(chan error),
+		errors: make(chan error, config.Errors.BufferSize),
 
 		closed:             make(chan struct{}),
+		exited:             make(chan struct{}),
+		stable:             make(chan struct{}),
 		add_consumers:      make(chan add_consumers),
 		rem_consumer:       make(chan *consumer),
+		topics_reqs:        make(chan chan<- map[string][]int32),
+		status_reqs:        make(chan chan<- ClientStatus),
+		partitioners:       make(chan Partitioner),
+		rejoin:             make(chan struct{}, 1),
+		retry_now:          make(chan struct{}, 1),
 		sidechannel_commit: make(chan map[string][]SidechannelOffset),
 	}
 
 	// start the client's manager goroutine
-	rc := make(chan error)
+	rc := make(chan error, 1) // (buffered, so client.run never waits for us should we give up)
 	cl.wg.Add(1)
 	go cl.run(rc)
 
-	return cl, <-rc
+	select {
+	case err := <-rc:
+		return cl, err
+	case <-ctx.Done():
+		// abandon the client. client.run sees cl.closed as soon as it waits for anything (for instance in the pause
+		// before it retries contacting the coordinator) and shuts down
+		close(cl.closed)
+		return nil, ctx.Err()
+	}
 }
 
 /*
@@ -233,6 +671,16 @@ type Client interface {
 	// repeatedly because kafka brokers serialize joining topics
 	ConsumeMany(topics []string) ([]Consumer, error)
 
+	// ConsumeWhenCreated is Consume, except that if topic doesn't exist yet it first waits up to timeout for the topic to
+	// be created, polling the metadata every sarama.Config.Metadata.Retry.Backoff. This removes the need to coordinate
+	// the startup of the process creating the topic and the consumers. If the topic still doesn't exist after timeout an
+	// error is returned, and the group is never joined with the topic.
+	ConsumeWhenCreated(topic string, timeout time.Duration) (Consumer, error)
+
+	// ConsumeContext is Consume, except that if ctx is done before the client has accepted the new consumer it gives up
+	// and returns ctx.Err(). (The client accepts new consumers whenever it isn't waiting for a response from kafka.)
+	ConsumeContext(ctx context.Context, topic string) (Consumer, error)
+
 	// Close closes the client. It must be called to shutdown
 	// the client. It cleans up any unclosed topic Consumers created by this Client.
 	// It does NOT close the inner sarama.Client.
@@ -243,9 +691,77 @@ type Client interface {
 	// for errors. callers should probably log or otherwise report
 	// the returned errors. The channel closes when the client
 	// is closed.
+	// It carries the errors of the client and of all its Consumers
+	// (Consumers have no error channel of their own). The errors are
+	// *Error, and their Consumer, Topic and Partition fields tell
+	// which Consumer and partition, if any, they concern.
 	Errors() <-chan error
 
-	// TODO have a Status() method for debug/logging? Or is Errors() enough?
+	// PauseAll stops the delivery of messages from all of this client's Consumers. The client
+	// continues to heartbeat and to commit offsets, so it keeps its membership in the consumer
+	// group and its partition assignments, and no rebalance is triggered. This is useful during
+	// a transient outage of a downstream dependency, when closing the consumers would cause a
+	// rebalance storm. Calling PauseAll when already paused has no effect.
+	PauseAll()
+
+	// ResumeAll resumes the delivery of messages after a PauseAll. Calling ResumeAll when not
+	// paused has no effect.
+	ResumeAll()
+
+	// MemberCount returns the number of members in the consumer group. If this client was the leader
+	// of the current generation it already knows the answer. Otherwise it asks the group's coordinating
+	// broker. This is useful for deciding whether the group is over or under provisioned.
+	MemberCount() (int, error)
+
+	// WaitStable waits until the client has joined the consumer group and handed its partition assignment (which
+	// might be empty) to its Consumers, or until timeout has passed, in which case it returns an error. If the client
+	// is already a stable member of the group it returns immediately. It is intended for tests and for coordinating
+	// startup. Note the group can begin rebalancing again at any time.
+	WaitStable(timeout time.Duration) error
+
+	// Topics returns every topic being consumed by this client's Consumers, and the partitions of each topic which are
+	// currently assigned to this client (nil if there are none). It is intended for management UIs. While the group is
+	// rebalancing the partitions are those of the previous generation. Once the client has stopped it returns nil.
+	Topics() map[string][]int32
+
+	// CommittedOffsets fetches from kafka the consumer group's committed offset of every partition of topic, whether or
+	// not the partition is assigned to this client, and whether or not topic is being consumed by this client. Partitions
+	// with no committed offset have an offset of sarama.OffsetNewest. Like every offset in this API the offsets are those
+	// of the next message to consume. It is intended for monitoring, like reporting the group's lag. Offsets published only
+	// to the side-channel are not included.
+	CommittedOffsets(topic string) (map[int32]int64, error)
+
+	// SetPartitioner replaces Config.Partitioner. It takes effect the next time the client joins the group; it does not
+	// itself cause a rebalance. A nil p reverts to Config.Partitioner. It is meant for migrating a group from one
+	// partitioner to another without recreating the clients. Note that the group can only sync once all its members
+	// propose a partitioner in common, so a migration must be rolled out in steps (for instance by first switching every
+	// member to a partitioner which proposes both the old and new protocols, as compressed.New() does), or the group
+	// won't sync while the members disagree.
+	SetPartitioner(p Partitioner)
+
+	// CopyOffsetsFrom copies the committed offsets of topic in consumer group old_group to this client's consumer group,
+	// so a group can be renamed (for instance to version the group names of a breaking deployment) without reprocessing
+	// or skipping any messages. Partitions for which old_group has no committed offset are left alone. Both groups must
+	// use the same Config.CommitLastConsumed convention. It refuses to copy while this client consumes topic, since its
+	// commits would race with the copy. So call it before consuming topic anywhere in the group. While the client isn't
+	// a member of the group (see JoinOnlyWhenConsuming) the coordinator accepts the copy only if the group is empty.
+	CopyOffsetsFrom(old_group string, topic string) error
+
+	// Rebalances returns the most recent times (up to 16) the client joined the consumer group, oldest first, and why.
+	// Each join rebalances the group. It is intended for answering "why is this group constantly rebalancing?"
+	Rebalances() []Rebalance
+
+	// RetryNow cuts short the pause the client takes after a failure to join the group (see Config.Backoff), or a rejoin
+	// deferred by the rebalance circuit breaker (see Config.Rebalance.Limit), and resets the Backoff, so the client tries
+	// again immediately. It is meant for operators who have just fixed a broker problem and don't want to wait out a long
+	// backoff. It has no effect while the client isn't waiting.
+	RetryNow()
+
+	// Status returns a snapshot of the client's membership in the group, and of the partitions it is consuming and their
+	// committed offsets. It is intended for operational dashboards showing which client owns which partitions. Like
+	// Topics(), while the group is rebalancing the partitions are those of the previous generation. The snapshot is a copy
+	// which the caller is free to alter.
+	Status() ClientStatus
 }
 
 /*
@@ -273,8 +789,82 @@ type Consumer interface {
 	// garbage message, can cause trouble.
 	// Calling Done on message out of order is supported, and the consumer keeps
 	// track of the correct offset to commit to kafka.
+	// It is safe to call Done after AsyncClose, so shutdown code can keep passing
+	// the messages it finishes to Done. Until the consumer has committed its final
+	// offsets (which waits up to Config.Close.GracePeriod for outstanding messages)
+	// Done is counted as usual. After that Done returns immediately, doing nothing.
 	Done(*sarama.ConsumerMessage)
 
+	// Nack indicates the processing of the message failed, and the message should be delivered again
+	// on the Messages channel after Config.NackDelay. The message is redelivered from memory, not
+	// refetched from kafka. If the message's partition is unassigned from this consumer before the
+	// message is redelivered then the redelivery is dropped (the partition's next owner will consume
+	// the message instead). Until the redelivered message is passed to Done its offset cannot be
+	// committed, so, just like never calling Done, Nack()ing a message over and over stalls the
+	// committed offset of its partition.
+	Nack(*sarama.ConsumerMessage)
+
+	// Commit commits the given offsets (a map of partition -> offset) to kafka, bypassing the bookkeeping done by Done.
+	// By kafka's convention the offset of a partition is the offset of the next message to consume. Every partition
+	// must currently be assigned to this consumer; otherwise nothing is committed and an error is returned.
+	// It is intended for migrations and testing. Note that the consumer's own commits, which happen periodically and
+	// whenever a partition is unassigned, will overwrite these offsets.
+	Commit(offsets map[int32]int64) error
+
+	// Rewind reprocesses the last n messages of each partition assigned to this consumer. Each partition is restarted at
+	// its committable offset minus n (but no earlier than the oldest offset kafka still has), and the messages from there
+	// on are delivered again. Every message delivered so far must have been Done(); otherwise nothing is rewound and an
+	// error is returned. It is an operational tool, for instance for reprocessing messages after deploying a fix to the
+	// code processing them. It isn't supported when Config.NoMessages is set. With Config.InOrderDone a message which was
+	// on its way to the Messages channel when Rewind was called may still arrive ahead of the rewound messages. Its Done()
+	// is ignored until the rewound partition has caught up to it. If a partition can't be rewound its error is returned.
+	Rewind(n int64) error
+
+	// Stats returns a consistent snapshot of the state of each partition currently assigned to this consumer.
+	// It is intended for operational dashboards and debugging. Once the consumer is closed it returns no partitions.
+	Stats() ConsumerStats
+
+	// Lag returns how far behind kafka each partition currently assigned to this consumer is: the number of messages
+	// from its committable offset (see PartitionStats.Committable) up to its high-water mark. Partitions whose
+	// high-water mark or committable offset isn't known yet (and, with Config.NoMessages, every partition) are left out.
+	// It is intended for alerting on a stuck consumer.
+	Lag() map[int32]int64
+
+	// AssignmentChanges returns a channel which receives this consumer's partition assignment each time the
+	// consumer group rebalances. It always returns the same channel, and the channel is closed when the consumer
+	// closes. Reading from it is optional. A slow reader never stalls consuming: if the previous Assignment has not
+	// yet been read it is replaced by one which combines both changes.
+	AssignmentChanges() <-chan Assignment
+
+	// Ticks returns a channel which receives the time every Config.TickInterval. It always returns the same channel, and
+	// the channel is closed when the consumer closes. Reading from it is optional; a tick which isn't read before the next
+	// one is dropped. Without a Config.TickInterval the channel never receives anything.
+	Ticks() <-chan time.Time
+
+	// SetRateLimit limits the rate at which the messages of each partition are delivered to per_second messages per second.
+	// A per_second <= 0 removes the limit. Messages are paced before they are delivered, so the offsets to commit are
+	// unaffected, and while the client is paused nothing accumulates: once resumed the messages continue at the limited pace.
+	// It takes effect with the next message of each partition.
+	SetRateLimit(per_second float64)
+
+	// LastInFetch is a hint that msg was the last message of its partition which had been fetched from kafka when msg was
+	// received from sarama. A caller which batches its work can use it to flush a batch opportunistically, rather than
+	// waiting for more messages which haven't arrived. It is only a hint: more messages can arrive at any time, and when
+	// it returns false there might be no more messages for a while. It is only accurate for the most recently
+	// delivered message of each partition.
+	LastInFetch(msg *sarama.ConsumerMessage) bool
+
+	// Pause stops the delivery of the messages of partition, for instance while a downstream dependency of that
+	// partition's keys is down. Like Client.PauseAll, the consumer keeps the partition's assignment, offsets and
+	// heartbeats, so no rebalance is triggered. Messages already on their way to the Messages channel are still
+	// delivered. The pause outlasts the partition's assignment: if the partition is reassigned to this consumer in a
+	// later generation it is still paused. Pausing a paused partition has no effect.
+	Pause(partition int32)
+
+	// Resume resumes the delivery of the messages of a partition after a Pause, where it left off. Resuming a partition
+	// which isn't paused has no effect.
+	Resume(partition int32)
+
 	// AsyncClose terminates the consumer cleanly. Callers can continue to read from
 	// Messages channel until it is closed, or not, as they wish.
 	// Calling Client.Close() performs a AsyncClose() on any remaining consumers.
@@ -282,9 +872,90 @@ type Consumer interface {
 	// Never calling AsyncClose is also permitted. Client.Close() implies Consumer.AsyncClose.
 	AsyncClose()
 
+	// Closed returns a channel which is closed once the consumer has shut down, after it has committed its final offsets.
+	// It is the same point at which Close returns, so AsyncClose followed by waiting on Closed is equivalent to Close.
+	// It always returns the same channel.
+	Closed() <-chan struct{}
+
 	// Close terminates the consumer and waits for it to be finished committing the current
-	// offsets to kafka. Calling twice happens to work at the moment, but let's not encourage it.
-	Close()
+	// offsets to kafka (which includes waiting up to Config.Close.GracePeriod for outstanding
+	// messages to be Done()). Meanwhile it reads and discards any messages the caller hasn't read
+	// from the Messages channel; they are never Done(), so their offsets aren't committed, and the
+	// partitions' next consumers receive them again. The grace period doesn't wait for them, only
+	// for the messages the caller did read. It returns the last error committing the final
+	// offsets, if any could not be committed. (Errors are still reported through Client.Errors(),
+	// which Close does not drain since it is shared by all the client's consumers.)
+	// Calling twice happens to work at the moment, but let's not encourage it.
+	Close() error
+}
+
+// RebalanceReason says why a client joined the consumer group
+type RebalanceReason string
+
+const (
+	RebalanceStart           RebalanceReason = "start"            // the client joined the group for the first time
+	RebalanceConsumerAdded   RebalanceReason = "consumer added"   // a Consumer was created
+	RebalanceConsumerRemoved RebalanceReason = "consumer removed" // a Consumer was closed
+	RebalanceRequested       RebalanceReason = "requested"        // a Consumer gave up a partition it couldn't consume, and asked for a new assignment
+	RebalanceHeartbeat       RebalanceReason = "heartbeat"        // a heartbeat failed. ErrRebalanceInProgress means another member started the rebalance
+	RebalanceCommit          RebalanceReason = "commit"           // committing offsets failed
+	RebalancePartitions      RebalanceReason = "partitions"       // the # of partitions of a consumed topic changed, or couldn't be looked up
+	RebalanceCoordinator     RebalanceReason = "coordinator"      // the group's coordinating broker couldn't be found or reached
+	RebalanceJoinFailed      RebalanceReason = "join failed"      // the previous JoinGroup failed
+	RebalanceSyncFailed      RebalanceReason = "sync failed"      // the previous SyncGroup failed
+	RebalancePartitioning    RebalanceReason = "partitioning"     // the Partitioner failed, or the assignment couldn't be decoded
+)
+
+// Rebalance records one time the client joined the consumer group
+type Rebalance struct {
+	Time   time.Time
+	Reason RebalanceReason
+	Err    error // the error behind Reason, if any
+}
+
+// Assignment describes a change in the partitions of a topic assigned to a Consumer
+type Assignment struct {
+	Topic      string
+	Generation int32   // the consumer group generation
+	Partitions []int32 // the partitions now assigned to the consumer, sorted
+	Added      []int32 // partitions which were added since the previous Assignment, sorted
+	Removed    []int32 // partitions which were removed since the previous Assignment, sorted
+}
+
+// ClientStatus is a snapshot of the state of a Client, as returned by Client.Status()
+type ClientStatus struct {
+	GroupName    string
+	GenerationId int32                  // generation of the group of which the client is a stable member, or -1 while it isn't
+	MemberId     string                 // the client's member id, or "" if it hasn't been assigned one
+	Topics       map[string]TopicStatus // status of each topic being consumed
+}
+
+// TopicStatus is the state of one of the topics in a ClientStatus
+type TopicStatus struct {
+	Partitions []int32         // partitions currently assigned to the client, in increasing order
+	Committed  map[int32]int64 // offset last successfully committed to kafka by this client of each of the Partitions, or -1 if none
+}
+
+// ConsumerStats is a snapshot of the state of a Consumer, as returned by Consumer.Stats()
+type ConsumerStats struct {
+	Topic      string
+	Partitions map[int32]PartitionStats // stats of each partition currently assigned to the consumer
+}
+
+// PartitionStats is a snapshot of the state of one partition assigned to a Consumer.
+// The counts start over each time the partition is assigned to the Consumer.
+type PartitionStats struct {
+	Delivered   int64 // # of msgs delivered on the Messages channel (not counting redeliveries of Nack()ed msgs)
+	Done        int64 // # of calls to Done()
+	Outstanding int64 // # of msgs delivered but not yet Done(). With Config.InOrderDone it is computed from the offsets
+
+	// OldestOutstanding is the offset of the oldest msg which is not yet Done(), or -1 if there is none or it is unknown.
+	// Unless Config.InOrderDone is set it is a lower bound, since out-of-order Done()s are tracked in groups of offsets.
+	OldestOutstanding int64
+
+	Committable   int64 // the offset which would be committed now
+	Committed     int64 // the offset last successfully committed to kafka by this client, or -1 if none
+	HighWaterMark int64 // the partition's high-water mark as of the last fetch, or -1 if unknown (as is always the case with Config.NoMessages)
 }
 
 /*
@@ -316,6 +987,23 @@ type Partitioner interface {
 	ParseSync(*sarama.SyncGroupResponse) (map[string][]int32, error)
 }
 
+/*
+  UserDataPartitioner is an optional extension of Partitioner for partitioners which
+  need to read back the UserData the leader put in the member assignments. This is
+  needed by stateful assignment protocols, and to interoperate with other frameworks
+  which store their own data in the UserData.
+
+  The UserData each member put in its ConsumerGroupMemberMetadata is available to the
+  leader's Partition method through JoinGroupResponse.GetMembers().
+*/
+type UserDataPartitioner interface {
+	Partitioner
+
+	// ParseSyncUserData is like ParseSync, but in addition returns the UserData
+	// of this client's member assignment.
+	ParseSyncUserData(*sarama.SyncGroupResponse) (assignments map[string][]int32, user_data []byte, err error)
+}
+
 // client implements the Client interface
 type client struct {
 	client     sarama.Client // the sarama client from which we were constructed
@@ -325,12 +1013,83 @@ type client struct {
 	errors chan error // channel over which asynchronous errors are reported
 
 	closed chan struct{}  // channel which is closed to cause the client to shutdown
+	exited chan struct{}  // channel which is closed when client.run has exited (after Close(), or when NewClient fails)
 	wg     sync.WaitGroup // waitgroup which is done when the client is shutdown
 
-	add_consumers chan add_consumers // command channel used to add new consumers
-	rem_consumer  chan *consumer     // command channel used to remove an existing consumer
+	add_consumers chan add_consumers             // command channel used to add new consumers
+	rem_consumer  chan *consumer                 // command channel used to remove an existing consumer
+	topics_reqs   chan chan<- map[string][]int32 // command channel used to request the consumed topics and their assigned partitions
+	status_reqs   chan chan<- ClientStatus       // command channel used to request a ClientStatus
+	partitioners  chan Partitioner               // command channel used to replace the partitioner
+	rejoin        chan struct{}                  // channel used to request client.run rejoin the consumer group. it has a capacity of 1
+	retry_now     chan struct{}                  // channel used by RetryNow() to cut short client.run's backoff. it has a capacity of 1
 
 	sidechannel_commit chan map[string][]SidechannelOffset // command channel used to commit to the sidechannel
+
+	shared_lock     sync.Mutex      // lock protecting shared_consumer
+	shared_consumer sarama.Consumer // nil, or the sarama.Consumer shared by all consumers if Config.ShareSaramaConsumer is set
+
+	pause_lock sync.Mutex    // lock protecting resumed
+	resumed    chan struct{} // nil, or a channel which is closed when a PauseAll() is undone by ResumeAll()
+
+	num_members int32 // # of members in the group at the last join if we were the leader, or 0 if we weren't. accessed atomically
+
+	stable_lock sync.Mutex    // lock protecting stable and membership
+	stable      chan struct{} // channel which is closed while the client is a stable member of the group. replaced when the client rejoins
+	membership  membership    // the generation of which the client is a stable member, or the zero value while it isn't
+
+	committed_lock sync.Mutex                 // lock protecting committed
+	committed      map[string]map[int32]int64 // map of topic -> partition -> last offset successfully committed to kafka
+
+	barrier_lock sync.Mutex        // lock protecting barrier
+	barrier      *shutdown_barrier // nil, or the barrier the consumers wait at while the client shuts down, if Config.Close.Barrier is set
+
+	rebalances_lock sync.Mutex  // lock protecting rebalances
+	rebalances      []Rebalance // the most recent max_rebalances times the client joined the group, oldest first
+}
+
+// # of recent Rebalances the client remembers
+const max_rebalances = 16
+
+// shutdown_barrier is the barrier between the two phases of a client's shutdown when Config.Close.Barrier is set
+type shutdown_barrier struct {
+	lock     sync.Mutex
+	pending  map[*consumer]struct{} // the consumers which have not yet quiesced
+	released chan struct{}          // closed once every consumer has quiesced
+}
+
+func newShutdownBarrier(consumers map[string]*consumer) *shutdown_barrier {
+	b := &shutdown_barrier{
+		pending:  make(map[*consumer]struct{}, len(consumers)),
+		released: make(chan struct{}),
+	}
+	for _, con := range consumers {
+		b.pending[con] = struct{}{}
+	}
+	if len(b.pending) == 0 {
+		close(b.released)
+	}
+	return b
+}
+
+// arrive notes that con has quiesced (or exited). It can safely be called more than once
+func (b *shutdown_barrier) arrive(con *consumer) {
+	b.lock.Lock()
+	if _, ok := b.pending[con]; ok {
+		delete(b.pending, con)
+		if len(b.pending) == 0 {
+			close(b.released)
+		}
+	}
+	b.lock.Unlock()
+}
+
+// shutdownBarrier returns the barrier at which consumers wait before committing their final offsets, or nil if there is none
+func (cl *client) shutdownBarrier() *shutdown_barrier {
+	cl.barrier_lock.Lock()
+	b := cl.barrier
+	cl.barrier_lock.Unlock()
+	return b
 }
 
 // Errors returns the channel over which asynchronous errors are observed.
@@ -342,12 +1101,46 @@ type add_consumers struct {
 	reply chan<- error
 }
 
-func (cl *client) Consume(topic string) (Consumer, error) {
-	sarama_consumer, err := sarama.NewConsumerFromClient(cl.client)
-	if err != nil {
-		return nil, cl.makeError("Consume sarama.NewConsumerFromClient", err)
+// saramaConsumer returns the sarama.Consumer a new consumer should use. If Config.ShareSaramaConsumer is
+// set that is the client's shared sarama.Consumer. Otherwise it is a new sarama.Consumer.
+func (cl *client) saramaConsumer() (sarama.Consumer, error) {
+	if !cl.config.ShareSaramaConsumer {
+		return sarama.NewConsumerFromClient(cl.client)
+	}
+	cl.shared_lock.Lock()
+	defer cl.shared_lock.Unlock()
+	if cl.shared_consumer == nil {
+		sarama_consumer, err := sarama.NewConsumerFromClient(cl.client)
+		if err != nil {
+			return nil, err
+		}
+		cl.shared_consumer = sarama_consumer
+	}
+	return cl.shared_consumer, nil
+}
+
+// releaseSaramaConsumer is called when a consumer is done with the sarama.Consumer returned by saramaConsumer.
+// Unless the sarama.Consumer is shared it is closed. The shared sarama.Consumer is closed once client.run has shutdown all consumers.
+func (cl *client) releaseSaramaConsumer(sarama_consumer sarama.Consumer) error {
+	if cl.config.ShareSaramaConsumer {
+		return nil
+	}
+	return sarama_consumer.Close()
+}
+
+// messagesBufferSize returns the capacity of the Messages channel given Config.MessagesBufferSize
+func messagesBufferSize(size int, chanbufsize int) int {
+	switch {
+	case size < 0:
+		return 0
+	case size == 0:
+		return chanbufsize
 	}
+	return size
+}
 
+// newConsumer constructs a consumer of topic. The consumer isn't running until it is passed to client.run over cl.add_consumers
+func (cl *client) newConsumer(topic string, sarama_consumer sarama.Consumer) *consumer {
 	chanbufsize := cl.client.Config().ChannelBufferSize // give ourselves some capacity once I know it runs right without any (capacity hides bugs :-)
 
 	con := &consumer{
@@ -356,72 +1149,134 @@ func (cl *client) Consume(topic string) (Consumer, error) {
 		topic:         topic,
 		in_order_done: cl.config.InOrderDone,
 
-		messages: make(chan *sarama.ConsumerMessage, chanbufsize),
+		messages: make(chan *sarama.ConsumerMessage, messagesBufferSize(cl.config.MessagesBufferSize, chanbufsize)),
 
-		closed: make(chan struct{}),
-		exited: make(chan struct{}),
+		closed:  make(chan struct{}),
+		stopped: make(chan struct{}),
+		exited:  make(chan struct{}),
 
 		assignments: make(chan *assignment, 1),
 		commit_reqs: make(chan commit_req),
 
-		done: make(chan *sarama.ConsumerMessage, chanbufsize),
+		explicit_commits: make(chan explicit_commit),
+		rewinds:          make(chan rewind),
+
+		assignment_changes: make(chan Assignment, 1),
+		ticks:              make(chan time.Time, 1),
+
+		stats_reqs: make(chan chan<- ConsumerStats),
+
+		nacks:        make(chan *sarama.ConsumerMessage, chanbufsize),
+		redeliveries: make(chan redelivery),
+
+		done:     make(chan *sarama.ConsumerMessage, chanbufsize),
+		discards: make(chan *sarama.ConsumerMessage),
 	}
 	if !con.in_order_done {
-		con.premessages = make(chan *sarama.ConsumerMessage, chanbufsize)
+		// the buffer between the partitions' goroutines and consumer.run keeps the partitions from being serialized behind consumer.run whenever it is busy
+		bufsize := cl.config.PartitionBufferSize
+		if bufsize <= 0 {
+			bufsize = chanbufsize
+		}
+		con.premessages = make(chan premessage, bufsize)
 	}
-	if !con.cl.config.NoMessages {
+	if !cl.config.NoMessages {
 		con.restart_partitions = make(chan *partition)
+		con.refetch_partitions = make(chan *partition)
 	}
+	con.SetRateLimit(cl.config.PartitionRateLimit)
+	return con
+}
 
-	reply := make(chan error)
-	cl.add_consumers <- add_consumers{[]*consumer{con}, reply}
-	err = <-reply
+func (cl *client) Consume(topic string) (Consumer, error) {
+	return cl.ConsumeContext(context.Background(), topic)
+}
+
+func (cl *client) ConsumeContext(ctx context.Context, topic string) (Consumer, error) {
+	sarama_consumer, err := cl.saramaConsumer()
+	if err != nil {
+		return nil, cl.makeError("Consume sarama.NewConsumerFromClient", err)
+	}
+
+	con := cl.newConsumer(topic, sarama_consumer)
+
+	err = cl.addConsumers(ctx, []*consumer{con})
 	if err != nil {
 		// if an error is returned then it is up to us to close the sarama.Consumer
-		_ = sarama_consumer.Close() // we already have an error to return. a 2nd one is too much
+		_ = cl.releaseSaramaConsumer(sarama_consumer) // we already have an error to return. a 2nd one is too much
 		return nil, err
 	}
 	return con, nil
 }
 
-func (cl *client) ConsumeMany(topics []string) ([]Consumer, error) {
-	sarama_consumer, err := sarama.NewConsumerFromClient(cl.client)
+func (cl *client) ConsumeWhenCreated(topic string, timeout time.Duration) (Consumer, error) {
+	err := cl.waitForTopic(topic, timeout)
 	if err != nil {
-		return nil, cl.makeError("ConsumeMany sarama.NewConsumerFromClient", err)
+		return nil, err
 	}
+	return cl.Consume(topic)
+}
 
-	chanbufsize := cl.client.Config().ChannelBufferSize // give ourselves some capacity once I know it runs right without any (capacity hides bugs :-)
-
-	consumers := make([]*consumer, len(topics))
-	for i, topic := range topics {
-		consumers[i] = &consumer{
-			cl:            cl,
-			consumer:      sarama_consumer,
-			topic:         topic,
-			in_order_done: cl.config.InOrderDone,
-
-			messages: make(chan *sarama.ConsumerMessage, chanbufsize),
-
-			closed: make(chan struct{}),
-			exited: make(chan struct{}),
-
-			assignments: make(chan *assignment, 1),
-			commit_reqs: make(chan commit_req),
+// waitForTopic waits up to timeout for topic to exist
+func (cl *client) waitForTopic(topic string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		// refresh the metadata of just this topic, since sarama caches the metadata, including the absence of a topic
+		err := cl.client.RefreshMetadata(topic)
+		if err == nil {
+			var partitions []int32
+			partitions, err = cl.client.Partitions(topic)
+			if err == nil && len(partitions) != 0 {
+				return nil
+			}
+		}
+		if err != nil && err != sarama.ErrUnknownTopicOrPartition {
+			return cl.makeError(fmt.Sprintf("looking up topic %q", topic), err)
+		}
 
-			restart_partitions: make(chan *partition),
-			done:               make(chan *sarama.ConsumerMessage, chanbufsize),
+		delay := cl.client.Config().Metadata.Retry.Backoff
+		if remaining := time.Until(deadline); remaining <= 0 {
+			return cl.makeError("ConsumeWhenCreated", fmt.Errorf("topic %q was not created within %v", topic, timeout))
+		} else if delay > remaining {
+			delay = remaining
 		}
-		if !consumers[i].in_order_done {
-			consumers[i].premessages = make(chan *sarama.ConsumerMessage, chanbufsize)
+		dbgf("waiting %v for topic %q to be created", delay, topic)
+		select {
+		case <-time.After(delay):
+		case <-cl.exited:
+			return cl.makeError("ConsumeWhenCreated", fmt.Errorf("client of consumer group %q has stopped", cl.group_name))
 		}
 	}
+}
 
+// hand the consumers to client.run and wait for its reply
+func (cl *client) addConsumers(ctx context.Context, consumers []*consumer) error {
 	reply := make(chan error)
-	cl.add_consumers <- add_consumers{consumers, reply}
-	err = <-reply
+	select {
+	case cl.add_consumers <- add_consumers{consumers, reply}:
+		return <-reply
+	case <-cl.exited:
+		return cl.makeError("Consume", fmt.Errorf("client of consumer group %q has stopped", cl.group_name))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (cl *client) ConsumeMany(topics []string) ([]Consumer, error) {
+	sarama_consumer, err := cl.saramaConsumer()
+	if err != nil {
+		return nil, cl.makeError("ConsumeMany sarama.NewConsumerFromClient", err)
+	}
+
+	consumers := make([]*consumer, len(topics))
+	for i, topic := range topics {
+		consumers[i] = cl.newConsumer(topic, sarama_consumer)
+	}
+
+	err = cl.addConsumers(context.Background(), consumers)
 	if err != nil {
 		// if an error is returned then it is up to us to close the sarama.Consumer
-		_ = sarama_consumer.Close() // we already have an error to return. a 2nd one is too much
+		_ = cl.releaseSaramaConsumer(sarama_consumer) // we already have an error to return. a 2nd one is too much
 		return nil, err
 	}
 
@@ -441,14 +1296,301 @@ func (cl *client) Close() {
 	cl.wg.Wait()
 }
 
+// PauseAll pauses the delivery of messages from all consumers
+func (cl *client) PauseAll() {
+	dbgf("PauseAll client of consumer-group %q", cl.group_name)
+	cl.pause_lock.Lock()
+	if cl.resumed == nil {
+		cl.resumed = make(chan struct{})
+	}
+	cl.pause_lock.Unlock()
+}
+
+// ResumeAll resumes the delivery of messages from all consumers
+func (cl *client) ResumeAll() {
+	dbgf("ResumeAll client of consumer-group %q", cl.group_name)
+	cl.pause_lock.Lock()
+	if cl.resumed != nil {
+		close(cl.resumed)
+		cl.resumed = nil
+	}
+	cl.pause_lock.Unlock()
+}
+
+// paused returns nil if the client is not paused, or a channel which is closed when the client is resumed
+func (cl *client) paused() <-chan struct{} {
+	cl.pause_lock.Lock()
+	resumed := cl.resumed
+	cl.pause_lock.Unlock()
+	return resumed
+}
+
+// a generation of the group, as seen by one of its members
+type membership struct {
+	generation_id int32
+	member_id     string
+	coor          *sarama.Broker // the group's coordinating broker
+}
+
+// note whether the client is a stable member of the group. m is nil if it isn't
+func (cl *client) setStable(m *membership) {
+	cl.stable_lock.Lock()
+	defer cl.stable_lock.Unlock()
+	stable := m != nil
+	select {
+	case <-cl.stable:
+		if !stable {
+			cl.stable = make(chan struct{})
+		}
+	default:
+		if stable {
+			close(cl.stable)
+		}
+	}
+	if stable {
+		cl.membership = *m
+	} else {
+		cl.membership = membership{}
+	}
+}
+
+func (cl *client) WaitStable(timeout time.Duration) error {
+	cl.stable_lock.Lock()
+	stable := cl.stable
+	cl.stable_lock.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-stable:
+		return nil
+	case <-t.C:
+		return cl.makeError("WaitStable", fmt.Errorf("consumer group %q not stable after %v", cl.group_name, timeout))
+	case <-cl.exited:
+		return cl.makeError("WaitStable", fmt.Errorf("client of consumer group %q has stopped", cl.group_name))
+	}
+}
+
+func (cl *client) Topics() map[string][]int32 {
+	reply := make(chan map[string][]int32, 1)
+	select {
+	case cl.topics_reqs <- reply:
+		return <-reply
+	case <-cl.exited:
+		return nil
+	}
+}
+
+func (cl *client) Status() ClientStatus {
+	reply := make(chan ClientStatus, 1)
+	select {
+	case cl.status_reqs <- reply:
+		return <-reply
+	case <-cl.exited:
+		return ClientStatus{GroupName: cl.group_name, GenerationId: -1}
+	}
+}
+
+func (cl *client) SetPartitioner(p Partitioner) {
+	if p == nil {
+		p = cl.config.Partitioner
+	}
+	select {
+	case cl.partitioners <- p:
+	case <-cl.exited:
+	}
+}
+
+func (cl *client) RetryNow() {
+	select {
+	case cl.retry_now <- struct{}{}:
+	default:
+		// a retry is already pending
+	}
+}
+
+// requestRejoin asks client.run to rejoin the consumer group, causing the group to rebalance
+func (cl *client) requestRejoin() {
+	select {
+	case cl.rejoin <- struct{}{}:
+	default:
+		// a rejoin is already pending
+	}
+}
+
+func (cl *client) CommittedOffsets(topic string) (map[int32]int64, error) {
+	return cl.fetchOffsets("CommittedOffsets", cl.group_name, topic)
+}
+
+// fetchOffsets fetches the committed offset of every partition of topic in consumer group group_name. op names the
+// operation in any error
+func (cl *client) fetchOffsets(op string, group_name string, topic string) (map[int32]int64, error) {
+	partitions, err := cl.client.Partitions(topic)
+	if err != nil {
+		return nil, cl.makeError(fmt.Sprintf("%s looking up partitions of topic %q", op, topic), err)
+	}
+	coor, err := cl.client.Coordinator(group_name)
+	if err != nil {
+		return nil, cl.makeError(op+" contacting coordinating broker", err)
+	}
+
+	oreq := &sarama.OffsetFetchRequest{
+		ConsumerGroup: group_name,
+		Version:       1, // kafka 0.9.0 expects version 1 offset requests
+	}
+	for _, p := range partitions {
+		oreq.AddPartition(topic, p)
+	}
+	dbgf("sending OffsetFetchRequest %v", oreq)
+	oresp, err := coor.FetchOffset(oreq)
+	dbgf("received OffsetFetchResponse %v, %v", oresp, err)
+	if err != nil {
+		return nil, cl.makeError(op+" fetching offsets", err)
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, p := range partitions {
+		b := oresp.GetBlock(topic, p)
+		if b == nil {
+			return nil, cl.makeError(op+" fetching offsets", fmt.Errorf("partition %d missing", p))
+		}
+		if b.Err != 0 {
+			Err := cl.makeError(op+" fetching offsets", b.Err)
+			Err.Topic = topic
+			Err.Partition = p
+			return nil, Err
+		}
+		offsets[p] = cl.fetchedOffset(b.Offset)
+	}
+	return offsets, nil
+}
+
+func (cl *client) CopyOffsetsFrom(old_group string, topic string) error {
+	if old_group == cl.group_name {
+		return cl.makeError("CopyOffsetsFrom", fmt.Errorf("consumer group %q can't copy offsets from itself", old_group))
+	}
+	if _, ok := cl.Topics()[topic]; ok {
+		Err := cl.makeError("CopyOffsetsFrom", fmt.Errorf("topic %q is being consumed, and its commits would race with the copy", topic))
+		Err.Topic = topic
+		return Err
+	}
+
+	offsets, err := cl.fetchOffsets("CopyOffsetsFrom", old_group, topic)
+	if err != nil {
+		return err
+	}
+
+	// commit as a member of the group if we are one. Otherwise commit as a client which isn't a member, which the
+	// coordinator accepts only while the group has no members
+	cl.stable_lock.Lock()
+	m := cl.membership
+	cl.stable_lock.Unlock()
+	if m.coor == nil {
+		m.generation_id = -1
+	}
+	ocreq := newOffsetCommitRequest(cl.group_name, m.generation_id, m.member_id, cl.client.Config())
+	n := 0
+	for p, offset := range offsets {
+		if offset == sarama.OffsetNewest {
+			// the old group never committed an offset for this partition; leave the partition as it is
+			continue
+		}
+		committed, ok := cl.committedOffset(offset)
+		if !ok {
+			continue
+		}
+		dbgf("ocreq.AddBlock(%q, %d, %d)", topic, p, committed)
+		ocreq.AddBlock(topic, p, committed, 0, "")
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	coor := m.coor
+	if coor == nil {
+		coor, err = cl.client.Coordinator(cl.group_name)
+		if err != nil {
+			return cl.makeError("CopyOffsetsFrom contacting coordinating broker", err)
+		}
+	}
+	dbgf("sending OffsetCommitRequest %v", ocreq)
+	ocresp, err := coor.CommitOffset(ocreq)
+	dbgf("received OffsetCommitResponse %v, %v", ocresp, err)
+	if err != nil {
+		return cl.makeError("CopyOffsetsFrom committing offsets", err)
+	}
+	for p, kerr := range ocresp.Errors[topic] {
+		if kerr != 0 {
+			Err := cl.makeError("CopyOffsetsFrom committing offsets", kerr)
+			Err.Topic = topic
+			Err.Partition = p
+			return Err
+		}
+	}
+	logf("consumer %q copied the committed offsets of %d partitions of %q from consumer group %q", cl.group_name, n, topic, old_group)
+	return nil
+}
+
+// noteRebalance records that the client is joining the group, and why
+func (cl *client) noteRebalance(reason RebalanceReason, err error) {
+	dbgf("consumer %q joining group because of %s (%v)", cl.group_name, reason, err)
+	cl.rebalances_lock.Lock()
+	if len(cl.rebalances) == max_rebalances {
+		copy(cl.rebalances, cl.rebalances[1:])
+		cl.rebalances = cl.rebalances[:max_rebalances-1]
+	}
+	cl.rebalances = append(cl.rebalances, Rebalance{Time: time.Now(), Reason: reason, Err: err})
+	cl.rebalances_lock.Unlock()
+}
+
+func (cl *client) Rebalances() []Rebalance {
+	cl.rebalances_lock.Lock()
+	defer cl.rebalances_lock.Unlock()
+	return append([]Rebalance(nil), cl.rebalances...)
+}
+
+// MemberCount returns the number of members in the consumer group
+func (cl *client) MemberCount() (int, error) {
+	if n := atomic.LoadInt32(&cl.num_members); n != 0 {
+		return int(n), nil
+	}
+
+	// we weren't the leader, so we have to ask the coordinator
+	coor, err := cl.client.Coordinator(cl.group_name)
+	if err != nil {
+		return 0, cl.makeError("MemberCount contacting coordinating broker", err)
+	}
+	req := &sarama.DescribeGroupsRequest{
+		Groups: []string{cl.group_name},
+	}
+	dbgf("sending DescribeGroupsRequest %v", req)
+	resp, err := coor.DescribeGroups(req)
+	dbgf("received DescribeGroupsResponse %v, %v", resp, err)
+	if err != nil {
+		return 0, cl.makeError("describing group", err)
+	}
+	for _, g := range resp.Groups {
+		if g.GroupId == cl.group_name {
+			if g.Err != 0 {
+				return 0, cl.makeError("describing group", g.Err)
+			}
+			return len(g.Members), nil
+		}
+	}
+	return 0, cl.makeError("describing group", fmt.Errorf("group missing from DescribeGroupsResponse"))
+}
+
 // run is a long lived goroutine which manages this client's membership in the consumer group.
 func (cl *client) run(early_rc chan<- error) {
 	defer cl.wg.Done()
+	defer close(cl.exited)
 
 	var member_id string                    // our group member id, assigned to us by kafka when we first make contact
 	consumers := make(map[string]*consumer) // map of topic -> consumer
 	var assignments map[string][]int32      // nil, or our currently assigned partitions (map of topic -> list of partitions)
 	var wg sync.WaitGroup                   // waitgroup used to wait for all consumers to exit
+	var joins []time.Time                   // when we joined the recent generations, if Config.Rebalance.Limit is set
 
 	defer dbgf("consumer-group %q client exiting", cl.group_name)
 
@@ -461,7 +1603,9 @@ func (cl *client) run(early_rc chan<- error) {
 			if _, ok := consumers[con.topic]; ok {
 				// topic already is being consumed. the way the standard kafka 0.9 group coordination works you cannot consume twice with the
 				// same client. If you want to consume the same topic twice, use two Clients.
-				add.reply <- cl.makeError("Consume", fmt.Errorf("topic %q is already being consumed", con.topic))
+				err := cl.makeError("Consume", ErrTopicAlreadyConsumed)
+				err.Topic = con.topic
+				add.reply <- err
 				return
 			}
 		}
@@ -487,9 +1631,61 @@ func (cl *client) run(early_rc chan<- error) {
 		close(con.assignments)
 		close(con.commit_reqs)
 	}
+	// reply to a Topics() request
+	topics := func(reply chan<- map[string][]int32) {
+		t := make(map[string][]int32, len(consumers))
+		for topic := range consumers {
+			var parts []int32
+			if a := assignments[topic]; len(a) != 0 {
+				parts = make([]int32, len(a)) // copy, so the caller can't alter our assignments
+				copy(parts, a)
+			}
+			t[topic] = parts
+		}
+		reply <- t
+	}
+	// reply with a snapshot of our status
+	status := func(reply chan<- ClientStatus) {
+		s := ClientStatus{
+			GroupName:    cl.group_name,
+			GenerationId: -1,
+			MemberId:     member_id,
+			Topics:       make(map[string]TopicStatus, len(consumers)),
+		}
+		cl.stable_lock.Lock()
+		select {
+		case <-cl.stable:
+			s.GenerationId = cl.membership.generation_id
+		default:
+		}
+		cl.stable_lock.Unlock()
+
+		for topic := range consumers {
+			a := assignments[topic]
+			ts := TopicStatus{
+				Partitions: make([]int32, len(a)), // copy, so the caller can't alter our assignments
+				Committed:  make(map[int32]int64, len(a)),
+			}
+			copy(ts.Partitions, a)
+			sort.Slice(ts.Partitions, func(i, j int) bool { return ts.Partitions[i] < ts.Partitions[j] })
+			for _, p := range ts.Partitions {
+				ts.Committed[p] = cl.lastCommitted(topic, p)
+			}
+			s.Topics[topic] = ts
+		}
+		reply <- s
+	}
 	// shutdown the consumers. waits until they are all stopped. only call once and return afterwards, since it makes assumptions that hold only when it is used like that
 	shutdown := func() {
 		dbgf("client.run shutdown")
+		// optionally have the consumers all quiesce before any commit. this must be in place before they are closed
+		var barrier *shutdown_barrier
+		if cl.config.Close.Barrier {
+			barrier = newShutdownBarrier(consumers)
+			cl.barrier_lock.Lock()
+			cl.barrier = barrier
+			cl.barrier_lock.Unlock()
+		}
 		// shutdown the remaining consumers
 		for _, con := range consumers {
 			con.AsyncClose()
@@ -500,12 +1696,25 @@ func (cl *client) run(early_rc chan<- error) {
 			close(cl.rem_consumer)
 		}()
 		for con := range cl.rem_consumer {
+			if barrier != nil {
+				// con might have been closing before the barrier was set up, and so never waited at it
+				barrier.arrive(con)
+			}
 			rem(con)
 		}
 		wg.Wait()
-		// and shutdown the errors channel
-		close(cl.errors)
-	}
+		// now that no consumer is using it, close any shared sarama.Consumer
+		cl.shared_lock.Lock()
+		shared_consumer := cl.shared_consumer
+		cl.shared_consumer = nil
+		cl.shared_lock.Unlock()
+		if shared_consumer != nil {
+			err := shared_consumer.Close()
+			if err != nil {
+				cl.deliverError("closing shared sarama.Consumer", err)
+			}
+		}
+	}
 
 	// if enabled, subscribe to the side-channel topic on the appropriate partition
 	var sidechannel_queries chan sidechannel_query // nil, or command channel used to request offsets from sidechannel
@@ -525,8 +1734,16 @@ func (cl *client) run(early_rc chan<- error) {
 	} // else leave sidechannel_queries nil
 
 	// always start the producer, even if it is just a dummy routine that drains and throws away msgs in cl.sidechannel_commit
+	sidechannel_exited := make(chan struct{})
 	cl.wg.Add(1)
-	go cl.sidechannel_producer(cl.config.SidechannelTopic)
+	go cl.sidechannel_producer(cl.config.SidechannelTopic, sidechannel_exited)
+	// the producer outlives the consumers so that their final commits, which might fail over to the sidechannel, get published.
+	// once it has flushed and exited nothing else can deliver errors, and we can shutdown the errors channel (defers run in reverse order)
+	defer close(cl.errors)
+	defer func() {
+		close(cl.sidechannel_commit)
+		<-sidechannel_exited
+	}()
 
 	// commitToSidechannel trys to send the partition offsets to the SidechannelTopic
 	commitToSidechannel := func() {
@@ -582,16 +1799,42 @@ func (cl *client) run(early_rc chan<- error) {
 		defer commit_ticker.Stop()
 	} // else don't commit periodically (we still commit when closing down)
 
+	// the periodic commits skip the offsets which haven't changed since they were last committed, except every
+	// refresh_interval, when every offset is committed so that kafka doesn't expire the offsets of idle partitions
+	refresh_interval := clconfig.Consumer.Offsets.Retention / 2
+	if refresh_interval <= 0 {
+		refresh_interval = default_commit_refresh_interval
+	}
+	var last_refresh time.Time // when every offset was last committed
+
+	// how often to check the topics' partition counts
+	metadata_interval := clconfig.Metadata.RefreshFrequency
+	if cl.config.Metadata.RefreshInterval > 0 {
+		metadata_interval = cl.config.Metadata.RefreshInterval
+	}
+
+	partitioner := cl.config.Partitioner // the partitioner to use the next time we join. replaced by SetPartitioner()
+
 	pause := false
+	attempt := 0            // # of consecutive pauses
 	refresh := false        // refresh the coordinating broker (after an I/O error or a ErrNotCoordinatorForConsumer)
 	reopen := false         // reopen coordinating broker (after an I/O error)
 	var coor *sarama.Broker // nil, or coordinating broker
 
+	rejoin_reason := RebalanceStart // why we are (re)joining the group
+	var rejoin_err error            // and the error which caused it, if any
+
 	// loop rejoining the group each time the group reforms
 join_loop:
 	for {
+		cl.setStable(nil)
+
 		if pause {
-			delay := cl.client.Config().Metadata.Retry.Backoff // TODO should we increase timeouts?
+			delay := cl.client.Config().Metadata.Retry.Backoff
+			if cl.config.Backoff != nil {
+				delay = cl.config.Backoff.NextDelay(attempt)
+			}
+			attempt++
 			dbgf("pausing %v", delay)
 			// pause before continuing, so we don't fail continuously too fast
 			timeout := time.After(delay)
@@ -600,6 +1843,13 @@ join_loop:
 				select {
 				case <-timeout:
 					break pause_loop
+				case <-cl.retry_now:
+					logf("consumer %q retrying now, after %d failed attempts", cl.group_name, attempt)
+					attempt = 0
+					if cl.config.Backoff != nil {
+						cl.config.Backoff.Reset()
+					}
+					break pause_loop
 				case <-cl.closed:
 					// shutdown the remaining consumers
 					shutdown()
@@ -608,6 +1858,12 @@ join_loop:
 					add(a)
 				case r := <-cl.rem_consumer:
 					rem(r)
+				case r := <-cl.topics_reqs:
+					topics(r)
+				case r := <-cl.status_reqs:
+					status(r)
+				case p := <-cl.partitioners:
+					partitioner = p
 				case <-commit_timer:
 					commitToSidechannel()
 				}
@@ -615,6 +1871,56 @@ join_loop:
 			pause = false
 		}
 
+		if cl.config.JoinOnlyWhenConsuming && len(consumers) == 0 {
+			if member_id != "" && coor != nil {
+				// we were a member; leave the group, since we've no longer anything to consume
+				logf("consumer %q leaving group since it has no consumers", cl.group_name)
+				req := &sarama.LeaveGroupRequest{
+					GroupId:  cl.group_name,
+					MemberId: member_id,
+				}
+				dbgf("sending LeaveGroupRequest %v", req)
+				resp, err := coor.LeaveGroup(req)
+				dbgf("received LeaveGroupResponse %v, %v", resp, err)
+				if err == nil && resp.Err != 0 {
+					err = resp.Err
+				}
+				if err != nil {
+					cl.deliverError("leaving group", err)
+				}
+				member_id = ""
+			}
+			if early_rc != nil {
+				// release the caller to NewClient
+				early_rc <- nil
+				early_rc = nil
+			}
+			// and wait outside the group until there is something to consume
+			dbgf("consumer %q waiting for consumers", cl.group_name)
+		idle_loop:
+			for {
+				select {
+				case <-cl.closed:
+					shutdown()
+					return
+				case a := <-cl.add_consumers:
+					add(a)
+					if len(consumers) != 0 {
+						rejoin_reason, rejoin_err = RebalanceConsumerAdded, nil
+						break idle_loop
+					}
+				case r := <-cl.rem_consumer:
+					rem(r)
+				case r := <-cl.topics_reqs:
+					topics(r)
+				case r := <-cl.status_reqs:
+					status(r)
+				case p := <-cl.partitioners:
+					partitioner = p
+				}
+			}
+		}
+
 		if reopen {
 			if coor != nil {
 				dbgf("closing and reopening connection to coordinator %d %s", coor.ID(), coor.Addr())
@@ -645,7 +1951,7 @@ join_loop:
 			dbgf("refreshing coordinating broker")
 
 			// refresh the group coordinator (because sarama caches the result, and the cache must be manually refreshed by us when we decide an invalidate might be needed)
-			err := cl.client.RefreshCoordinator(cl.group_name)
+			err := refreshCoordinator(cl.client, cl.group_name)
 			if err != nil {
 				err = cl.makeError("refreshing coordinating broker", err)
 				if early_rc != nil {
@@ -654,6 +1960,7 @@ join_loop:
 				}
 				cl.deliverError("", err)
 				pause = true
+				rejoin_reason, rejoin_err = RebalanceCoordinator, err
 				continue join_loop
 			}
 			refresh = false
@@ -674,6 +1981,7 @@ join_loop:
 
 			pause = true
 			refresh = true
+			rejoin_reason, rejoin_err = RebalanceCoordinator, err
 			continue join_loop
 		}
 		dbgf("Coordinator %v %v", coor.ID(), coor.Addr())
@@ -689,23 +1997,23 @@ join_loop:
 
 			pause = true
 			reopen = true
+			rejoin_reason, rejoin_err = RebalanceCoordinator, err
 			continue join_loop
 		}
 
 		// join the group
-		jreq := &sarama.JoinGroupRequest{
-			GroupId:        cl.group_name,
-			SessionTimeout: int32(cl.config.Session.Timeout / time.Millisecond),
-			MemberId:       member_id,
-			ProtocolType:   "consumer", // we implement the standard kafka 0.9 consumer protocol metadata
-		}
+		jreq := newJoinGroupRequest(cl.group_name, member_id, cl.config, clconfig)
+		join_partitioner := partitioner // the partitioner used throughout this join, even if SetPartitioner() is called meanwhile
 
+		// the topics we asked to consume when we joined, and the # of partitions of each
+		requested := make(map[string]bool, len(consumers))
 		num_partitions := make(map[string]int, len(consumers))
 		{ // prepare the join request
 			var topics = make([]string, 0, len(consumers))
 			var current_assignments = make(map[string][]int32, len(consumers))
 			for topic := range consumers {
 				topics = append(topics, topic)
+				requested[topic] = true
 				if a := assignments[topic]; a != nil && len(a) != 0 { // omit any topics for which we are not assigned a partition
 					current_assignments[topic] = a
 				}
@@ -718,10 +2026,24 @@ join_loop:
 					num_partitions[topic] = len(partitions)
 				}
 			}
-			logf("consumer %q proposing partitioner %q", cl.group_name, cl.config.Partitioner.Name())
-			cl.config.Partitioner.PrepareJoin(jreq, topics, current_assignments)
+			logf("consumer %q proposing partitioner %q", cl.group_name, join_partitioner.Name())
+			err := prepareJoin(join_partitioner, jreq, topics, current_assignments)
+			if err != nil {
+				err = cl.makeError("preparing to join group", err)
+				if early_rc != nil {
+					early_rc <- err
+					return
+				}
+				cl.deliverError("", err)
+				pause = true
+				rejoin_reason, rejoin_err = RebalancePartitioning, err
+				continue join_loop
+			}
 		}
 
+		// note why we're joining
+		cl.noteRebalance(rejoin_reason, rejoin_err)
+
 		// send and wait for join response while still committing to the side channel, since the JoinGroupResponse doesn't arrive until the broker is sure it has gathered them all
 		var jresp *sarama.JoinGroupResponse
 		done := make(chan struct{})
@@ -736,6 +2058,12 @@ join_loop:
 			select {
 			case <-done:
 				break wait_for_jresp
+			case r := <-cl.topics_reqs:
+				topics(r)
+			case r := <-cl.status_reqs:
+				status(r)
+			case p := <-cl.partitioners:
+				partitioner = p
 			case <-commit_timer:
 				commitToSidechannel()
 			}
@@ -751,6 +2079,11 @@ join_loop:
 				member_id = "" // the coordinator no longer knows who we are; have it assign us a new member id
 			}
 			err = jresp.Err
+			if err == sarama.ErrInvalidSessionTimeout {
+				// brokers don't clamp the timeouts to the range they allow, and the JoinGroupResponse doesn't say what that range is,
+				// so the best we can do is explain which of our settings are at fault
+				err = sessionTimeoutError(err, cl.config)
+			}
 		}
 		if err != nil {
 			switch err {
@@ -768,6 +2101,7 @@ join_loop:
 			}
 
 			pause = true
+			rejoin_reason, rejoin_err = RebalanceJoinFailed, err
 			continue join_loop
 		}
 
@@ -782,6 +2116,12 @@ join_loop:
 		member_id = jresp.MemberId
 		generation_id := jresp.GenerationId
 		logf("consumer %q joining generation %d as member %q", cl.group_name, generation_id, member_id)
+		if jresp.LeaderId == member_id {
+			// the leader is told about all the members
+			atomic.StoreInt32(&cl.num_members, int32(len(jresp.Members)))
+		} else {
+			atomic.StoreInt32(&cl.num_members, 0)
+		}
 
 		// prepare a sync request
 		sreq := &sarama.SyncGroupRequest{
@@ -792,14 +2132,32 @@ join_loop:
 
 		// we have been chosen as the leader then we have to map the partitions
 		if jresp.LeaderId == member_id {
-			dbgf("leader is we; partitioning using partitioner %s", cl.config.Partitioner.Name())
-			err := cl.config.Partitioner.Partition(sreq, jresp, cl.client)
+			dbgf("leader is we; partitioning using partitioner %s", join_partitioner.Name())
+			if cl.config.MemberMetadataNotification != nil {
+				if members, err := jresp.GetMembers(); err != nil {
+					cl.deliverError("decoding member metadata", err)
+				} else {
+					cl.config.MemberMetadataNotification(generation_id, members)
+				}
+			}
+			err := partitionGroup(join_partitioner, sreq, jresp, cl.client)
 			if err != nil {
 				cl.deliverError("partitioning", err)
 				// and rejoin (thus aborting this generation) since we can't partition it as needed
 				pause = true
+				rejoin_reason, rejoin_err = RebalancePartitioning, err
 				continue join_loop
 			}
+			if err := checkAssignmentSizes(sreq); err != nil {
+				// send it anyway. the members might have a larger sarama.MaxResponseSize than we do
+				cl.deliverError("partitioning", err)
+			}
+			if cl.config.LogAssignments {
+				logSyncAssignments(cl.group_name, generation_id, jresp, sreq)
+			}
+			if cl.config.AssignmentPublisher != nil {
+				cl.config.AssignmentPublisher(generation_id, decodeSyncAssignments(cl.group_name, generation_id, jresp, sreq))
+			}
 		}
 
 		// send SyncGroup
@@ -816,12 +2174,19 @@ join_loop:
 			select {
 			case <-done:
 				break wait_for_sresp
+			case r := <-cl.topics_reqs:
+				topics(r)
+			case r := <-cl.status_reqs:
+				status(r)
+			case p := <-cl.partitioners:
+				partitioner = p
 			case <-commit_timer:
 				commitToSidechannel()
 			}
 		}
 		if err != nil {
 			reopen = true
+			err = syncGroupError(err)
 		} else if sresp.Err != 0 {
 			switch sresp.Err {
 			case sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable, sarama.ErrRebalanceInProgress:
@@ -840,14 +2205,20 @@ join_loop:
 				cl.deliverError("synchronizing group", err)
 			}
 			pause = true
+			rejoin_reason, rejoin_err = RebalanceSyncFailed, err
 			continue join_loop
 		}
-		new_assignments, err := cl.config.Partitioner.ParseSync(sresp)
+		new_assignments, user_data, err := parseSync(join_partitioner, sresp)
 		if err != nil {
 			cl.deliverError("decoding member assignments", err)
 			pause = true
+			rejoin_reason, rejoin_err = RebalancePartitioning, err
 			continue join_loop
 		}
+		if unrequested := dropUnrequested(new_assignments, requested); len(unrequested) != 0 {
+			// the leader's Partitioner is buggy, or doesn't understand our metadata. all we can do is ignore the bogus topics
+			cl.deliverError("", cl.makeError("decoding member assignments", fmt.Errorf("the leader assigned partitions of topics %q, which this client didn't ask to consume; ignoring them", unrequested)))
+		}
 
 		// keep track of which and how many partitions we are assigned
 		assignments = new_assignments
@@ -871,6 +2242,9 @@ join_loop:
 			}
 			cl.config.AssignmentNotification(acopy)
 		}
+		if cl.config.AssignmentUserDataNotification != nil {
+			cl.config.AssignmentUserDataNotification(user_data)
+		}
 
 		// save and distribute the new assignments to our topic consumers
 		a := &assignment{
@@ -879,24 +2253,60 @@ join_loop:
 			member_id:           member_id,
 			assignments:         assignments,
 			sidechannel_queries: sidechannel_queries,
+			commits:             newCommitBatch(cl, len(consumers)),
 		}
 		for _, con := range consumers {
 			// con.assignments has a capacity of 1. the chan is either empty, or contains a stale assignment we can remove and replace
 			select {
 			case con.assignments <- a:
 				// a is delivered
-			case <-con.assignments:
+			case stale := <-con.assignments:
 				// we've cleared out the stale assignment. since we've the only code which writes to this channel we now know we have room
+				// (skipping its batch might send it, and we mustn't wait on the coordinator here, between SyncGroup and the first heartbeat)
+				go stale.commits.skip()
 				con.assignments <- a
 			}
 		}
 
+		// we've successfully joined the group, so any further failure is the first of its kind
+		if attempt != 0 {
+			attempt = 0
+			if cl.config.Backoff != nil {
+				cl.config.Backoff.Reset()
+			}
+		}
+
+		cl.setStable(&membership{generation_id, member_id, coor})
+
+		// and remember when, for the rebalance circuit breaker
+		if cl.config.Rebalance.Limit > 0 {
+			now := time.Now()
+			joins, _ = rebalanceDelay(append(joins, now), now, cl.config.Rebalance.Limit, cl.config.Rebalance.Window)
+		}
+		var deferred_rejoin <-chan time.Time // nil, or fires when a rejoin deferred by the circuit breaker can proceed
+		// rejoinAfterChange returns true if we should rejoin now after a change in our consumers, or false if the
+		// circuit breaker has deferred the rejoin
+		rejoinAfterChange := func() bool {
+			if deferred_rejoin != nil {
+				// we're already waiting; this change will be part of that rejoin
+				return false
+			}
+			var delay time.Duration
+			joins, delay = rebalanceDelay(joins, time.Now(), cl.config.Rebalance.Limit, cl.config.Rebalance.Window)
+			if delay <= 0 {
+				return true
+			}
+			cl.deliverError("", cl.makeError("rebalance circuit breaker", fmt.Errorf("%d rebalances within %v; deferring rejoining the group for %v", len(joins), cl.config.Rebalance.Window, delay)))
+			deferred_rejoin = time.After(delay)
+			return false
+		}
+
 		// start the heartbeat timer
-		heartbeat_timer := time.After(cl.config.Heartbeat.Interval)
+		heartbeat_timer := time.After(cl.config.Heartbeat.Interval + cl.config.Heartbeat.InitialDelay)
 		// and the metadata check timer
 		var metadata_timer <-chan time.Time
-		if clconfig.Metadata.RefreshFrequency > 0 {
-			metadata_timer = time.After(clconfig.Metadata.RefreshFrequency)
+		if metadata_interval > 0 {
+			metadata_timer = time.After(metadata_interval)
 		}
 
 		// and loop, sending heartbeats until something happens and we need to rejoin (or exit)
@@ -905,7 +2315,9 @@ join_loop:
 			case <-cl.closed:
 				// cl.Close() has been called; time to exit
 
-				// shutdown any remaining consumers (causing them to sync their final offsets)
+				// shutdown any remaining consumers (causing them to sync their final offsets).
+				// this must happen before we leave the group, since once we've left our generation is no longer valid and the
+				// coordinator would reject the commits
 				shutdown()
 
 				// and nicely leave the consumer group
@@ -935,6 +2347,7 @@ join_loop:
 					GenerationId: generation_id,
 				}
 				dbgf("sending HeartbeatRequest %v", req)
+				sent := time.Now()
 				resp, err := coor.Heartbeat(req)
 				dbgf("received HeartbeatResponse %v, %v", resp, err)
 				if err != nil {
@@ -948,6 +2361,9 @@ join_loop:
 					}
 					err = resp.Err
 				}
+				if cl.config.Heartbeat.Notification != nil {
+					cl.config.Heartbeat.Notification(generation_id, time.Since(sent), err)
+				}
 				if err != nil {
 					switch err {
 					case sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration:
@@ -957,6 +2373,7 @@ join_loop:
 						cl.deliverError("heartbeating with "+coor.Addr(), err)
 					}
 					// we've got heartbeat troubles of one kind or another; disconnect and reconnect
+					rejoin_reason, rejoin_err = RebalanceHeartbeat, err
 					continue join_loop
 				}
 
@@ -965,16 +2382,8 @@ join_loop:
 				heartbeat_timer = time.After(cl.config.Heartbeat.Interval)
 
 			case <-commit_timer:
-				ocreq := &sarama.OffsetCommitRequest{
-					ConsumerGroup:           cl.group_name,
-					ConsumerGroupGeneration: generation_id,
-					ConsumerID:              member_id,
-					RetentionTime:           int64(clconfig.Consumer.Offsets.Retention / time.Millisecond),
-					Version:                 2, // kafka 0.9.0 version, with RetentionTime
-				}
-				if clconfig.Consumer.Offsets.Retention == 0 { // note that this and the rounding math above means that if you wanted a retention time of 0 millseconds you could set Config.Offsets.RetentionTime to something < 1 ms, like 1 nanosecond
-					ocreq.RetentionTime = -1 // use broker's value
-				}
+				refresh_all := time.Since(last_refresh) >= refresh_interval
+				ocreq := newOffsetCommitRequest(cl.group_name, generation_id, member_id, clconfig)
 				var wg sync.WaitGroup
 				resp := make(chan commit_resp, num_assigned_partitions) // allocating room for the responses helps the code run smoothly
 				for _, con := range consumers {
@@ -985,13 +2394,21 @@ join_loop:
 					wg.Wait()
 					close(resp)
 				}(resp, &wg)
-				empty := true
+				commits := make([]commit_resp, 0, num_assigned_partitions)
 				for r := range resp {
-					dbgf("ocreq.AddBlock(%q, %d, %d)", r.topic, r.partition, r.offset)
-					ocreq.AddBlock(r.topic, r.partition, r.offset, 0, "")
-					empty = false
+					offset, ok := cl.committedOffset(r.offset)
+					if !ok {
+						continue
+					}
+					if !refresh_all && cl.lastCommitted(r.topic, r.partition) == r.offset {
+						// nothing has changed since the offset was last committed
+						continue
+					}
+					dbgf("ocreq.AddBlock(%q, %d, %d)", r.topic, r.partition, offset)
+					ocreq.AddBlock(r.topic, r.partition, offset, 0, "")
+					commits = append(commits, r)
 				}
-				if empty {
+				if len(commits) == 0 {
 					// no point in sending an empty commit message
 					break
 				}
@@ -1019,7 +2436,7 @@ join_loop:
 									}
 									prev_kerr = kerr
 								} else {
-									dbgf("same error committing offset of topic %q partition %d", topic, p, kerr)
+									dbgf("same error committing offset of topic %q partition %d: %v", topic, p, kerr)
 								}
 								switch kerr {
 								case sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable, sarama.ErrRebalanceInProgress:
@@ -1035,17 +2452,40 @@ join_loop:
 						}
 					}
 				}
+				if ocresp != nil {
+					for _, r := range commits {
+						if ocresp.Errors[r.topic][r.partition] == 0 {
+							cl.noteCommitted(r.topic, r.partition, r.offset)
+						}
+					}
+				}
+				if err == nil && refresh_all {
+					last_refresh = time.Now()
+				}
 				if try_sidechannel {
 					// immediately send a commit to the side channel
 					commitToSidechannel()
 				}
 				if err != nil {
+					rejoin_reason, rejoin_err = RebalanceCommit, err
 					continue join_loop
 				}
 
 			case <-metadata_timer:
 				dbgf("metadata timer")
-				// the sarama.Client has refreshed its metadata within the interval
+				if cl.config.Metadata.RefreshInterval > 0 && len(consumers) != 0 {
+					// we have to refresh the metadata ourselves
+					topics := make([]string, 0, len(consumers))
+					for topic := range consumers {
+						topics = append(topics, topic)
+					}
+					err := cl.client.RefreshMetadata(topics...)
+					if err != nil {
+						// carry on with whatever metadata sarama has cached
+						cl.deliverError("refreshing metadata", err)
+					}
+				}
+				// otherwise the sarama.Client has refreshed its metadata within the interval
 				// all we do is verify the number of partitions hasn't changed since we joined a topic
 				// this is a local calculation, so no need for any fancy concurrency
 				for topic := range consumers {
@@ -1053,32 +2493,337 @@ join_loop:
 					if err != nil {
 						cl.deliverError(fmt.Sprintf("looking up the partitions of topic %q", topic), err)
 						// and rejoin the groups
+						rejoin_reason, rejoin_err = RebalancePartitions, err
 						continue join_loop
 					}
 					if len(partitions) != num_partitions[topic] {
 						dbgf("num_partitions of topic %q changed from %d to %d; rejoining", topic, num_partitions[topic], len(partitions))
 						// rejoin the new partition count (presumably some new partitions have been added, since you can't remove partitions from a running kafka broker)
+						rejoin_reason, rejoin_err = RebalancePartitions, nil
 						continue join_loop
 					}
 				}
 
 				// this drifts slightly. is that good enough for this use case or must I use a time.Ticker? the worst that happens is an interval is skipped. That is ok, we'll
 				// pick up the change in the next interval.
-				metadata_timer = time.After(clconfig.Metadata.RefreshFrequency)
+				metadata_timer = time.After(metadata_interval)
 
 			case a := <-cl.add_consumers:
 				add(a)
 				// and rejoin so we can become a member of the new topic
-				continue join_loop
+				rejoin_reason, rejoin_err = RebalanceConsumerAdded, nil // (also when the rejoin is deferred)
+				if rejoinAfterChange() {
+					continue join_loop
+				}
 			case r := <-cl.rem_consumer:
 				rem(r)
 				// and rejoin so we can be removed as member of the new topic
+				rejoin_reason, rejoin_err = RebalanceConsumerRemoved, nil
+				if rejoinAfterChange() {
+					continue join_loop
+				}
+			case <-deferred_rejoin:
+				dbgf("rejoining after circuit breaker delay")
+				continue join_loop
+			case <-cl.retry_now:
+				if deferred_rejoin != nil {
+					logf("consumer %q rejoining now instead of after the circuit breaker delay", cl.group_name)
+					continue join_loop
+				}
+				// otherwise we aren't waiting, so there is nothing to cut short
+			case r := <-cl.topics_reqs:
+				topics(r)
+			case r := <-cl.status_reqs:
+				status(r)
+			case p := <-cl.partitioners:
+				logf("consumer %q will propose partitioner %q when it next joins", cl.group_name, p.Name())
+				partitioner = p
+			case <-cl.rejoin:
+				// leave the group and join again as a new member. (a JoinGroup from an existing member doesn't necessarily cause a rebalance)
+				logf("consumer %q rejoining group at the request of a consumer", cl.group_name)
+				req := &sarama.LeaveGroupRequest{
+					GroupId:  cl.group_name,
+					MemberId: member_id,
+				}
+				dbgf("sending LeaveGroupRequest %v", req)
+				resp, err := coor.LeaveGroup(req)
+				dbgf("received LeaveGroupResponse %v, %v", resp, err)
+				if err == nil && resp.Err != 0 {
+					err = resp.Err
+				}
+				if err != nil {
+					cl.deliverError("leaving group", err)
+				}
+				member_id = ""
+				rejoin_reason, rejoin_err = RebalanceRequested, nil
 				continue join_loop
 			}
 		} // end of heartbeat loop
 	} // end of join_loop
 }
 
+// rebalanceDelay implements the rebalance circuit breaker. Given the times of the recent joins, it returns those which are
+// still within window, and how long a rejoin must be delayed so that there are no more than limit joins within window.
+func rebalanceDelay(joins []time.Time, now time.Time, limit int, window time.Duration) ([]time.Time, time.Duration) {
+	if limit <= 0 {
+		return nil, 0
+	}
+	// forget the joins which are outside the window
+	i := 0
+	for i < len(joins) && now.Sub(joins[i]) >= window {
+		i++
+	}
+	joins = joins[i:]
+	if len(joins) < limit {
+		return joins, 0
+	}
+	// the joins[len-limit] must leave the window before we can join again
+	return joins, joins[len(joins)-limit].Add(window).Sub(now)
+}
+
+// the RefreshCoordinator calls in flight, keyed by sarama.Client and group. Several Clients of the same group can share
+// a sarama.Client, and when their coordinator moves they all notice at once. Rather than each of them asking the brokers
+// for the new coordinator, and each replacing the answer the others just cached, they share a single refresh.
+// Only sarama.Clients which are pointers (as sarama.NewClient's are) are keys, since any other type might not be hashable.
+var refreshes struct {
+	sync.Mutex
+	calls map[refresh_key]*refresh_call
+}
+
+type refresh_key struct {
+	client sarama.Client
+	group  string
+}
+
+type refresh_call struct {
+	done chan struct{} // closed when the refresh is complete
+	err  error         // result of the refresh. valid once done is closed
+}
+
+// refreshCoordinator calls client.RefreshCoordinator(group), unless such a call is already in flight, in which case it waits for
+// and returns that call's result.
+func refreshCoordinator(client sarama.Client, group string) error {
+	if reflect.TypeOf(client).Kind() != reflect.Ptr {
+		// we can't share the refresh
+		return client.RefreshCoordinator(group)
+	}
+	key := refresh_key{client, group}
+	refreshes.Lock()
+	if call, ok := refreshes.calls[key]; ok {
+		refreshes.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &refresh_call{done: make(chan struct{})}
+	if refreshes.calls == nil {
+		refreshes.calls = make(map[refresh_key]*refresh_call)
+	}
+	refreshes.calls[key] = call
+	refreshes.Unlock()
+
+	call.err = client.RefreshCoordinator(group)
+
+	refreshes.Lock()
+	delete(refreshes.calls, key)
+	refreshes.Unlock()
+	close(call.done)
+	return call.err
+}
+
+// committedOffset converts the offset of the next message to consume into the offset to commit to kafka. It returns false
+// if there is nothing which can be committed.
+func (cl *client) committedOffset(next int64) (int64, bool) {
+	if !cl.config.CommitLastConsumed {
+		return next, true
+	}
+	if next <= 0 {
+		// either no message has been consumed or next is a special offset; either way there is no last consumed offset
+		return next, false
+	}
+	return next - 1, true
+}
+
+// fetchedOffset converts an offset committed to kafka into the offset of the next message to consume. It is the
+// inverse of committedOffset
+func (cl *client) fetchedOffset(committed int64) int64 {
+	if cl.config.CommitLastConsumed && committed >= 0 {
+		return committed + 1
+	}
+	return committed // kafka's convention, or special offsets like sarama.OffsetNewest, which are never converted
+}
+
+// newOffsetCommitRequest constructs an empty OffsetCommitRequest for the given generation and member
+func newOffsetCommitRequest(group_name string, generation_id int32, member_id string, clconfig *sarama.Config) *sarama.OffsetCommitRequest {
+	ocreq := &sarama.OffsetCommitRequest{
+		ConsumerGroup:           group_name,
+		ConsumerGroupGeneration: generation_id,
+		ConsumerID:              member_id,
+		RetentionTime:           int64(clconfig.Consumer.Offsets.Retention / time.Millisecond),
+		Version:                 2, // kafka 0.9.0 version, with RetentionTime
+	}
+	if clconfig.Consumer.Offsets.Retention == 0 { // note that this and the rounding math above means that if you wanted a retention time of 0 millseconds you could set Config.Offsets.RetentionTime to something < 1 ms, like 1 nanosecond
+		ocreq.RetentionTime = -1 // use broker's value
+	}
+	return ocreq
+}
+
+// how often the periodic commits recommit offsets which haven't changed when sarama.Config.Consumer.Offsets.Retention
+// isn't set. It is half of the broker's default offsets.retention.minutes before kafka 2.0 (1 day)
+const default_commit_refresh_interval = 12 * time.Hour
+
+// sessionTimeoutError explains an ErrInvalidSessionTimeout response to a JoinGroupRequest
+func sessionTimeoutError(err error, config *Config) error {
+	return fmt.Errorf("%w (the configured Session.Timeout %v must be within the brokers' group.min.session.timeout.ms and group.max.session.timeout.ms)", err, config.Session.Timeout)
+}
+
+// dropUnrequested removes from assignments (a map of topic -> partitions) the topics which aren't in requested,
+// and returns them, sorted
+func dropUnrequested(assignments map[string][]int32, requested map[string]bool) []string {
+	var unrequested []string
+	for topic := range assignments {
+		if !requested[topic] {
+			unrequested = append(unrequested, topic)
+			delete(assignments, topic)
+		}
+	}
+	sort.Strings(unrequested)
+	return unrequested
+}
+
+// prepareJoin calls p.PrepareJoin. The Partitioner might be user code, and a bug in it shouldn't take down the
+// whole client, so this and the other wrappers convert any panic into an error.
+func prepareJoin(p Partitioner, jreq *sarama.JoinGroupRequest, topics []string, current_assignments map[string][]int32) (err error) {
+	defer recoverPartitioner(p, "PrepareJoin", &err)
+	p.PrepareJoin(jreq, topics, current_assignments)
+	return nil
+}
+
+// partitionGroup calls p.Partition, converting any panic into an error
+func partitionGroup(p Partitioner, sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) (err error) {
+	defer recoverPartitioner(p, "Partition", &err)
+	return p.Partition(sreq, jresp, client)
+}
+
+// parseSync calls p.ParseSyncUserData if p is a UserDataPartitioner, or p.ParseSync otherwise, converting any panic into an error
+func parseSync(p Partitioner, sresp *sarama.SyncGroupResponse) (assignments map[string][]int32, user_data []byte, err error) {
+	if udp, ok := p.(UserDataPartitioner); ok {
+		defer recoverPartitioner(p, "ParseSyncUserData", &err)
+		return udp.ParseSyncUserData(sresp)
+	}
+	defer recoverPartitioner(p, "ParseSync", &err)
+	assignments, err = p.ParseSync(sresp)
+	return assignments, nil, err
+}
+
+// the advice given when a member assignment is too large for sarama to receive
+const assignment_too_large_advice = "wrap Config.Partitioner with compressed.New() to compress the assignments, or raise sarama.MaxResponseSize"
+
+// the approximate size of a SyncGroupResponse, not counting the member assignment
+const sync_group_response_overhead = 64
+
+// checkAssignmentSizes returns an error if any member assignment in sreq would make a SyncGroupResponse which is too large for sarama to receive
+func checkAssignmentSizes(sreq *sarama.SyncGroupRequest) error {
+	for member, data := range sreq.GroupAssignments {
+		if len(data)+sync_group_response_overhead > int(sarama.MaxResponseSize) {
+			return fmt.Errorf("the %d byte assignment of member %q exceeds sarama.MaxResponseSize of %d bytes; %s", len(data), member, sarama.MaxResponseSize, assignment_too_large_advice)
+		}
+	}
+	return nil
+}
+
+// syncGroupError turns the error sarama returns when the SyncGroupResponse is larger than sarama.MaxResponseSize into an
+// error which explains the remedies. Other errors are returned as-is. Otherwise the failure is an inscrutable decoding
+// error, and the client rejoins, and fails again, forever.
+func syncGroupError(err error) error {
+	if pde, ok := err.(sarama.PacketDecodingError); ok && strings.Contains(pde.Info, "too large") {
+		return fmt.Errorf("SyncGroupResponse larger than sarama.MaxResponseSize of %d bytes (%w); %s", sarama.MaxResponseSize, err, assignment_too_large_advice)
+	}
+	return err
+}
+
+// logSyncAssignments decodes and logs the assignments the leader is about to send in sreq
+func logSyncAssignments(group_name string, generation_id int32, jresp *sarama.JoinGroupResponse, sreq *sarama.SyncGroupRequest) {
+	LogAssignments(group_name, generation_id, decodeSyncAssignments(group_name, generation_id, jresp, sreq))
+}
+
+// decodeSyncAssignments decodes the assignments the leader is about to send in sreq. returns a map of member -> topic -> partitions
+func decodeSyncAssignments(group_name string, generation_id int32, jresp *sarama.JoinGroupResponse, sreq *sarama.SyncGroupRequest) map[string]map[string][]int32 {
+	assignments := make(map[string]map[string][]int32, len(jresp.Members))
+	for member := range jresp.Members {
+		assignments[member] = nil // members which were assigned nothing are listed too
+	}
+	for member, data := range sreq.GroupAssignments {
+		if len(data) == 0 {
+			continue
+		}
+		sresp := sarama.SyncGroupResponse{MemberAssignment: data}
+		ma, err := sresp.GetMemberAssignment()
+		if err != nil {
+			// not something we can decode (the compressed partitioner's assignments, for instance)
+			logf("consumer %q generation %d can't decode %d byte assignment of member %q: %v", group_name, generation_id, len(data), member, err)
+			continue
+		}
+		assignments[member] = ma.Topics
+	}
+	return assignments
+}
+
+// LogAssignments logs the matrix of assignments of partitions to members, one member per line, in a stable order
+// so that the logs of successive generations can be compared. It is what Config.LogAssignments logs. Custom
+// Partitioners can call it to log their own assignments in the same format.
+func LogAssignments(group_name string, generation_id int32, assignments map[string]map[string][]int32) {
+	members := make([]string, 0, len(assignments))
+	for member := range assignments {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "consumer %q generation %d assignments of %d members:", group_name, generation_id, len(members))
+	for _, member := range members {
+		topics := make([]string, 0, len(assignments[member]))
+		for topic := range assignments[member] {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+
+		fmt.Fprintf(&buf, "\n  %s:", member)
+		if len(topics) == 0 {
+			buf.WriteString(" (nothing)")
+		}
+		for _, topic := range topics {
+			partitions := append([]int32(nil), assignments[member][topic]...)
+			sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+			fmt.Fprintf(&buf, " %s%v", topic, partitions)
+		}
+	}
+	logf("%s", buf.String())
+}
+
+// recoverPartitioner recovers from a panic in a Partitioner's method, and stores an error describing the panic in *err
+func recoverPartitioner(p Partitioner, method string, err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("Partitioner %T.%s panicked: %v", p, method, r)
+	}
+}
+
+// newJoinGroupRequest constructs the JoinGroupRequest (minus the partitioner's protocol metadata) appropriate for the
+// kafka version in the sarama.Config
+func newJoinGroupRequest(group_name string, member_id string, config *Config, clconfig *sarama.Config) *sarama.JoinGroupRequest {
+	jreq := &sarama.JoinGroupRequest{
+		GroupId:        group_name,
+		SessionTimeout: int32(config.Session.Timeout / time.Millisecond),
+		MemberId:       member_id,
+		ProtocolType:   "consumer", // we implement the standard kafka 0.9 consumer protocol metadata
+	}
+	if clconfig.Version.IsAtLeast(sarama.V0_10_1_0) {
+		// version 1 of the JoinGroupRequest carries a rebalance timeout separate from the session timeout
+		jreq.Version = 1
+		jreq.RebalanceTimeout = int32(config.Rebalance.Timeout / time.Millisecond)
+	}
+	return jreq
+}
+
 type sidechannel_key struct {
 	topic     string
 	partition int32
@@ -1323,10 +3068,11 @@ func (cl *client) sidechannel_consumer(topic string, queries <-chan sidechannel_
 
 // produce to the sidechannel partition when asked
 // if topic == "" then silently throw away any requests to produce
-func (cl *client) sidechannel_producer(topic string) {
+func (cl *client) sidechannel_producer(topic string, exited chan<- struct{}) {
 	dbgf("sidechannel_producer(%q)", topic)
 	defer dbgf("sidechannel_producer(%q) exiting", topic)
 	defer cl.wg.Done()
+	defer close(exited)
 
 	our_key := []byte(cl.group_name)
 
@@ -1401,25 +3147,22 @@ func (cl *client) sidechannel_producer(topic string) {
 		}
 
 		dbgf("sending offsets to side-channel topic %q", cl.config.SidechannelTopic)
-		select {
-		case producer.Input() <- &sarama.ProducerMessage{
+		// note: we don't abort when cl.closed is closed, since the final offsets are committed while the client is closing
+		producer.Input() <- &sarama.ProducerMessage{
 			Topic: cl.config.SidechannelTopic,
 			Key:   sarama.ByteEncoder(our_key),
 			Value: sarama.ByteEncoder(data),
-		}:
-		case <-cl.closed:
-			return
 		}
 	}
 
 	for {
 		select {
-		case <-cl.closed:
-			dbgf("sidechannel producer closed")
-			// consumer is shutting down; let the defers do the cleanup
-			return
-
-		case offsets := <-cl.sidechannel_commit:
+		case offsets, ok := <-cl.sidechannel_commit:
+			if !ok {
+				dbgf("sidechannel producer closed")
+				// client is shutting down; let the defers do the cleanup (producer.Close() flushes any pending msgs)
+				return
+			}
 			send(offsets)
 
 		case err, ok := <-perrors:
@@ -1439,6 +3182,31 @@ func (cl *client) sidechannel_producer(topic string) {
 	}
 }
 
+// noteCommitted records that offset was successfully committed to kafka for the topic's partition
+func (cl *client) noteCommitted(topic string, partition int32, offset int64) {
+	cl.committed_lock.Lock()
+	partitions := cl.committed[topic]
+	if partitions == nil {
+		if cl.committed == nil {
+			cl.committed = make(map[string]map[int32]int64)
+		}
+		partitions = make(map[int32]int64)
+		cl.committed[topic] = partitions
+	}
+	partitions[partition] = offset
+	cl.committed_lock.Unlock()
+}
+
+// lastCommitted returns the last offset successfully committed for the topic's partition, or -1 if there isn't one
+func (cl *client) lastCommitted(topic string, partition int32) int64 {
+	cl.committed_lock.Lock()
+	defer cl.committed_lock.Unlock()
+	if offset, ok := cl.committed[topic][partition]; ok {
+		return offset
+	}
+	return -1
+}
+
 // makeError wraps err into a *Error, associating it with context
 func (cl *client) makeError(context string, err error) *Error {
 	return &Error{
@@ -1456,9 +3224,39 @@ func (cl *client) deliverError(context string, err error) {
 		err = cl.makeError(context, err)
 	}
 	logf("%v", err)
-	select {
-	case cl.errors <- err:
-	case <-cl.closed:
+	overflow := cl.config.Errors.Overflow
+	if overflow == ErrorsLatest && cap(cl.errors) == 0 {
+		// there's no buffer to hold the latest errors
+		overflow = ErrorsDrop
+	}
+	switch overflow {
+	case ErrorsDrop:
+		select {
+		case cl.errors <- err:
+		default:
+			dbgf("dropping error %v", err)
+		}
+	case ErrorsLatest:
+		for {
+			select {
+			case cl.errors <- err:
+				return
+			case <-cl.closed:
+				return
+			default:
+			}
+			// make room by dropping the oldest error
+			select {
+			case old := <-cl.errors:
+				dbgf("dropping error %v", old)
+			default:
+			}
+		}
+	default: // ErrorsBlock
+		select {
+		case cl.errors <- err:
+		case <-cl.closed:
+		}
 	}
 }
 
@@ -1471,16 +3269,44 @@ type consumer struct {
 	// if false then Done() must be called for each message, but need not be called in message receive order.
 
 	messages chan *sarama.ConsumerMessage
+	discards chan *sarama.ConsumerMessage // channel over which Close() hands consumer.run the msgs it discarded from messages, so linger() doesn't wait for them
 
 	closed     chan struct{} // channel which is closed when the consumer is AsyncClose()ed
 	close_once sync.Once     // Once used to make sure we close only once
+	stopped    chan struct{} // channel which is closed when the consumer stops accepting Done() (after any Config.Close.GracePeriod)
 	exited     chan struct{} // channel which is closed when the consumer is far enough along in exiting that consumer.Close can return
+	close_lock sync.Mutex    // lock protecting close_err
+	close_err  error         // the last error committing the final offsets while closing. written before consumer.run closes exited
 
 	assignments chan *assignment // channel over which client.run sends consumer.run each generation's partition assignments
 	commit_reqs chan commit_req  // channel over which client.run sends consumer.run request to fill out a OffsetCommitRequest
 
+	explicit_commits chan explicit_commit // channel over which Commit() sends offsets to commit to consumer.run
+	rewinds          chan rewind          // channel over which Rewind() sends its requests to consumer.run
+
+	assignment_changes chan Assignment // channel through which consumer.run publishes assignment changes. Holds only the latest unread Assignment
+	ticks              chan time.Time  // channel through which consumer.run sends a tick every Config.TickInterval. Holds only the oldest unread tick
+
+	stats_reqs chan chan<- ConsumerStats // channel over which Stats() asks consumer.run for the stats
+
+	retries sync.WaitGroup // the goroutines retrying commits as configured by Config.CommitRetry
+
+	inflight_bytes int64 // total size of the delivered msgs which are not yet Done(). Used only by consumer.run, and only if !in_order_done
+
+	rate_interval int64 // minimum time.Duration between the msgs of each partition, or 0 if there is no rate limit. Accessed atomically
+
+	pause_lock sync.Mutex              // lock protecting paused
+	paused     map[int32]chan struct{} // nil, or map of partition -> channel which is closed when the partition's Pause() is undone by Resume()
+
+	last_lock     sync.Mutex      // lock protecting last_in_fetch
+	last_in_fetch map[int32]int64 // map of partition -> offset of the latest msg which was the last one fetched when partition.run received it
+
+	nacks        chan *sarama.ConsumerMessage // channel through which Nack() returns messages
+	redeliveries chan redelivery              // channel through which Nack()ed messages return to consumer.run to be redelivered
+
 	restart_partitions chan *partition              // channel through which partition.run delivers partition restart [at new offset] requests if !Config.NoMessages. nil otherwise
-	premessages        chan *sarama.ConsumerMessage // channel through which partition.run delivers messages to consumer.run if !in_order_done. nil otherwise
+	refetch_partitions chan *partition              // channel through which partition.run delivers requests to restart its partition consumer at part.fetch_offset if !Config.NoMessages. nil otherwise
+	premessages        chan premessage              // channel through which partition.run delivers messages to consumer.run if !in_order_done. nil otherwise
 	done               chan *sarama.ConsumerMessage // channel through which Done() returns messages
 }
 
@@ -1496,6 +3322,37 @@ type commit_resp struct {
 	offset    int64
 }
 
+// redelivery is a Nack()ed message to be redelivered, as long as its partition hasn't changed
+type redelivery struct {
+	part *partition
+	msg  *sarama.ConsumerMessage
+}
+
+// explicit_commit is a request from Commit() to consumer.run to commit the given offsets
+type explicit_commit struct {
+	offsets map[int32]int64 // map of partition -> offset
+	reply   chan<- error
+}
+
+// lazy_start is the outcome of a lazily started partition's check for msgs, sent by partition.startIfNotEmpty to consumer.run
+type lazy_start struct {
+	part     *partition
+	consumer sarama.PartitionConsumer // nil if the partition is still empty, or couldn't be started
+	offset   int64                    // the offset at which consumer starts
+}
+
+// premessage is a msg on its way from partition.run to consumer.run, along with the partition which consumed it
+type premessage struct {
+	part *partition
+	msg  *sarama.ConsumerMessage
+}
+
+// rewind is a request from Rewind() to consumer.run
+type rewind struct {
+	n     int64 // # of messages to rewind
+	reply chan<- error
+}
+
 // SidechannelMsg is what is published to and read from the Config.SidechannelTopic
 type SidechannelMsg struct {
 	Ver           int                            // should be 1
@@ -1517,36 +3374,247 @@ type assignment struct {
 	member_id           string                   // the member_id assigned to us by the coordinator
 	assignments         map[string][]int32       // map of topic -> list of partitions
 	sidechannel_queries chan<- sidechannel_query // nil, or a channel over which consumers can ask about sidechannel information
+	commits             *commit_batch            // batch into which the consumers commit the offsets of the partitions they are no longer assigned
 }
 
-// construct a *Error from this consumer
-func (con *consumer) makeError(context string, err error) *Error {
-	Err := con.cl.makeError(context, err)
-	Err.Consumer = con
-	Err.Topic = con.topic
-	return Err
+// commit_batch coalesces the final offsets of the partitions the consumers of a client stop consuming at a rebalance into
+// a single OffsetCommitRequest. Each consumer given the batch must call add or skip exactly once (client.run calls skip on
+// behalf of a consumer which never received the batch). Whoever makes the last call sends the request within that call,
+// and the others wait for the result.
+type commit_batch struct {
+	cl *client
+
+	lock          sync.Mutex
+	pending       int                         // # of consumers which have yet to call add or skip
+	ocreq         *sarama.OffsetCommitRequest // nil, or the request being filled in
+	coor          *sarama.Broker              // coordinating broker to which ocreq is sent
+	generation_id int32                       // generation and member of ocreq
+	member_id     string
+
+	sent   chan struct{} // closed once the request has been sent (or there was nothing to send), and ocresp and err are set
+	ocresp *sarama.OffsetCommitResponse
+	err    error
 }
 
-// construct and deliver an *Error from this consumer
-func (con *consumer) deliverError(context string, partition int32, err error) {
-	Err := con.makeError(context, err)
-	Err.Partition = partition
-	con.cl.deliverError("", Err)
+func newCommitBatch(cl *client, consumers int) *commit_batch {
+	b := &commit_batch{
+		cl:      cl,
+		pending: consumers,
+		sent:    make(chan struct{}),
+	}
+	if consumers == 0 {
+		close(b.sent)
+	}
+	return b
+}
+
+// add adds the committed offsets of topic's partitions to the batch, and returns true if they were added, in which case
+// the caller must wait for the result. It returns false if there are no offsets, or if they are from another generation
+// than the rest of the batch, in which case the caller must commit them itself.
+func (b *commit_batch) add(generation_id int32, member_id string, coor *sarama.Broker, topic string, offsets []SidechannelOffset) bool {
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	added := false
+	if len(offsets) != 0 {
+		if b.ocreq == nil {
+			b.ocreq = newOffsetCommitRequest(b.cl.group_name, generation_id, member_id, b.cl.client.Config())
+			b.coor = coor
+			b.generation_id = generation_id
+			b.member_id = member_id
+		}
+		if b.generation_id == generation_id && b.member_id == member_id && b.coor == coor {
+			for _, o := range offsets {
+				dbgf("ocreq.AddBlock(%q, %d, %d)", topic, o.Partition, o.Offset)
+				b.ocreq.AddBlock(topic, o.Partition, o.Offset, 0, "")
+			}
+			added = true
+		}
+	}
+	b.lock.Unlock()
+	b.skip()
+	return added
+}
+
+// skip records that a consumer has nothing (more) to add to the batch. The last call to add or skip sends the batch, and
+// so can block for a round trip to the coordinator.
+func (b *commit_batch) skip() {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.pending--
+	last := b.pending == 0
+	b.lock.Unlock()
+	if !last {
+		return
+	}
+	if b.ocreq != nil {
+		dbgf("sending batched OffsetCommitRequest %v", b.ocreq)
+		b.ocresp, b.err = b.coor.CommitOffset(b.ocreq)
+		dbgf("received batched OffsetCommitResponse %v, %v", b.ocresp, b.err)
+	}
+	close(b.sent)
+}
+
+// construct a *Error from this consumer
+func (con *consumer) makeError(context string, err error) *Error {
+	Err := con.cl.makeError(context, err)
+	Err.Consumer = con
+	Err.Topic = con.topic
+	return Err
+}
+
+// construct and deliver an *Error from this consumer
+func (con *consumer) deliverError(context string, partition int32, err error) {
+	Err := con.makeError(context, err)
+	Err.Partition = partition
+	con.cl.deliverError("", Err)
 }
 
 func (con *consumer) Messages() <-chan *sarama.ConsumerMessage { return con.messages }
 
+func (con *consumer) AssignmentChanges() <-chan Assignment { return con.assignment_changes }
+
+func (con *consumer) Ticks() <-chan time.Time { return con.ticks }
+
+func (con *consumer) LastInFetch(msg *sarama.ConsumerMessage) bool {
+	con.last_lock.Lock()
+	offset, ok := con.last_in_fetch[msg.Partition]
+	con.last_lock.Unlock()
+	return ok && offset == msg.Offset
+}
+
+// noteLastInFetch records that msg was the last fetched msg of its partition
+func (con *consumer) noteLastInFetch(msg *sarama.ConsumerMessage) {
+	con.last_lock.Lock()
+	if con.last_in_fetch == nil {
+		con.last_in_fetch = make(map[int32]int64)
+	}
+	con.last_in_fetch[msg.Partition] = msg.Offset
+	con.last_lock.Unlock()
+}
+
+func (con *consumer) SetRateLimit(per_second float64) {
+	var interval time.Duration
+	if per_second > 0 {
+		interval = time.Duration(float64(time.Second) / per_second)
+	}
+	atomic.StoreInt64(&con.rate_interval, int64(interval))
+}
+
+// ask consumer.run for the stats
+func (con *consumer) Stats() ConsumerStats {
+	reply := make(chan ConsumerStats, 1)
+	select {
+	case con.stats_reqs <- reply:
+		return <-reply
+	case <-con.closed:
+		return ConsumerStats{Topic: con.topic}
+	}
+}
+
+func (con *consumer) Lag() map[int32]int64 {
+	return con.Stats().Lag()
+}
+
+// Lag computes the lag of each partition in the stats, as returned by Consumer.Lag()
+func (s ConsumerStats) Lag() map[int32]int64 {
+	lag := make(map[int32]int64, len(s.Partitions))
+	for p, ps := range s.Partitions {
+		if ps.HighWaterMark < 0 || ps.Committable < 0 {
+			// unknown
+			continue
+		}
+		l := ps.HighWaterMark - ps.Committable
+		if l < 0 {
+			// the high-water mark is sampled at the last fetch, so it can lag behind
+			l = 0
+		}
+		lag[p] = l
+	}
+	return lag
+}
+
+// compute the stats of the partition. only consumer.run may call this
+func (part *partition) stats() PartitionStats {
+	s := PartitionStats{
+		Delivered:         atomic.LoadInt64(&part.delivered),
+		Done:              part.done,
+		OldestOutstanding: -1,
+		Committable:       part.compute_commit_offset(),
+		Committed:         part.con.cl.lastCommitted(part.con.topic, part.partition),
+		HighWaterMark:     -1,
+	}
+	if part.con.in_order_done {
+		if d := atomic.LoadInt64(&part.delivered_offset); d > part.next_commit_offset {
+			if part.next_commit_offset >= 0 {
+				s.Outstanding = d - part.next_commit_offset
+				s.OldestOutstanding = part.next_commit_offset
+			} else {
+				// nothing has been Done() yet
+				s.Outstanding = s.Delivered
+			}
+		}
+	} else {
+		for _, b := range part.buckets {
+			s.Outstanding += int64(b.read) - int64(b.done)
+		}
+		if s.Outstanding != 0 {
+			s.OldestOutstanding = s.Committable
+		}
+	}
+	if part.consumer != nil {
+		s.HighWaterMark = part.consumer.HighWaterMarkOffset()
+	}
+	return s
+}
+
+// publish an Assignment to con.assignment_changes without blocking, combining it with any previous Assignment which is still unread.
+// only consumer.run may call this, since it must be the only sender
+func (con *consumer) publishAssignment(a Assignment) {
+	select {
+	case prev := <-con.assignment_changes:
+		// the reader hasn't kept up. recompute the changes relative to the partitions before prev
+		base := make(map[int32]*partition, len(prev.Partitions))
+		for _, p := range prev.Partitions {
+			base[p] = nil
+		}
+		for _, p := range prev.Added {
+			delete(base, p)
+		}
+		for _, p := range prev.Removed {
+			base[p] = nil
+		}
+		a.Added, a.Removed = difference(base, a.Partitions)
+	default:
+	}
+	// we are the only sender, so there is now room in the channel
+	con.assignment_changes <- a
+}
+
 // close the consumer. it can safely be called multiple times
 func (con *consumer) AsyncClose() {
 	dbgf("AsyncClose consumer of topic %q", con.topic)
 	con.close_once.Do(func() { close(con.closed) })
 }
 
+func (con *consumer) Closed() <-chan struct{} { return con.exited }
+
 // close the consumer and wait
-func (con *consumer) Close() {
+func (con *consumer) Close() error {
 	dbgf("Close consumer of topic %q", con.topic)
 	con.AsyncClose() // initiate the shutdown
-	<-con.exited     // and wait around until it is complete
+	for msg := range con.messages {
+		// discard the msgs the caller didn't read, and tell linger() they will never be Done()
+		select {
+		case con.discards <- msg:
+		case <-con.stopped:
+		}
+	}
+	<-con.exited // and wait around until it is complete
+	return con.close_err
 }
 
 // consumer goroutine coordinates consuming from multiple partitions in a topic
@@ -1559,24 +3627,159 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 
 	partitions := make(map[int32]*partition) // map of partition number -> partition consumer
 
-	// shutdown the removed partitions, committing their last offset
-	remove := func(removed []int32) {
+	max_buckets := int((con.cl.config.MaxOutstandingSpan + offsets_per_bucket - 1) >> lg2_offsets_per_bucket) // Config.MaxOutstandingSpan, rounded up to a whole # of buckets
+
+	var settling []int32                // the added partitions waiting out Config.Rebalance.SettleDelay before they are started
+	var settling_assignment *assignment // the assignment which most recently added or kept them
+	var settle_timer <-chan time.Time   // non-nil while settling isn't empty. fires when the SettleDelay is over
+
+	var done_below map[int32]int64 // nil, or if Config.Deduplicate or ResumeLocalOffsets, map of partition number -> offset below which every msg has been Done() in this process
+	if con.cl.config.Deduplicate || con.cl.config.ResumeLocalOffsets {
+		done_below = make(map[int32]int64)
+	}
+
+	// remember how far part got, in case we consume its partition again
+	forget := func(part *partition) {
+		if done_below == nil {
+			return
+		}
+		offset := part.compute_commit_offset()
+		if offset == sarama.OffsetNewest || offset == sarama.OffsetOldest {
+			return
+		}
+		if offset > done_below[part.partition] {
+			done_below[part.partition] = offset
+		}
+	}
+
+	// arrange for a newly constructed part to skip any msgs which were already Done() in this process. Called concurrently, but only while done_below isn't being modified
+	deduplicate := func(part *partition) {
+		below, ok := done_below[part.partition]
+		if !ok || !con.cl.config.Deduplicate {
+			return
+		}
+		if offset := part.next_commit_offset; offset == sarama.OffsetNewest || offset >= below {
+			// there's nothing we've seen before
+			return
+		}
+		dbgf("consumer %q of %q partition %d skipping msgs below offset %d, which are already Done()", con.cl.group_name, con.topic, part.partition, below)
+		// msgs below next_commit_offset are dropped as stale by consumer.run, and skipped by partition.run when they'd go directly to the caller
+		part.next_commit_offset = below
+		part.dedup_below = below
+	}
+
+	// handle a commit request from client.run
+	commit_req := func(c commit_req) {
+		dbgf("consumer %q commit_req(%v)", con.topic, c)
+		for p, partition := range partitions {
+			c.resp <- commit_resp{topic: con.topic, partition: p, offset: partition.compute_commit_offset()}
+		}
+		c.wg.Done()
+	}
+
+	// report offsets, which are those of the next messages to consume, which could not be committed. Called concurrently
+	commit_failed := func(offsets []SidechannelOffset, err error) {
+		select {
+		case <-con.closed:
+			// these are the final offsets, which Close() reports
+			con.close_lock.Lock()
+			con.close_err = con.makeError("committing final offsets", err)
+			con.close_lock.Unlock()
+		default:
+		}
+		if con.cl.config.CommitFailedNotification != nil {
+			failed := make(map[int32]int64, len(offsets))
+			for _, o := range offsets {
+				failed[o.Partition] = o.Offset
+			}
+			con.cl.config.CommitFailedNotification(con.topic, failed, err)
+		}
+	}
+
+	// retry committing offsets, which are those of the next messages to consume, as configured by Config.CommitRetry.
+	// It runs in its own goroutine, so consumer.run keeps answering Done() and client.run while it waits. The partitions
+	// were unassigned by a rebalance, so each attempt commits as a member of the group's current generation. err is the
+	// error of the first attempt
+	retry_commit := func(offsets []SidechannelOffset, err error) {
+		defer con.retries.Done()
+		var lost []SidechannelOffset // offsets which failed permanently
+		closing := false             // the Consumer is being closed, so we don't wait any longer, and make only one last attempt
+		for attempt := 0; attempt < con.cl.config.CommitRetry.Max && len(offsets) != 0 && !closing; attempt++ {
+			delay := con.cl.client.Config().Metadata.Retry.Backoff
+			if con.cl.config.CommitRetry.Backoff != nil {
+				delay = con.cl.config.CommitRetry.Backoff.NextDelay(attempt)
+			}
+			logf("consumer %q of %q retrying commit of %d offsets in %v (attempt %d): %v", con.cl.group_name, con.topic, len(offsets), delay, attempt+1, err)
+			select {
+			case <-time.After(delay):
+			case <-con.closed:
+				closing = true
+			}
+
+			// commit as a member of the group if we are one. Otherwise commit as a client which isn't a member, which
+			// the coordinator accepts only while the group has no members
+			con.cl.stable_lock.Lock()
+			m := con.cl.membership
+			con.cl.stable_lock.Unlock()
+			if m.coor == nil {
+				m.generation_id = -1
+			}
+
+			if err = refreshCoordinator(con.cl.client, con.cl.group_name); err != nil {
+				continue
+			}
+			var coor *sarama.Broker
+			if coor, err = con.cl.client.Coordinator(con.cl.group_name); err != nil {
+				continue
+			}
+			ocreq := newOffsetCommitRequest(con.cl.group_name, m.generation_id, m.member_id, con.cl.client.Config())
+			for _, o := range offsets {
+				committed, _ := con.cl.committedOffset(o.Offset)
+				dbgf("ocreq.AddBlock(%q, %d, %d)", con.topic, o.Partition, committed)
+				ocreq.AddBlock(con.topic, o.Partition, committed, 0, "")
+			}
+			dbgf("sending OffsetCommitRequest %v", ocreq)
+			ocresp, err2 := coor.CommitOffset(ocreq)
+			dbgf("received OffsetCommitResponse %v, %v", ocresp, err2)
+			if err2 != nil {
+				err = err2
+				continue
+			}
+			var failed []SidechannelOffset
+			for _, o := range offsets {
+				switch kerr := ocresp.Errors[con.topic][o.Partition]; kerr {
+				case sarama.ErrNoError:
+					con.cl.noteCommitted(con.topic, o.Partition, o.Offset)
+				case sarama.ErrIllegalGeneration, sarama.ErrRebalanceInProgress, sarama.ErrUnknownMemberId:
+					// the generation changed since we looked. the next attempt commits as a member of the new one
+					failed = append(failed, o)
+					err = kerr
+				default:
+					if retriableCommitError(kerr) {
+						failed = append(failed, o)
+					} else {
+						lost = append(lost, o)
+					}
+					err = kerr
+				}
+			}
+			offsets = failed
+		}
+		if offsets = append(lost, offsets...); len(offsets) != 0 {
+			commit_failed(offsets, err)
+		}
+	}
+
+	// shutdown the removed partitions, committing their last offset. if batch isn't nil the commit is part of batch,
+	// which the caller must not otherwise skip
+	remove := func(removed []int32, batch *commit_batch) {
 		dbgf("consumer %q rem(%v)", con.topic, removed)
 		if len(removed) == 0 {
 			// nothing to do, and no point in sending an empty OffsetCommitRequest msg either
+			batch.skip()
 			return
 		}
-		clconfig := con.cl.client.Config()
-		ocreq := &sarama.OffsetCommitRequest{
-			ConsumerGroup:           con.cl.group_name,
-			ConsumerGroupGeneration: generation_id,
-			ConsumerID:              member_id,
-			RetentionTime:           int64(clconfig.Consumer.Offsets.Retention / time.Millisecond),
-			Version:                 2, // kafka 0.9.0 version, with RetentionTime
-		}
-		if clconfig.Consumer.Offsets.Retention == 0 { // note that this and the rounding math above means that if you wanted a retention time of 0 millseconds you could set Config.Offsets.RetentionTime to something < 1 ms, like 1 nanosecond
-			ocreq.RetentionTime = -1 // use broker's value
-		}
+		var commits = make([]SidechannelOffset, 0, len(removed)) // the offsets to commit to kafka
 		var sidechannel_offsets = make([]SidechannelOffset, 0, len(removed))
 		for _, p := range removed {
 			// stop consuming from partition p
@@ -1585,19 +3788,49 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 				if part.consumer != nil {
 					part.consumer.Close()
 				}
+				part.unthrottle() // so partition.run can see it is finished
+				forget(part)
+				con.inflight_bytes -= part.inflight_bytes
 				offset := part.compute_commit_offset()
 				if offset == sarama.OffsetNewest || offset == sarama.OffsetOldest {
 					continue // omit this partition, we don't have a proper offset for this partition b/c we have not yet received any msgs on this partition yet
 				}
-				dbgf("ocreq.AddBlock(%q, %d, %d)", con.topic, p, offset)
-				ocreq.AddBlock(con.topic, p, offset, 0, "")
+				if committed, ok := con.cl.committedOffset(offset); ok {
+					commits = append(commits, SidechannelOffset{p, committed})
+				}
 				sidechannel_offsets = append(sidechannel_offsets, SidechannelOffset{p, offset})
 				logf("consumer %q stopped consuming %q partition %d at offset %d", con.cl.group_name, con.topic, p, offset)
 			}
 		}
-		dbgf("sending OffsetCommitRequest %v", ocreq)
-		ocresp, err := coor.CommitOffset(ocreq)
-		dbgf("received OffsetCommitResponse %v, %v", ocresp, err)
+		var ocresp *sarama.OffsetCommitResponse
+		var err error
+		if batch.add(generation_id, member_id, coor, con.topic, commits) {
+			// wait for the other consumers to add their offsets and for the batch to be sent, while still answering client.run
+			// (the other consumers may be behind a commit_req from client.run)
+		wait_loop:
+			for {
+				select {
+				case <-batch.sent:
+					break wait_loop
+				case c := <-con.commit_reqs:
+					commit_req(c)
+				}
+			}
+			ocresp, err = batch.ocresp, batch.err
+		} else {
+			if len(commits) == 0 {
+				// no point in sending an empty OffsetCommitRequest
+				return
+			}
+			ocreq := newOffsetCommitRequest(con.cl.group_name, generation_id, member_id, con.cl.client.Config())
+			for _, o := range commits {
+				dbgf("ocreq.AddBlock(%q, %d, %d)", con.topic, o.Partition, o.Offset)
+				ocreq.AddBlock(con.topic, o.Partition, o.Offset, 0, "")
+			}
+			dbgf("sending OffsetCommitRequest %v", ocreq)
+			ocresp, err = coor.CommitOffset(ocreq)
+			dbgf("received OffsetCommitResponse %v, %v", ocresp, err)
+		}
 		// log any errors we got. there isn't much we can do about them; the next consumer will start at an older offset
 		try_sidechannel := false
 		if err != nil {
@@ -1605,58 +3838,152 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 			try_sidechannel = true
 		} else {
 			var prev_kerr sarama.KError // don't print the same error over and over. usually the same error will happen to all partitions
-			for _, partitions := range ocresp.Errors {
-				for p, kerr := range partitions {
-					if kerr != 0 {
-						if kerr != prev_kerr {
-							switch kerr {
-							case sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration:
-								// The "error" whenever the kafka consumer group starts a new generation is correct, expected, and normal
-								logf("new consumer group %q generation forming (discovered while committing offset of topic %q partition %d): %v; will publish to side-channel instead", con.cl.group_name, con.topic, p, kerr)
-							default:
-								con.deliverError("committing offset", p, kerr)
-							}
-							prev_kerr = kerr
-						} else {
-							dbgf("same error committing offset of topic %q partition %d", con.topic, p, kerr)
-						}
+			// (a batched response includes the other consumers' topics too)
+			for p, kerr := range ocresp.Errors[con.topic] {
+				if kerr != 0 {
+					if kerr != prev_kerr {
 						switch kerr {
-						case sarama.ErrIllegalGeneration, sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable, sarama.ErrRebalanceInProgress:
-							try_sidechannel = true
+						case sarama.ErrRebalanceInProgress, sarama.ErrIllegalGeneration:
+							// The "error" whenever the kafka consumer group starts a new generation is correct, expected, and normal
+							logf("new consumer group %q generation forming (discovered while committing offset of topic %q partition %d): %v; will publish to side-channel instead", con.cl.group_name, con.topic, p, kerr)
+						default:
+							con.deliverError("committing offset", p, kerr)
 						}
+						prev_kerr = kerr
+					} else {
+						dbgf("same error committing offset of topic %q partition %d: %v", con.topic, p, kerr)
 					}
+					switch kerr {
+					case sarama.ErrIllegalGeneration, sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable, sarama.ErrRebalanceInProgress:
+						try_sidechannel = true
+					}
+				}
+			}
+		}
+		if err == nil {
+			for _, so := range sidechannel_offsets {
+				if ocresp.Errors[con.topic][so.Partition] == 0 {
+					con.cl.noteCommitted(con.topic, so.Partition, so.Offset)
 				}
 			}
 		}
 		if try_sidechannel {
-			select {
-			case con.cl.sidechannel_commit <- map[string][]SidechannelOffset{con.topic: sidechannel_offsets}:
-			case <-con.cl.closed:
+			// note: the sidechannel producer runs until all the consumers have exited, so this can't block forever
+			con.cl.sidechannel_commit <- map[string][]SidechannelOffset{con.topic: sidechannel_offsets}
+		}
+
+		// retry the offsets which failed for reasons which might be transient
+		var failed []SidechannelOffset
+		for _, so := range sidechannel_offsets {
+			if _, ok := con.cl.committedOffset(so.Offset); ok && (err != nil || retriableCommitError(ocresp.Errors[con.topic][so.Partition])) {
+				failed = append(failed, so)
 			}
 		}
+		if len(failed) == 0 {
+			return
+		}
+		if err == nil {
+			err = ocresp.Errors[con.topic][failed[0].Partition]
+		}
+		if con.cl.config.CommitRetry.Max > 0 {
+			con.retries.Add(1)
+			go retry_commit(failed, err)
+			return
+		}
+		commit_failed(failed, err)
 	}
 
-	// handle a commit request from client.run
-	commit_req := func(c commit_req) {
-		dbgf("consumer %q commit_req(%v)", con.topic, c)
-		for p, partition := range partitions {
-			c.resp <- commit_resp{topic: con.topic, partition: p, offset: partition.compute_commit_offset()}
+	// handle a request from Stats()
+	stats_req := func(reply chan<- ConsumerStats) {
+		s := ConsumerStats{
+			Topic:      con.topic,
+			Partitions: make(map[int32]PartitionStats, len(partitions)),
 		}
-		c.wg.Done()
+		for p, part := range partitions {
+			s.Partitions[p] = part.stats()
+		}
+		reply <- s
+	}
+
+	// handle an explicit commit request from Commit()
+	explicit_commit := func(c explicit_commit) {
+		dbgf("consumer %q explicit_commit(%v)", con.topic, c.offsets)
+		for p := range c.offsets {
+			if _, ok := partitions[p]; !ok {
+				Err := con.makeError("Commit", fmt.Errorf("partition %d is not assigned to this consumer", p))
+				Err.Partition = p
+				c.reply <- Err
+				return
+			}
+		}
+		if len(c.offsets) == 0 {
+			c.reply <- nil
+			return
+		}
+		ocreq := newOffsetCommitRequest(con.cl.group_name, generation_id, member_id, con.cl.client.Config())
+		for p, offset := range c.offsets {
+			committed, ok := con.cl.committedOffset(offset)
+			if !ok {
+				continue
+			}
+			dbgf("ocreq.AddBlock(%q, %d, %d)", con.topic, p, committed)
+			ocreq.AddBlock(con.topic, p, committed, 0, "")
+		}
+		dbgf("sending OffsetCommitRequest %v", ocreq)
+		ocresp, err := coor.CommitOffset(ocreq)
+		dbgf("received OffsetCommitResponse %v, %v", ocresp, err)
+		if err != nil {
+			c.reply <- con.makeError("Commit", err)
+			return
+		}
+		for p, kerr := range ocresp.Errors[con.topic] {
+			if kerr != 0 {
+				Err := con.makeError("Commit", kerr)
+				Err.Partition = p
+				c.reply <- Err
+				return
+			}
+		}
+		for p, offset := range c.offsets {
+			if _, ok := con.cl.committedOffset(offset); ok {
+				con.cl.noteCommitted(con.topic, p, offset)
+			}
+		}
+		c.reply <- nil
 	}
 
 	defer func() {
+		if b := con.cl.shutdownBarrier(); b != nil {
+			// we've quiesced (linger() has run). wait for the client's other consumers to quiesce too before committing
+			b.arrive(con)
+			dbgf("consumer %q waiting at the shutdown barrier", con.topic)
+		barrier_loop:
+			for {
+				select {
+				case <-b.released:
+					break barrier_loop
+				case c := <-con.commit_reqs:
+					commit_req(c)
+				case a := <-con.assignments:
+					// ignore them, we're shutting down
+					a.commits.skip()
+				}
+			}
+		}
+
 		if len(partitions) != 0 {
 			// cleanup the remaining partition consumers
 			removed := make([]int32, 0, len(partitions))
 			for p := range partitions {
 				removed = append(removed, p)
 			}
-			remove(removed)
+			remove(removed, nil)
 		}
 
-		con.consumer.Close()
+		con.cl.releaseSaramaConsumer(con.consumer)
 		close(con.messages)
+		close(con.assignment_changes)
+		close(con.ticks)
 
 		// send ourselves to rem_consumer
 	rem_loop:
@@ -1664,8 +3991,9 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 			select {
 			case c := <-con.commit_reqs:
 				commit_req(c)
-			case <-con.assignments:
+			case a := <-con.assignments:
 				// ignore them, we're shutting down
+				a.commits.skip()
 			case con.cl.rem_consumer <- con:
 				break rem_loop
 			}
@@ -1679,15 +4007,66 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 		for c := range con.commit_reqs {
 			commit_req(c)
 		}
-		for range con.assignments {
+		for a := range con.assignments {
 			// ignore them
+			a.commits.skip()
 		}
 
+		// wait for any commit retries, which might yet fail to commit the final offsets
+		con.retries.Wait()
+
 		dbgf("consumer of topic %q exiting", con.topic)
 		close(con.exited)
 		wg.Done()
 	}()
 
+	// advance part's bucket 0 highwater mark, and its commit offset past any complete buckets. Used only if !con.in_order_done
+	advance := func(part *partition) {
+		if len(part.buckets) == 0 {
+			return
+		}
+		// we might be able to advance the bucket 0 highwater mark
+		if part.buckets[0].read == part.buckets[0].done {
+			// we know, since messages a read in offset order, that the range of offsets from the start
+			// of the bucket to .done is completely Done() and can be committed. (this is useful when the
+			// traffic rate is low or a client shuts down cleanly, since in these cases there is a good
+			// chance there are no outstanding offsets in the pipelines)
+			part.bucket_0_highwater = part.buckets[0].done
+		}
+		// we might have finished the oldest bucket, and any later waiting, completed buckets
+		for part.buckets[0].done == offsets_per_bucket {
+			// the oldest bucket is complete; bump the last committed offset and advance to the next bucket
+			part.next_commit_offset += offsets_per_bucket
+			part.bucket_0_highwater = 0
+			part.buckets = part.buckets[1:]
+			if len(part.buckets) == 0 {
+				break
+			}
+		}
+		if len(part.buckets) <= max_buckets && part.unthrottle() {
+			logf("consumer %q of %q partition %d resuming", con.cl.group_name, con.topic, part.partition)
+		}
+	}
+
+	// account for the offsets from up to (but not including) to, which kafka skipped because they were compacted away or
+	// are transaction markers, as read and Done(). Otherwise their buckets would never be complete. Used only if !con.in_order_done
+	skipped := func(part *partition, from, to int64) {
+		for from < to {
+			index := int(from-part.next_commit_offset) >> lg2_offsets_per_bucket
+			for index >= len(part.buckets) {
+				part.buckets = append(part.buckets, bucket{})
+			}
+			end := part.next_commit_offset + int64(index+1)<<lg2_offsets_per_bucket // the end of the bucket
+			if end > to {
+				end = to
+			}
+			part.buckets[index].read += uint8(end - from)
+			part.buckets[index].done += uint8(end - from)
+			from = end
+		}
+		advance(part)
+	}
+
 	// handle a message sent to us via con.done
 	done := func(msg *sarama.ConsumerMessage) {
 		if msg.Topic == "" { // a blank topic can happen when the caller faked the ConsumerMessage and doesn't set .Topic. It's better to have a topic for logging purposes, so fill it in
@@ -1708,7 +4087,19 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 			return
 		}
 
+		part.done++
+
+		if con.cl.config.StrictOrderDone {
+			part.checkDoneOrder(msg.Offset)
+		}
+
 		if con.in_order_done {
+			if !con.cl.config.NoMessages && msg.Offset >= atomic.LoadInt64(&part.received_offset) {
+				// the msg was delivered by an earlier consumer of the partition (one which was rewound), and this one
+				// hasn't got that far yet. Letting it advance the commit offset would skip the rewound msgs
+				dbgf("early message %q:%d/%d", msg.Topic, msg.Partition, msg.Offset)
+				return
+			}
 			// if this advances the commit offset, then record it. otherwise ignore it
 			if part.next_commit_offset <= msg.Offset {
 				part.next_commit_offset = msg.Offset + 1
@@ -1726,55 +4117,18 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 				return
 			}
 			part.buckets[index].done++
+			if n := msgSize(msg); n <= part.inflight_bytes {
+				part.inflight_bytes -= n
+				con.inflight_bytes -= n
+			}
 			if index == 0 {
-				// we might be able to advance the bucket 0 highwater mark
-				if part.buckets[0].read == part.buckets[0].done {
-					// we know, since messages a read in offset order, that the range of offsets from the start
-					// of the bucket to .done is completely Done() and can be committed. (this is useful when the
-					// traffic rate is low or a client shuts down cleanly, since in these cases there is a good
-					// chance there are no outstanding offsets in the pipelines)
-					part.bucket_0_highwater = part.buckets[0].done
-				}
-				// we might have finished the oldest bucket, and any later waiting, completed buckets
-				for part.buckets[0].done == offsets_per_bucket {
-					// the oldest bucket is complete; bump the last committed offset and advance to the next bucket
-					part.next_commit_offset += offsets_per_bucket
-					part.bucket_0_highwater = 0
-					part.buckets = part.buckets[1:]
-					if len(part.buckets) == 0 {
-						break
-					}
-				}
+				advance(part)
 			}
 		}
 	}
 
-	// handle an assignment message
-	assignment := func(a *assignment) {
-		dbgf("consumer %q assignment(%v)", con.topic, a)
-		// see what has changed in the partition assignment of our topic
-		new_partitions := a.assignments[con.topic]
-		added, removed := difference(partitions, new_partitions)
-		dbgf("consumer %q added %v, removed %v", con.topic, added, removed)
-
-		// shutdown the partitions while we still belong to the previous generation
-		remove(removed)
-
-		// update the current generation and related info after committing the last offsets from the previous generation
-		generation_id = a.generation_id
-		coor = a.coordinator
-		member_id = a.member_id
-
-		if len(added) == 0 {
-			// we're done early
-			return
-		}
-
-		// the sarama-cluster code pauses here so that other consumers have time to sync their offsets. Should we do the same?
-		// I've observed with kafka 0.9.0.1 that once the coordinator bumps the generation_id the client can't commit an offset with
-		// the old id. So unless the client lies and sends generation_id+1 when it commits there is nothing it can commit, and there
-		// is no point in waiting. So for now, no waiting.
-
+	// fetch the committed offsets of the added partitions of assignment a, and start consuming them
+	start := func(a *assignment, added []int32) {
 		// fetch the last committed offsets of the new partitions from sarama and, if available, from our side-channel consumer
 
 		oreq := &sarama.OffsetFetchRequest{
@@ -1812,6 +4166,24 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 			return
 		}
 
+		// convert the committed offsets to the offset of the next message to consume
+		for _, b := range oresp.Blocks[con.topic] {
+			b.Offset = con.cl.fetchedOffset(b.Offset)
+		}
+
+		// forget how far this process got in a partition whose committed offset is older, unless it is the offset this
+		// client last committed (its final commit failed, or raced with the rebalance). Otherwise someone else set it: an
+		// operator resetting the group's offsets, or the partition's next owner. Or the topic was recreated. Either way the
+		// msgs below the remembered offset may not have been Done() after all
+		for _, p := range added {
+			below, ok := done_below[p]
+			b := oresp.GetBlock(con.topic, p)
+			if ok && b != nil && b.Err == 0 && b.Offset < below && b.Offset != con.cl.lastCommitted(con.topic, p) {
+				logf("consumer %q of %q partition %d was committed at offset %d by someone else; forgetting that msgs below offset %d were Done()", con.cl.group_name, con.topic, p, b.Offset, below)
+				delete(done_below, p)
+			}
+		}
+
 		// merge any sidechannel results into the sarama results
 		for r := range sidechannel_replies {
 			b := oresp.GetBlock(r.topic, r.partition)
@@ -1825,15 +4197,37 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 			}
 		}
 
+		// and optionally resume any partitions we consumed before from where we left them, if that's further along. (the
+		// partitions whose committed offsets were reset by someone else have been forgotten above)
+		if con.cl.config.ResumeLocalOffsets {
+			for _, p := range added {
+				below, ok := done_below[p]
+				b := oresp.GetBlock(con.topic, p)
+				if ok && b != nil && b.Err == 0 && b.Offset < below {
+					logf("consumer %q of %q resuming partition %d at offset %d, where this process stopped consuming it, rather than at %d", con.cl.group_name, con.topic, p, below, b.Offset)
+					b.Offset = below
+				}
+			}
+		}
+
 		// start consuming from the added partitions at each partition's last committed offset (which by convention kafaka defines as the last consumed offset+1)
 		// since computing the starting offset and beginning to consume requires several round trips to the kafka brokers we start all the
 		// partitions concurrently. That reduces the startup time to a couple RTTs even for topics with a numerous partitions.
+		// optionally the number of partitions starting at once is limited, so that large assignments ramp up smoothly
 		started := make(chan *partition)
+		var starting chan struct{} // nil, or a semaphore limiting the # of partitions starting concurrently
+		if n := con.cl.config.MaxConcurrentPartitionStarts; n > 0 {
+			starting = make(chan struct{}, n)
+		}
 		var wg sync.WaitGroup
 		for _, p := range added {
 			wg.Add(1)
 			go func(p int32) {
 				defer wg.Done()
+				if starting != nil {
+					starting <- struct{}{}
+					defer func() { <-starting }()
+				}
 				ob := oresp.GetBlock(con.topic, p)
 				if ob == nil {
 					// can't start this partition without an offset
@@ -1844,6 +4238,9 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 					con.deliverError("FetchOffset response", p, ob.Err)
 					return
 				}
+				if con.cl.config.FetchedOffsetNotification != nil {
+					con.cl.config.FetchedOffsetNotification(con.topic, p, ob.Offset, ob.Metadata)
+				}
 
 				// run the committed offset through the StartingOffset() hook
 				offset, err := con.cl.config.StartingOffset(con.topic, p, ob.Offset, con.cl.client)
@@ -1851,6 +4248,33 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 					con.deliverError("StartingOffset", p, err)
 					return
 				}
+				if ob.Offset == sarama.OffsetNewest {
+					// there is no committed offset. Either this is a new consumer group, or the group's offsets have been lost
+					// (expired by the broker's offset retention, or the topic was recreated). Make that visible.
+					logf("consumer %q has no committed offset for %q partition %d; reset to offset %d", con.cl.group_name, con.topic, p, offset)
+					if con.cl.config.OffsetResetNotification != nil {
+						con.cl.config.OffsetResetNotification(con.topic, p, offset)
+					}
+				}
+
+				if con.cl.config.LazyStartInterval > 0 && !con.cl.config.NoMessages {
+					if hwm, empty := con.isEmpty(p, offset); empty {
+						logf("consumer %q deferring consuming empty %q partition %d at offset %d", con.cl.group_name, con.topic, p, hwm)
+						// the partition has no consumer until consumer.run notices it has messages
+						part := &partition{
+							con:                con,
+							partition:          p,
+							next_commit_offset: hwm,
+							last_done:          -1,
+						}
+						if con.cl.config.CaughtUpNotification != nil {
+							// there's nothing to catch up on
+							part.caughtUp()
+						}
+						started <- part
+						return
+					}
+				}
 
 				logf("consumer %q consuming %q partition %d at offset %d", con.cl.group_name, con.topic, p, offset)
 
@@ -1895,9 +4319,15 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 					consumer:           consumer,
 					partition:          p,
 					next_commit_offset: offset,
+					fetch_offset:       offset,
+					last_done:          -1,
 				}
+				deduplicate(part)
 
 				if !con.cl.config.NoMessages {
+					if con.cl.config.CaughtUpNotification != nil {
+						part.startCatchup(offset)
+					}
 					go part.run()
 				}
 
@@ -1914,6 +4344,95 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 		}
 	}
 
+	// handle an assignment message
+	assignment := func(a *assignment) {
+		dbgf("consumer %q assignment(%v)", con.topic, a)
+		// see what has changed in the partition assignment of our topic
+		new_partitions := a.assignments[con.topic]
+		current := partitions
+		if len(settling) != 0 {
+			// the partitions waiting out the SettleDelay are assigned to us too
+			current = make(map[int32]*partition, len(partitions)+len(settling))
+			for p, part := range partitions {
+				current[p] = part
+			}
+			for _, p := range settling {
+				current[p] = nil
+			}
+		}
+		added, removed := difference(current, new_partitions)
+		dbgf("consumer %q added %v, removed %v", con.topic, added, removed)
+
+		// shutdown the partitions while we still belong to the previous generation, committing their offsets in one
+		// request along with the other consumers of the client
+		remove(removed, a.commits)
+
+		if notify := con.cl.config.Rebalance.Notify; notify != nil && (len(added) != 0 || len(removed) != 0) {
+			notify(con.topic, added, removed)
+		}
+
+		// a move of the group's coordinator to another broker doesn't in itself change anything. Only the partitions in
+		// added and removed are started and stopped. Those which remain assigned to us keep their partition consumers,
+		// and with them the Done state of the messages in flight, so nothing is redelivered.
+		if coor != nil && a.coordinator != nil && coor.ID() != a.coordinator.ID() {
+			logf("consumer %q of %q following coordinator from %s to %s; keeping %d partitions", con.cl.group_name, con.topic, coor.Addr(), a.coordinator.Addr(), len(new_partitions)-len(added))
+		}
+
+		// update the current generation and related info after committing the last offsets from the previous generation
+		generation_id = a.generation_id
+		coor = a.coordinator
+		member_id = a.member_id
+
+		sorted_partitions := make(int32Slice, len(new_partitions))
+		copy(sorted_partitions, new_partitions)
+		sort.Sort(sorted_partitions)
+		con.publishAssignment(Assignment{
+			Topic:      con.topic,
+			Generation: generation_id,
+			Partitions: sorted_partitions,
+			Added:      added,
+			Removed:    removed,
+		})
+
+		// the partitions still waiting out the SettleDelay which remain ours are started along with added. The others are
+		// dropped; they were never started, so there's nothing of theirs to stop
+		if len(settling) != 0 {
+			assigned := make(map[int32]bool, len(new_partitions))
+			for _, p := range new_partitions {
+				assigned[p] = true
+			}
+			kept := make([]int32, 0, len(settling)+len(added))
+			for _, p := range settling {
+				if assigned[p] {
+					kept = append(kept, p)
+				}
+			}
+			added = append(kept, added...)
+			settling, settling_assignment, settle_timer = nil, nil, nil
+		}
+
+		if len(added) == 0 {
+			// we're done early
+			return
+		}
+
+		// the sarama-cluster code pauses here so that other consumers have time to sync their offsets. Should we do the same?
+		// I've observed with kafka 0.9.0.1 that once the coordinator bumps the generation_id the client can't commit an offset with
+		// the old id. So unless the client lies and sends generation_id+1 when it commits there is nothing it can commit, and there
+		// is no point in waiting. However the previous owner might have published its offsets to the side-channel, and that takes
+		// time. So waiting is optional, and by default there is no waiting.
+		if delay := con.cl.config.Rebalance.SettleDelay; delay > 0 {
+			// the main loop starts them once the delay is over, and meanwhile keeps handling everything else
+			dbgf("consumer %q settling for %v", con.topic, delay)
+			settling = added
+			settling_assignment = a
+			settle_timer = time.After(delay)
+			return
+		}
+
+		start(a, added)
+	}
+
 	// restart consuming a partition at a new[er] offset
 	restart_partition := func(part *partition) {
 		// we kill the old and start a new partition consumer since there is no way to seek an existing sarama.PartitionConsumer in sarama's November 2016 API)
@@ -1927,6 +4446,9 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 		}
 		delete(partitions, p)
 		part.consumer.Close()
+		part.unthrottle()
+		forget(part)
+		con.inflight_bytes -= part.inflight_bytes
 
 		// then ask what the new starting offset should be
 		offset, err := con.cl.config.OffsetOutOfRange(con.topic, p, con.cl.client)
@@ -1950,70 +4472,495 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 			consumer:           consumer,
 			partition:          p,
 			next_commit_offset: offset,
+			fetch_offset:       offset,
+			last_done:          -1,
 		}
+		deduplicate(part)
 		go part.run()
 		partitions[p] = part
 	}
 
-	for {
-		select {
-		case msg := <-con.premessages:
-			msgf("premessage msg %q:%d/%d", msg)
-			// keep track of msg's offset so we can match it with Done, and deliver the msg
-			part := partitions[msg.Partition]
-			if part == nil {
-				// message from a stale consumer; ignore it
-				dbgf("no partition %d", msg.Partition)
-				continue
+	// restart a partition's consumer which has had too many errors. Unlike restart_partition the partition's state is kept,
+	// and consuming resumes where partition.run left off
+	refetch_partition := func(part *partition) {
+		p := part.partition
+		if pa, ok := partitions[p]; !ok || part != pa {
+			// this is an unknown partition, or it has been removed; ignore the request
+			return
+		}
+		part.consumer.Close()
+		part.consumer = nil
+
+		consumer, err := con.consumer.ConsumePartition(con.topic, p, part.fetch_offset)
+		if err != nil {
+			con.deliverError(fmt.Sprintf("sarama.ConsumePartition at offset %d", part.fetch_offset), p, err)
+			// give up the partition, and have the group rebalance. With luck the partition's next owner (possibly us) does better
+			logf("consumer %q giving up %q partition %d and rejoining the group", con.cl.group_name, con.topic, p)
+			remove([]int32{p}, nil)
+			con.cl.requestRejoin()
+			return
+		}
+
+		logf("consumer %q restarting consuming %q partition %d at offset %d after %d consecutive errors", con.cl.group_name, con.topic, p, part.fetch_offset, con.cl.config.PartitionErrorThreshold)
+		part.consumer = consumer
+		go part.run()
+	}
+
+	// handle a request from Rewind()
+	rewind_req := func(r rewind) {
+		dbgf("consumer %q rewind(%d)", con.topic, r.n)
+		// a Done() of a msg delivered before the rewind would be mistaken for one of the redelivered msgs, so insist there are none
+		for p, part := range partitions {
+			if part.outstanding() {
+				Err := con.makeError("Rewind", fmt.Errorf("partition %d has messages which are not yet Done()", p))
+				Err.Partition = p
+				r.reply <- Err
+				return
 			}
-			if part.next_commit_offset == sarama.OffsetNewest || part.next_commit_offset == sarama.OffsetOldest {
-				// we now know the starting offset. make as if we'd been asked to start there
-				part.next_commit_offset = msg.Offset
+		}
+		var Err *Error // the first partition which failed to rewind
+		failed := func(context string, p int32, err error) {
+			if Err == nil {
+				Err = con.makeError(context, err)
+				Err.Partition = p
 			}
-			delta := msg.Offset - part.next_commit_offset
-			if delta < 0 { // || delta > max-out-of-order  (TODO if needed, which so far hasn't been the case)
-				dbgf("stale message %q:%d/%d", msg.Topic, msg.Partition, msg.Offset)
-				// we can't take this message into account
+		}
+		for p, part := range partitions {
+			offset := part.compute_commit_offset()
+			if offset == sarama.OffsetNewest || offset == sarama.OffsetOldest {
+				// we haven't consumed anything yet, so there's nothing to rewind
 				continue
 			}
-			index := int(delta) >> lg2_offsets_per_bucket
-			for index >= len(part.buckets) {
-				// add a new bucket
-				part.buckets = append(part.buckets, bucket{})
+			offset -= r.n
+			if oldest, err := con.cl.client.GetOffset(con.topic, p, sarama.OffsetOldest); err != nil {
+				failed("looking up the oldest offset", p, err)
+				continue
+			} else if offset < oldest {
+				offset = oldest
 			}
-			part.buckets[index].read++
 
-			// and deliver the msg (or handle any of the other messages which can arrive)
-		deliver_loop:
-			for {
-				select {
-				case con.messages <- msg:
-					msgf("delivered msg %q:%d/%d", msg)
-					// success
-					break deliver_loop
+			var consumer sarama.PartitionConsumer // nil if the partition is being started lazily, and will start at next_commit_offset
+			if part.consumer != nil {
+				// sarama refuses to consume a partition twice, so the old partition consumer must be closed first. And
+				// the msgs it has already fetched must not be delivered
+				atomic.StoreInt32(&part.retired, 1)
+				part.consumer.Close()
+				part.consumer = nil
+				part.unthrottle() // so partition.run can see it is finished
+
+				var err error
+				consumer, err = con.consumer.ConsumePartition(con.topic, p, offset)
+				if err != nil {
+					failed(fmt.Sprintf("sarama.ConsumePartition at offset %d", offset), p, err)
+					// give up the partition, and have the group rebalance, like refetch_partition does
+					logf("consumer %q giving up %q partition %d and rejoining the group", con.cl.group_name, con.topic, p)
+					remove([]int32{p}, nil)
+					con.cl.requestRejoin()
+					continue
+				}
+			}
 
-				case msg2 := <-con.done:
-					done(msg2)
-				case a := <-con.assignments:
-					assignment(a)
-				case c := <-con.commit_reqs:
-					commit_req(c)
-				case p := <-con.restart_partitions:
-					restart_partition(p)
-				case <-con.closed:
+			logf("consumer %q rewinding %q partition %d to offset %d", con.cl.group_name, con.topic, p, offset)
+			// start afresh, keeping only the stats
+			np := &partition{
+				con:                con,
+				consumer:           consumer,
+				partition:          p,
+				next_commit_offset: offset,
+				fetch_offset:       offset,
+				last_done:          -1,
+				delivered:          atomic.LoadInt64(&part.delivered),
+				done:               part.done,
+			}
+			partitions[p] = np
+			if np.consumer != nil {
+				go np.run()
+			}
+		}
+		if Err != nil {
+			r.reply <- Err
+			return
+		}
+		r.reply <- nil
+	}
+
+	// handle a message sent to us via con.nacks
+	nack := func(msg *sarama.ConsumerMessage) {
+		msgf("consumer nack(%q:%d/%d)", msg)
+		part := partitions[msg.Partition]
+		if part == nil {
+			dbgf("no partition %d in topic %q", msg.Partition, con.topic)
+			return
+		}
+		// schedule the redelivery. the msg remains outstanding (not Done) in the meantime
+		time.AfterFunc(con.cl.config.NackDelay, func() {
+			select {
+			case con.redeliveries <- redelivery{part, msg}:
+			case <-con.closed:
+			}
+		})
+	}
+
+	// account for msg having been delivered
+	delivered := func(part *partition, msg *sarama.ConsumerMessage) {
+		atomic.AddInt64(&part.delivered, 1)
+		n := msgSize(msg)
+		part.inflight_bytes += n
+		con.inflight_bytes += n
+		if con.cl.config.StrictOrderDone {
+			part.undone = append(part.undone, msg.Offset)
+		}
+	}
+
+	// deliver msg to the caller (while handling any of the other messages which can arrive).
+	// returns false if the consumer closed before msg could be delivered
+	deliver := func(msg *sarama.ConsumerMessage) bool {
+		if con.cl.config.OnDeliver != nil {
+			con.cl.config.OnDeliver(msg)
+		}
+		con.reportAge(msg)
+		// while the client is paused we don't deliver, but we keep handling everything else
+		messages := con.messages
+		resumed := con.cl.paused()
+		if resumed != nil {
+			messages = nil
+		}
+		for {
+			select {
+			case messages <- msg:
+				msgf("delivered msg %q:%d/%d", msg)
+				// success
+				return true
+
+			case <-resumed:
+				// we might have been paused again in the meantime
+				resumed = con.cl.paused()
+				if resumed == nil {
+					messages = con.messages
+				}
+
+			case msg2 := <-con.done:
+				done(msg2)
+			case msg2 := <-con.nacks:
+				nack(msg2)
+			case a := <-con.assignments:
+				assignment(a)
+			case c := <-con.commit_reqs:
+				commit_req(c)
+			case c := <-con.explicit_commits:
+				explicit_commit(c)
+			case r := <-con.rewinds:
+				rewind_req(r)
+			case r := <-con.stats_reqs:
+				stats_req(r)
+			case p := <-con.restart_partitions:
+				restart_partition(p)
+			case p := <-con.refetch_partitions:
+				refetch_partition(p)
+			case <-con.closed:
+				return false
+			}
+		}
+	}
+
+	// outstanding returns true if any msg which has been delivered has not yet been Done()
+	outstanding := func() bool {
+		for _, part := range partitions {
+			if part.outstanding() {
+				return true
+			}
+		}
+		return false
+	}
+
+	// discard accounts for a delivered msg which Close() discarded, and so which will never be Done()
+	discard := func(msg *sarama.ConsumerMessage) {
+		part := partitions[msg.Partition]
+		if part == nil || msg.Offset < part.next_commit_offset {
+			// msg is from an earlier consumer of the partition
+			return
+		}
+		if con.in_order_done {
+			if msg.Offset >= atomic.LoadInt64(&part.delivered_offset) {
+				return
+			}
+		} else if msg.Offset >= part.read_offset {
+			return
+		}
+		if part.discarded == 0 || msg.Offset < part.discarded_offset {
+			part.discarded_offset = msg.Offset
+		}
+		part.discarded++
+	}
+
+	// linger waits up to Config.Close.GracePeriod for the outstanding msgs to be Done(), and then stops accepting Done()
+	linger := func() {
+		defer close(con.stopped)
+		grace := con.cl.config.Close.GracePeriod
+		if grace <= 0 || !outstanding() {
+			return
+		}
+		dbgf("consumer %q waiting up to %v for outstanding msgs", con.topic, grace)
+		timeout := time.NewTimer(grace)
+		defer timeout.Stop()
+		for outstanding() {
+			select {
+			case msg := <-con.done:
+				done(msg)
+			case msg := <-con.discards:
+				discard(msg)
+			case <-con.nacks:
+				// we're closing, so a Nack()ed msg won't be redelivered
+			case a := <-con.assignments:
+				// ignore them, we're shutting down
+				a.commits.skip()
+			case c := <-con.commit_reqs:
+				commit_req(c)
+			case c := <-con.explicit_commits:
+				explicit_commit(c)
+			case <-con.restart_partitions:
+				// ignore them too
+			case <-con.refetch_partitions:
+				// and these
+			case <-timeout.C:
+				logf("consumer %q of %q closing with msgs which are not Done() after %v", con.cl.group_name, con.topic, grace)
+				return
+			}
+		}
+	}
+	// this runs before the defer above which commits the final offsets
+	defer linger()
+
+	max_inflight_bytes := con.cl.config.MaxInFlightBytes
+
+	// when starting partitions lazily, periodically check the deferred partitions for messages
+	var lazy_timer <-chan time.Time
+	lazy_starts := make(chan lazy_start)
+	if interval := con.cl.config.LazyStartInterval; interval > 0 && !con.cl.config.NoMessages {
+		lazy_ticker := time.NewTicker(interval)
+		defer lazy_ticker.Stop()
+		lazy_timer = lazy_ticker.C
+	}
+
+	// when watching for stalled commits, periodically check every partition
+	var stall_timer <-chan time.Time
+	stall_timeout := con.cl.config.CommitStallTimeout
+	if stall_timeout > 0 {
+		stall_ticker := time.NewTicker(stall_timeout / 2)
+		defer stall_ticker.Stop()
+		stall_timer = stall_ticker.C
+	}
+
+	// when closing idle consumers, periodically check whether we are idle
+	var idle_timer <-chan time.Time
+	var idle_since time.Time // when we were first seen to have no partitions, or zero if we have some
+	idle_timeout := con.cl.config.IdleTimeout
+	if idle_timeout > 0 {
+		idle_ticker := time.NewTicker(idle_timeout / 2)
+		defer idle_ticker.Stop()
+		idle_timer = idle_ticker.C
+	}
+
+	// when ticking, periodically send the time to con.ticks
+	var tick_timer <-chan time.Time
+	if interval := con.cl.config.TickInterval; interval > 0 {
+		tick_ticker := time.NewTicker(interval)
+		defer tick_ticker.Stop()
+		tick_timer = tick_ticker.C
+	}
+
+	// accept keeps track of a msg's offset so we can match it with Done. it returns false if the msg shouldn't be delivered
+	accept := func(pm premessage) bool {
+		msg := pm.msg
+		msgf("premessage msg %q:%d/%d", msg)
+		part := partitions[msg.Partition]
+		if part == nil || part != pm.part {
+			// message from a stale consumer (of a partition which has since been removed, restarted or rewound); ignore it
+			dbgf("stale partition %d", msg.Partition)
+			return false
+		}
+		if part.next_commit_offset == sarama.OffsetNewest || part.next_commit_offset == sarama.OffsetOldest {
+			// we now know the starting offset. make as if we'd been asked to start there
+			part.next_commit_offset = msg.Offset
+		}
+		delta := msg.Offset - part.next_commit_offset
+		if delta < 0 { // || delta > max-out-of-order  (TODO if needed, which so far hasn't been the case)
+			dbgf("stale message %q:%d/%d", msg.Topic, msg.Partition, msg.Offset)
+			// we can't take this message into account
+			return false
+		}
+		from := part.read_offset
+		if from < part.next_commit_offset {
+			// this is the first msg
+			from = part.next_commit_offset
+		}
+		part.read_offset = msg.Offset + 1
+		if msg.Offset > from {
+			skipped(part, from, msg.Offset)
+			delta = msg.Offset - part.next_commit_offset // (skipped might have advanced next_commit_offset)
+		}
+		index := int(delta) >> lg2_offsets_per_bucket
+		for index >= len(part.buckets) {
+			// add a new bucket
+			part.buckets = append(part.buckets, bucket{})
+		}
+		part.buckets[index].read++
+		if max_buckets > 0 && len(part.buckets) > max_buckets && part.throttle() {
+			logf("consumer %q of %q partition %d has delivered up to offset %d, which is more than Config.MaxOutstandingSpan beyond the oldest msg which isn't Done(); pausing the partition", con.cl.group_name, con.topic, part.partition, msg.Offset)
+		}
+
+		if !con.filter(msg) {
+			// account for the msg as if it was delivered, and immediately Done() it
+			delivered(part, msg)
+			done(msg)
+			return false
+		}
+		return true
+	}
+
+	// unread undoes accept() of a msg which was never delivered, so it isn't outstanding
+	unread := func(pm premessage) {
+		// the buckets might have advanced since accept(), so recompute the msg's index
+		if pm.part == partitions[pm.msg.Partition] {
+			pm.part.buckets[int(pm.msg.Offset-pm.part.next_commit_offset)>>lg2_offsets_per_bucket].read--
+		}
+	}
+
+	// deliver_accepted delivers an accept()ed msg. it returns false if the consumer is closing
+	deliver_accepted := func(pm premessage) bool {
+		if !deliver(pm.msg) {
+			unread(pm)
+			return false
+		}
+		delivered(pm.part, pm.msg)
+		return true
+	}
+
+	delivery_order := con.cl.config.DeliveryOrder
+	var batch []premessage // reused batch of msgs gathered when delivery_order != DeliverAsArrived
+
+	for {
+		premessages := con.premessages
+		if max_inflight_bytes > 0 && con.inflight_bytes >= max_inflight_bytes {
+			// don't deliver any more msgs until some are Done()
+			premessages = nil
+		}
+		select {
+		case pm := <-premessages:
+			if !accept(pm) {
+				continue
+			}
+			if delivery_order == DeliverAsArrived {
+				if !deliver_accepted(pm) {
 					// the defered operations do the work
 					return
 				}
+				continue
+			}
+
+			// gather whatever other msgs have already arrived, and deliver the batch in the configured order
+			batch = append(batch[:0], pm)
+		gather:
+			for len(batch) < cap(con.premessages) {
+				select {
+				case pm := <-con.premessages:
+					if accept(pm) {
+						batch = append(batch, pm)
+					}
+				default:
+					break gather
+				}
+			}
+			ordered := orderMessages(delivery_order, batch)
+			for i, pm := range ordered {
+				if partitions[pm.msg.Partition] != pm.part {
+					// the partition was revoked, restarted or rewound while we were delivering the earlier msgs
+					continue
+				}
+				if !deliver_accepted(pm) {
+					// the rest of the batch was never delivered either
+					for _, pm := range ordered[i+1:] {
+						unread(pm)
+					}
+					return
+				}
+			}
+
+		case r := <-con.redeliveries:
+			// redeliver a Nack()ed msg, unless its partition has been revoked in the meantime
+			if partitions[r.msg.Partition] != r.part {
+				dbgf("dropping redelivery of msg %q:%d/%d from a revoked partition", r.msg.Topic, r.msg.Partition, r.msg.Offset)
+				continue
+			}
+			msgf("redelivering msg %q:%d/%d", r.msg)
+			if !deliver(r.msg) {
+				return
 			}
 
 		case msg := <-con.done:
 			done(msg)
+		case msg := <-con.nacks:
+			nack(msg)
 		case a := <-con.assignments:
 			assignment(a)
 		case c := <-con.commit_reqs:
 			commit_req(c)
+		case c := <-con.explicit_commits:
+			explicit_commit(c)
+		case r := <-con.rewinds:
+			rewind_req(r)
+		case r := <-con.stats_reqs:
+			stats_req(r)
 		case p := <-con.restart_partitions:
 			restart_partition(p)
+		case p := <-con.refetch_partitions:
+			refetch_partition(p)
+		case <-lazy_timer:
+			// the lookups are made concurrently, so we keep answering client.run in the meantime
+			for _, part := range partitions {
+				if part.consumer == nil && !part.starting {
+					part.starting = true
+					go part.startIfNotEmpty(part.next_commit_offset, lazy_starts)
+				}
+			}
+		case <-settle_timer:
+			added, a := settling, settling_assignment
+			settling, settling_assignment, settle_timer = nil, nil, nil
+			start(a, added)
+		case s := <-lazy_starts:
+			s.part.starting = false
+			if s.consumer == nil {
+				continue
+			}
+			if partitions[s.part.partition] != s.part || s.part.next_commit_offset != s.offset {
+				// the partition was removed or rewound in the meantime
+				s.consumer.Close()
+				continue
+			}
+			logf("consumer %q consuming %q partition %d at offset %d", con.cl.group_name, con.topic, s.part.partition, s.offset)
+			s.part.consumer = s.consumer
+			s.part.fetch_offset = s.offset
+			go s.part.run()
+		case now := <-stall_timer:
+			for _, part := range partitions {
+				part.checkStalled(now, stall_timeout)
+			}
+		case now := <-tick_timer:
+			select {
+			case con.ticks <- now:
+			default:
+				// the previous tick hasn't been read; drop this one
+			}
+		case now := <-idle_timer:
+			if len(partitions) != 0 || coor == nil { // (coor is nil until the first assignment arrives)
+				idle_since = time.Time{}
+			} else if idle_since.IsZero() {
+				idle_since = now
+			} else if now.Sub(idle_since) >= idle_timeout {
+				logf("consumer %q of %q closing after being idle for %v", con.cl.group_name, con.topic, now.Sub(idle_since))
+				con.AsyncClose()
+				// and the next pass through the loop sees con.closed
+			}
 		case <-con.closed:
 			// the defered operations do the work
 			return
@@ -2021,13 +4968,136 @@ func (con *consumer) run(wg *sync.WaitGroup) {
 	}
 }
 
+// Nack schedules msg to be redelivered after Config.NackDelay
+func (con *consumer) Nack(msg *sarama.ConsumerMessage) {
+	msgf("Nack(%q:%d/%d)", msg)
+	select {
+	case con.nacks <- msg:
+		// great, msg delivered
+	case <-con.closed:
+		// consumer has closed
+	}
+}
+
+// Rewind restarts each partition n messages before its committable offset
+func (con *consumer) Rewind(n int64) error {
+	if con.cl.config.NoMessages {
+		return con.makeError("Rewind", fmt.Errorf("Rewind isn't supported with Config.NoMessages"))
+	}
+	reply := make(chan error, 1)
+	select {
+	case con.rewinds <- rewind{n, reply}:
+		return <-reply
+	case <-con.closed:
+		return con.makeError("Rewind", fmt.Errorf("consumer of topic %q is closed", con.topic))
+	}
+}
+
+// Commit commits the offsets, as long as all the partitions are assigned to us
+func (con *consumer) Commit(offsets map[int32]int64) error {
+	reply := make(chan error, 1)
+	select {
+	case con.explicit_commits <- explicit_commit{offsets, reply}:
+		return <-reply
+	case <-con.closed:
+		return con.makeError("Commit", fmt.Errorf("consumer of topic %q is closed", con.topic))
+	}
+}
+
+func (con *consumer) Pause(partition int32) {
+	dbgf("Pause consumer of topic %q partition %d", con.topic, partition)
+	con.pause_lock.Lock()
+	if con.paused == nil {
+		con.paused = make(map[int32]chan struct{})
+	}
+	if _, ok := con.paused[partition]; !ok {
+		con.paused[partition] = make(chan struct{})
+	}
+	con.pause_lock.Unlock()
+}
+
+func (con *consumer) Resume(partition int32) {
+	dbgf("Resume consumer of topic %q partition %d", con.topic, partition)
+	con.pause_lock.Lock()
+	if resumed, ok := con.paused[partition]; ok {
+		close(resumed)
+		delete(con.paused, partition)
+	}
+	con.pause_lock.Unlock()
+}
+
+// partitionPaused returns nil if partition is not paused, or a channel which is closed when the partition is resumed
+func (con *consumer) partitionPaused(partition int32) <-chan struct{} {
+	con.pause_lock.Lock()
+	defer con.pause_lock.Unlock()
+	return con.paused[partition] // (a nil map returns nil)
+}
+
+// waitResumed blocks while the client, or partition, is paused. It returns false if the consumer closed while waiting.
+func (con *consumer) waitResumed(partition int32) bool {
+	for {
+		resumed := con.cl.paused()
+		if resumed == nil {
+			resumed = con.partitionPaused(partition)
+			if resumed == nil {
+				return true
+			}
+		}
+		select {
+		case <-resumed:
+			// we might have been paused again in the meantime, or the partition might still be paused
+		case <-con.closed:
+			return false
+		}
+	}
+}
+
+// filter returns true if msg should be delivered, according to Config.Filter
+func (con *consumer) filter(msg *sarama.ConsumerMessage) (deliver bool) {
+	f := con.cl.config.Filter
+	if f == nil {
+		return true
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			con.deliverError("Filter", msg.Partition, fmt.Errorf("Filter panicked on offset %d: %v", msg.Offset, r))
+			deliver = true
+		}
+	}()
+	return f(msg)
+}
+
+// pace waits until *next, if the consumer has a rate limit, and then advances *next by the interval between msgs.
+// A *next in the past is first brought up to the present, so time spent paused or idle isn't made up in a burst.
+// It returns false if the consumer closed while waiting.
+func (con *consumer) pace(next *time.Time) bool {
+	interval := time.Duration(atomic.LoadInt64(&con.rate_interval))
+	if interval == 0 {
+		return true
+	}
+	now := time.Now()
+	if wait := next.Sub(now); wait > 0 {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-con.closed:
+			t.Stop()
+			return false
+		}
+	} else {
+		*next = now
+	}
+	*next = next.Add(interval)
+	return true
+}
+
 func (con *consumer) Done(msg *sarama.ConsumerMessage) {
 	// send it back to consumer.run to be processed synchronously
 	msgf("Done(%q:%d/%d)", msg)
 	select {
 	case con.done <- msg:
 		// great, msg delivered
-	case <-con.closed:
+	case <-con.stopped:
 		// consumer has closed
 	}
 }
@@ -2046,6 +5116,35 @@ type partition struct {
 	// These are used only if con.in_order_done is disabled.
 	buckets            []bucket
 	bucket_0_highwater uint8 // highwater mark of commits from buckets[0]
+	read_offset        int64 // the offset following the last msg consumer.run received from partition.run, or 0 if none. Used only if !con.in_order_done
+
+	throttle_lock sync.Mutex
+	throttled     chan struct{} // non-nil while partition.run must wait before delivering msgs because the buckets are at Config.MaxOutstandingSpan. Closed when the wait is over. Protected by throttle_lock
+
+	fetch_offset int64 // the offset of the next msg expected from consumer. Set before partition.run is started, and owned by partition.run while it runs
+
+	catchup_offset int64 // the high-water mark of the partition when we started consuming it, or 0 if we aren't waiting to catch up to it. Used only by partition.run
+
+	delivered_offset int64 // Offset+1 of the last msg partition.run delivered, or 0 if none. Accessed atomically. Used only if con.in_order_done
+	received_offset  int64 // Offset+1 of the last msg partition.run received from sarama, or 0 if none. Accessed atomically. Used only if con.in_order_done
+	retired          int32 // set to 1 by consumer.run when the partition has been rewound, after which partition.run delivers nothing more. Accessed atomically
+	delivered        int64 // # of msgs delivered. Accessed atomically, since partition.run delivers directly when con.in_order_done
+	done             int64 // # of calls to Done()
+
+	inflight_bytes int64 // size of the delivered msgs of this partition which are not yet Done(). Used only if !con.in_order_done
+
+	last_done   int64   // offset of the last msg passed to Done(), or -1 if none. Used only if Config.StrictOrderDone
+	undone      []int64 // offsets of the delivered msgs which aren't yet Done(), in order. Used only if Config.StrictOrderDone and !con.in_order_done
+	dedup_below int64   // msgs with offsets below this were already Done() earlier in this process, and partition.run skips them (when Config.Deduplicate)
+
+	advanced_offset int64     // the committable offset as of the commit stall watchdog's last check. Used only if Config.CommitStallTimeout
+	advanced_at     time.Time // when the watchdog first saw advanced_offset, or zero if it hasn't checked yet
+	stalled         bool      // true once the watchdog has reported advanced_offset as stalled
+
+	starting bool // true while startIfNotEmpty checks whether the lazily started partition has msgs. Used only by consumer.run
+
+	discarded        int   // # of delivered msgs which Close() discarded, and which will never be Done(). Used only by consumer.run
+	discarded_offset int64 // the lowest offset of those msgs
 }
 
 // a bucket of message offsets. It contains counts of the msgs with offsets in the range base to base+offsets_per_bucket
@@ -2054,6 +5153,24 @@ type bucket struct {
 	done uint8 // count of how many messages are Done()
 }
 
+// outstanding returns true if msgs of the partition have been delivered and not yet Done() (not counting the msgs
+// Close() discarded, which never will be). only consumer.run may call this
+func (part *partition) outstanding() bool {
+	if part.con.in_order_done {
+		end := atomic.LoadInt64(&part.delivered_offset)
+		if part.discarded != 0 && part.discarded_offset < end {
+			// nothing at or beyond the discarded msg can be Done()
+			end = part.discarded_offset
+		}
+		return end > part.next_commit_offset
+	}
+	n := 0
+	for _, b := range part.buckets {
+		n += int(b.read - b.done)
+	}
+	return n > part.discarded
+}
+
 // log base 2 of the number of offsets in a bucket
 const lg2_offsets_per_bucket = 7 // using 128 gets rid of the edge case of 0 == 256, which I fear would be a source of bugs
 const offsets_per_bucket = 1 << lg2_offsets_per_bucket
@@ -2078,6 +5195,198 @@ func (part *partition) compute_commit_offset() int64 {
 	return offset
 }
 
+// isEmpty looks up whether starting to consume the partition at offset would find no messages, and returns the equivalent numeric offset
+func (con *consumer) isEmpty(partition int32, offset int64) (int64, bool) {
+	hwm, err := con.cl.client.GetOffset(con.topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		// we can't tell, so let's not defer the partition
+		return offset, false
+	}
+	switch offset {
+	case sarama.OffsetNewest:
+		return hwm, true
+	case sarama.OffsetOldest:
+		oldest, err := con.cl.client.GetOffset(con.topic, partition, sarama.OffsetOldest)
+		return hwm, err == nil && oldest == hwm
+	default:
+		return hwm, offset == hwm
+	}
+}
+
+// startIfNotEmpty starts a partition consumer of a lazily started partition at offset, if messages have arrived, and
+// sends the outcome to consumer.run over starts. It runs in its own goroutine
+func (part *partition) startIfNotEmpty(offset int64, starts chan<- lazy_start) {
+	con := part.con
+	s := lazy_start{part: part, offset: offset}
+	if hwm, err := con.cl.client.GetOffset(con.topic, part.partition, sarama.OffsetNewest); err != nil {
+		con.deliverError("looking up the high-water mark", part.partition, err)
+	} else if hwm > offset {
+		s.consumer, err = con.consumer.ConsumePartition(con.topic, part.partition, offset)
+		if err != nil {
+			con.deliverError(fmt.Sprintf("sarama.ConsumePartition at offset %d", offset), part.partition, err)
+		}
+	} // else still empty
+
+	select {
+	case starts <- s:
+	case <-con.closed:
+		if s.consumer != nil {
+			s.consumer.Close()
+		}
+	}
+}
+
+// checkStalled reports the partition if its committable offset hasn't advanced for longer than timeout while msgs are outstanding.
+// Only consumer.run may call this
+func (part *partition) checkStalled(now time.Time, timeout time.Duration) {
+	offset := part.compute_commit_offset()
+	if offset != part.advanced_offset || part.advanced_at.IsZero() {
+		part.advanced_offset = offset
+		part.advanced_at = now
+		part.stalled = false
+		return
+	}
+	if part.stalled || part.stats().Outstanding == 0 {
+		// already reported, or there is nothing to commit anyway
+		return
+	}
+	stalled := now.Sub(part.advanced_at)
+	if stalled <= timeout {
+		return
+	}
+	part.stalled = true
+	con := part.con
+	con.deliverError("commit watchdog", part.partition, fmt.Errorf("committable offset %d of partition %d has not advanced for %v while msgs are outstanding", offset, part.partition, stalled))
+	if con.cl.config.CommitStalledNotification != nil {
+		con.cl.config.CommitStalledNotification(con.topic, part.partition, offset, stalled)
+	}
+}
+
+// the size of a msg, for the purposes of Config.MaxInFlightBytes
+func msgSize(msg *sarama.ConsumerMessage) int64 {
+	return int64(len(msg.Key) + len(msg.Value))
+}
+
+// reportAge calls Config.OnMessageAge, if any, with the age of msg. Messages without a timestamp are skipped
+func (con *consumer) reportAge(msg *sarama.ConsumerMessage) {
+	if con.cl.config.OnMessageAge == nil || msg.Timestamp.Unix() <= 0 {
+		// messages produced without a timestamp have a zero Timestamp (or, depending on the record format, -1 ms)
+		return
+	}
+	con.cl.config.OnMessageAge(msg.Topic, msg.Partition, time.Since(msg.Timestamp))
+}
+
+// retriableCommitError returns true if kerr, an error committing an offset, might be transient
+func retriableCommitError(kerr sarama.KError) bool {
+	switch kerr {
+	case sarama.ErrNotCoordinatorForConsumer, sarama.ErrConsumerCoordinatorNotAvailable, sarama.ErrOffsetsLoadInProgress, sarama.ErrRequestTimedOut:
+		return true
+	}
+	return false
+}
+
+// checkDoneOrder delivers an error if offset isn't the next one to be Done() in strict order
+func (part *partition) checkDoneOrder(offset int64) {
+	con := part.con
+	if con.in_order_done {
+		if offset <= part.last_done {
+			con.deliverError("Done()", part.partition, fmt.Errorf("out of order Done() of offset %d after offset %d", offset, part.last_done))
+		}
+	} else {
+		i := 0
+		for i < len(part.undone) && part.undone[i] != offset {
+			i++
+		}
+		switch {
+		case i == len(part.undone):
+			con.deliverError("Done()", part.partition, fmt.Errorf("out of order Done() of offset %d, which is not outstanding", offset))
+		case i != 0:
+			con.deliverError("Done()", part.partition, fmt.Errorf("out of order Done() of offset %d before offset %d", offset, part.undone[0]))
+			fallthrough
+		default:
+			// forget offset, so the order of the remaining offsets can still be checked
+			part.undone = append(part.undone[:i], part.undone[i+1:]...)
+		}
+	}
+	if offset > part.last_done {
+		part.last_done = offset
+	}
+}
+
+// throttle makes partition.run wait before delivering any more msgs. It returns true if the partition wasn't already
+// throttled. only consumer.run may call this
+func (part *partition) throttle() bool {
+	part.throttle_lock.Lock()
+	defer part.throttle_lock.Unlock()
+	if part.throttled != nil {
+		return false
+	}
+	part.throttled = make(chan struct{})
+	return true
+}
+
+// unthrottle releases partition.run from throttle(). It returns true if the partition was throttled. only consumer.run may call this
+func (part *partition) unthrottle() bool {
+	part.throttle_lock.Lock()
+	defer part.throttle_lock.Unlock()
+	if part.throttled == nil {
+		return false
+	}
+	close(part.throttled)
+	part.throttled = nil
+	return true
+}
+
+// waitUnthrottled waits while the partition is throttled. It returns false if the consumer closed in the meantime
+func (part *partition) waitUnthrottled() bool {
+	part.throttle_lock.Lock()
+	throttled := part.throttled
+	part.throttle_lock.Unlock()
+	if throttled != nil {
+		select {
+		case <-throttled:
+		case <-part.con.closed:
+			return false
+		}
+	}
+	return true
+}
+
+// startCatchup records the partition's high-water mark, so that partition.run can tell when consuming from offset has caught up to it
+func (part *partition) startCatchup(offset int64) {
+	con := part.con
+	hwm, err := con.cl.client.GetOffset(con.topic, part.partition, sarama.OffsetNewest)
+	if err != nil {
+		con.deliverError("looking up the high-water mark", part.partition, err)
+		// without the high-water mark we can't know when we've caught up. The least bad choice is to say we already have
+		part.caughtUp()
+		return
+	}
+	if offset == sarama.OffsetOldest {
+		offset, err = con.cl.client.GetOffset(con.topic, part.partition, sarama.OffsetOldest)
+		if err != nil {
+			con.deliverError("looking up the oldest offset", part.partition, err)
+			part.caughtUp()
+			return
+		}
+	}
+	if offset == sarama.OffsetNewest || offset >= hwm {
+		// there is nothing to catch up on
+		part.caughtUp()
+		return
+	}
+	dbgf("consumer %q of %q partition %d catching up from offset %d to %d", con.cl.group_name, con.topic, part.partition, offset, hwm)
+	part.catchup_offset = hwm
+}
+
+// caughtUp notes that the partition has caught up with the high-water mark it had when we started consuming it
+func (part *partition) caughtUp() {
+	con := part.con
+	part.catchup_offset = 0
+	logf("consumer %q of %q partition %d caught up", con.cl.group_name, con.topic, part.partition)
+	con.cl.config.CaughtUpNotification(con.topic, part.partition)
+}
+
 // run consumes from the partition and delivers it to the consumer
 func (part *partition) run() {
 	con := part.con
@@ -2085,20 +5394,103 @@ func (part *partition) run() {
 	msgs := part.consumer.Messages()
 	errors := part.consumer.Errors()
 	sink := con.messages
+	var presink chan<- premessage
+	on_deliver := con.cl.config.OnDeliver
+	report_age := true
 	if !con.in_order_done {
 		// messages have to go throught a pre-delivery step
-		sink = con.premessages
+		sink = nil
+		presink = con.premessages
+		on_deliver = nil   // consumer.run will call it
+		report_age = false // and this
+	}
+	throttling := presink != nil && con.cl.config.MaxOutstandingSpan > 0 // consumer.run can throttle us
+	threshold := con.cl.config.PartitionErrorThreshold
+	num_errors := 0     // # of consecutive errors
+	var paced time.Time // earliest time at which the next msg can be delivered, if there is a rate limit
+
+	// the last offsets before the high-water mark we are catching up to can be transaction markers (or aborted msgs),
+	// which sarama never delivers. So once sarama has found nothing more to deliver for a couple of fetches, and its
+	// latest fetch had reached that high-water mark, we've caught up all the same
+	catchup_idle_time := 2 * con.cl.client.Config().Consumer.MaxWaitTime
+	var catchup_timer *time.Timer
+	var catchup_idle <-chan time.Time // catchup_timer's channel while the timer is running, or nil
+	catchup_wait := func() {
+		if part.catchup_offset == 0 {
+			return
+		}
+		if catchup_timer == nil {
+			catchup_timer = time.NewTimer(catchup_idle_time)
+		} else {
+			if !catchup_timer.Stop() && catchup_idle != nil {
+				<-catchup_timer.C
+			}
+			catchup_timer.Reset(catchup_idle_time)
+		}
+		catchup_idle = catchup_timer.C
 	}
+	defer func() {
+		if catchup_timer != nil {
+			catchup_timer.Stop()
+		}
+	}()
+	catchup_wait()
+
 	for {
 		select {
 		case msg, ok := <-msgs:
 			if ok {
+				catchup_wait()
 				msgf("got msg %q:%d/%d", msg)
+				part.fetch_offset = msg.Offset + 1
+				atomic.StoreInt64(&part.received_offset, msg.Offset+1)
+				num_errors = 0
+				if len(msgs) == 0 {
+					// sarama has nothing more buffered for this partition at the moment
+					con.noteLastInFetch(msg)
+				}
+				if msg.Offset < part.dedup_below && con.in_order_done {
+					msgf("skipping already Done() msg %q:%d/%d", msg)
+					continue
+				}
+				if con.in_order_done && !con.filter(msg) {
+					// (when !in_order_done consumer.run does the filtering)
+					msgf("filtered msg %q:%d/%d", msg)
+					atomic.StoreInt64(&part.delivered_offset, msg.Offset+1)
+					atomic.AddInt64(&part.delivered, 1)
+					con.Done(msg)
+					continue
+				}
+				if !con.waitResumed(part.partition) {
+					return
+				}
+				if throttling && !part.waitUnthrottled() {
+					return
+				}
+				if !con.pace(&paced) {
+					return
+				}
+				if on_deliver != nil {
+					on_deliver(msg)
+				}
+				if report_age {
+					con.reportAge(msg)
+				}
+				if atomic.LoadInt32(&part.retired) != 0 {
+					// the partition has been rewound, and its msgs are delivered by its new partition.run
+					return
+				}
 				select {
-				case sink <- msg:
+				case sink <- msg: // (when in_order_done)
+					atomic.StoreInt64(&part.delivered_offset, msg.Offset+1)
+					atomic.AddInt64(&part.delivered, 1)
+				case presink <- premessage{part, msg}: // (when !in_order_done)
 				case <-con.closed:
 					return
 				}
+				if part.catchup_offset != 0 && msg.Offset+1 >= part.catchup_offset {
+					part.caughtUp()
+				}
 			} else {
 				dbgf("draining topic %q partition %d errors", con.topic, part.partition)
 				// deliver any remaining errors, and exit
@@ -2107,8 +5499,22 @@ func (part *partition) run() {
 				}
 				return
 			}
+		case <-catchup_idle:
+			catchup_idle = nil
+			if part.catchup_offset == 0 {
+				// we caught up in the meantime
+				continue
+			}
+			if len(msgs) != 0 || part.consumer.HighWaterMarkOffset() < part.catchup_offset {
+				// sarama hasn't caught up yet
+				catchup_wait()
+				continue
+			}
+			dbgf("consumer %q of %q partition %d found no msgs before offset %d", con.cl.group_name, con.topic, part.partition, part.catchup_offset)
+			part.caughtUp()
 		case sarama_err, ok := <-errors:
 			if ok {
+				catchup_wait() // an error isn't a sign that there's nothing more to fetch
 				// pick out ErrOffsetOutOfRange errors. These happen if the consumer offset falls off the tail of the kafka log.
 				// this easily happens in two cases: when the consumer is too slow, or when the consumer has been stopped for too long.
 				// This error cannot be fixed without seeking to a valid offset. However we can't assume that OffsetNewest is the right
@@ -2122,14 +5528,60 @@ func (part *partition) run() {
 					}
 					// should we keep reading from the partition? it's unlikely to produce much
 				}
+				// (there's no need to pick out ErrNotLeaderForPartition. sarama's partition consumer handles it itself, by
+				// refreshing the metadata and following the partition to its new leader, and never returns it to us)
 				// and always deliver the error
 				con.cl.deliverError("", part.makeConsumerError(sarama_err))
+
+				if sarama_err.Err != sarama.ErrOffsetOutOfRange {
+					num_errors++
+					if threshold > 0 && num_errors >= threshold {
+						// this partition consumer seems stuck. ask consumer.run to replace it, and exit
+						logf("consumer %q of %q partition %d received %d consecutive errors and will be restarted", con.cl.group_name, con.topic, part.partition, num_errors)
+						select {
+						case con.refetch_partitions <- part:
+						case <-con.closed:
+						}
+						return
+					}
+				}
 			} else {
 				// finish off any remaining messages, and exit
 				dbgf("draining topic %q partition %d msgs", con.topic, part.partition)
 				for msg := range msgs {
+					atomic.StoreInt64(&part.received_offset, msg.Offset+1)
+					if msg.Offset < part.dedup_below && con.in_order_done {
+						continue
+					}
+					if con.in_order_done && !con.filter(msg) {
+						atomic.StoreInt64(&part.delivered_offset, msg.Offset+1)
+						atomic.AddInt64(&part.delivered, 1)
+						con.Done(msg)
+						continue
+					}
+					if !con.waitResumed(part.partition) {
+						return
+					}
+					if throttling && !part.waitUnthrottled() {
+						return
+					}
+					if !con.pace(&paced) {
+						return
+					}
+					if on_deliver != nil {
+						on_deliver(msg)
+					}
+					if report_age {
+						con.reportAge(msg)
+					}
+					if atomic.LoadInt32(&part.retired) != 0 {
+						return
+					}
 					select {
 					case sink <- msg:
+						atomic.StoreInt64(&part.delivered_offset, msg.Offset+1)
+						atomic.AddInt64(&part.delivered, 1)
+					case presink <- premessage{part, msg}:
 					case <-con.closed:
 						return
 					}
@@ -2179,3 +5631,49 @@ type int32Slice []int32
 func (p int32Slice) Len() int           { return len(p) }
 func (p int32Slice) Less(i, j int) bool { return p[i] < p[j] }
 func (p int32Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// orderMessages returns a batch of accepted msgs (in the order they arrived) in the order in which they should be
+// delivered. The msgs of each partition stay in the order they arrived, which is offset order.
+func orderMessages(order DeliveryOrder, batch []premessage) []premessage {
+	if order == DeliverAsArrived || len(batch) <= 1 {
+		return batch
+	}
+
+	// split the batch into a queue per partition, ordered by the arrival of each partition's first msg
+	var queues [][]premessage
+	index := make(map[*partition]int)
+	for _, pm := range batch {
+		i, ok := index[pm.part]
+		if !ok {
+			i = len(queues)
+			index[pm.part] = i
+			queues = append(queues, nil)
+		}
+		queues[i] = append(queues[i], pm)
+	}
+
+	ordered := make([]premessage, 0, len(batch))
+	for len(ordered) < len(batch) {
+		switch order {
+		case DeliverRoundRobin:
+			// one msg from each partition in turn
+			for i, q := range queues {
+				if len(q) != 0 {
+					ordered = append(ordered, q[0])
+					queues[i] = q[1:]
+				}
+			}
+		default: // DeliverByTimestamp
+			// the oldest msg at the head of any queue
+			oldest := -1
+			for i, q := range queues {
+				if len(q) != 0 && (oldest < 0 || q[0].msg.Timestamp.Before(queues[oldest][0].msg.Timestamp)) {
+					oldest = i
+				}
+			}
+			ordered = append(ordered, queues[oldest][0])
+			queues[oldest] = queues[oldest][1:]
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,97 @@
+/*
+  A simple kafka consumer-group client
+
+  Copyright 2016 MistSys
+*/
+
+package partitiontest_test
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	consumer "github.com/mistsys/sarama-consumer"
+	"github.com/mistsys/sarama-consumer/composite"
+	"github.com/mistsys/sarama-consumer/consistenthash"
+	"github.com/mistsys/sarama-consumer/partitiontest"
+	"github.com/mistsys/sarama-consumer/roundrobin"
+	"github.com/mistsys/sarama-consumer/stable"
+	"github.com/mistsys/sarama-consumer/zone"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/ with the current assignments")
+
+// the partitioners whose assignments are locked down by golden files
+// (sticky isn't one of them, since sarama.BalanceStrategySticky's assignments depend on map iteration order)
+var partitioners = map[string]consumer.Partitioner{
+	"roundrobin":       roundrobin.RoundRobin,
+	"cappedroundrobin": roundrobin.NewCapped(4, nil),
+	"consistenthash":   consistenthash.ConsistentHash,
+	"zonepreferring":   zone.New("", nil),
+	"stable":           stable.New(false),
+	"composite":        composite.New(map[string]composite.Partitioner{"topic1": roundrobin.RoundRobin}, consistenthash.ConsistentHash),
+}
+
+// run the partitioner over a matrix of member and partition counts, and format the results
+func matrix(t *testing.T, p consumer.Partitioner) string {
+	var b strings.Builder
+	for _, num_members := range []int{1, 2, 3, 5} {
+		for _, num_partitions := range []int{1, 4, 8, 13} {
+			members := make(map[string][]string, num_members)
+			for i := 0; i < num_members; i++ {
+				// every member consumes topic1, and every other one topic2 too
+				topics := []string{"topic1"}
+				if i%2 == 0 {
+					topics = append(topics, "topic2")
+				}
+				members[fmt.Sprintf("member%d", i)] = topics
+			}
+			partitions := map[string][]int32{
+				"topic1": make([]int32, num_partitions),
+				"topic2": make([]int32, num_partitions/2+1),
+			}
+			for _, parts := range partitions {
+				for i := range parts {
+					parts[i] = int32(i)
+				}
+			}
+
+			assignments, err := partitiontest.Partition(p, members, partitions)
+			if err != nil {
+				t.Fatalf("%d members, %d partitions: %v", num_members, num_partitions, err)
+			}
+			fmt.Fprintf(&b, "# %d members, %d partitions\n%s", num_members, num_partitions, partitiontest.Format(assignments))
+		}
+	}
+	return b.String()
+}
+
+func TestGolden(t *testing.T) {
+	for name, p := range partitioners {
+		t.Run(name, func(t *testing.T) {
+			act := matrix(t, p)
+			path := filepath.Join("testdata", name+".golden")
+			if *update {
+				if err := ioutil.WriteFile(path, []byte(act), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			exp, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if act != string(exp) {
+				t.Errorf("assignments differ from %s (rerun with -update if the change is intended):\n%s", path, act)
+			}
+			// and the assignments must be deterministic
+			if again := matrix(t, p); again != act {
+				t.Errorf("assignments aren't deterministic:\n%s", again)
+			}
+		})
+	}
+}
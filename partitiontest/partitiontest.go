@@ -0,0 +1,150 @@
+/*
+  Helpers for testing Partitioners in isolation
+
+  Partition runs a Partitioner over a synthetic consumer group, going
+  through PrepareJoin, Partition and ParseSync just as the members of
+  a real group would, but without any kafka brokers.
+
+  Copyright 2016 MistSys
+*/
+
+package partitiontest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	consumer "github.com/mistsys/sarama-consumer"
+)
+
+// Partition has each member (a map of member id -> topics the member consumes) join a synthetic group using p, has
+// the first member (in sorted order) partition the group as its leader, and returns the assignment each member parsed
+// from its SyncGroupResponse (a map of member id -> topic -> partitions). partitions is a map of topic -> partitions of
+// the topic. Since the partitioners treat all the members the same, all the members use p.
+func Partition(p consumer.Partitioner, members map[string][]string, partitions map[string][]int32) (map[string]map[string][]int32, error) {
+	ps := make(map[string]consumer.Partitioner, len(members))
+	for id := range members {
+		ps[id] = p
+	}
+	return PartitionEach(ps, members, partitions)
+}
+
+// PartitionEach is Partition with each member using its own partitioner (a map of member id -> partitioner), for
+// testing what happens when the members of a group are configured differently. The leader's partitioner names the
+// group's protocol, and every member must propose it.
+func PartitionEach(ps map[string]consumer.Partitioner, members map[string][]string, partitions map[string][]int32) (map[string]map[string][]int32, error) {
+	return Rebalance(ps, members, partitions, nil)
+}
+
+// Rebalance is PartitionEach with each member joining with its current assignment (a map of member id -> topic ->
+// partitions, typically the result of a previous Partition), for testing how a partitioner moves partitions when the
+// group changes. Members missing from current join with no partitions.
+func Rebalance(ps map[string]consumer.Partitioner, members map[string][]string, partitions map[string][]int32, current map[string]map[string][]int32) (map[string]map[string][]int32, error) {
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	p := ps[ids[0]] // the leader's partitioner
+	jresp := &sarama.JoinGroupResponse{
+		GenerationId:  1,
+		GroupProtocol: p.Name(),
+		LeaderId:      ids[0],
+		MemberId:      ids[0],
+		Members:       make(map[string][]byte, len(ids)),
+	}
+	for _, id := range ids {
+		jreq := &sarama.JoinGroupRequest{GroupId: "group", MemberId: id, ProtocolType: "consumer"}
+		ps[id].PrepareJoin(jreq, members[id], current[id])
+		for _, gp := range jreq.OrderedGroupProtocols {
+			if gp.Name == p.Name() {
+				jresp.Members[id] = gp.Metadata
+			}
+		}
+		if _, ok := jresp.Members[id]; !ok {
+			return nil, fmt.Errorf("member %q didn't propose protocol %q", id, p.Name())
+		}
+	}
+
+	sreq := &sarama.SyncGroupRequest{GroupId: "group", GenerationId: 1, MemberId: ids[0]}
+	if err := p.Partition(sreq, jresp, &client{partitions: partitions}); err != nil {
+		return nil, err
+	}
+
+	assignments := make(map[string]map[string][]int32, len(ids))
+	for _, id := range ids {
+		a, err := ps[id].ParseSync(&sarama.SyncGroupResponse{MemberAssignment: sreq.GroupAssignments[id]})
+		if err != nil {
+			return nil, fmt.Errorf("member %q: %v", id, err)
+		}
+		assignments[id] = a
+	}
+	return assignments, nil
+}
+
+// Format formats assignments (as returned by Partition) in a stable, readable form, one member per line
+func Format(assignments map[string]map[string][]int32) string {
+	ids := make([]string, 0, len(assignments))
+	for id := range assignments {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var b strings.Builder
+	for _, id := range ids {
+		topics := make([]string, 0, len(assignments[id]))
+		for topic := range assignments[id] {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		fmt.Fprintf(&b, "%s:", id)
+		for _, topic := range topics {
+			parts := append([]int32(nil), assignments[id][topic]...)
+			sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+			fmt.Fprintf(&b, " %s%v", topic, parts)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// client is a sarama.Client which knows the partitions of the topics, and nothing else.
+// the partitions have no leader. the methods the partitioners don't use panic
+type client struct {
+	sarama.Client
+	partitions map[string][]int32
+}
+
+func (c *client) Config() *sarama.Config { return sarama.NewConfig() }
+
+func (c *client) Topics() ([]string, error) {
+	var topics = make([]string, 0, len(c.partitions))
+	for t := range c.partitions {
+		topics = append(topics, t)
+	}
+	return topics, nil
+}
+
+func (c *client) Partitions(topic string) ([]int32, error) {
+	if p, ok := c.partitions[topic]; ok {
+		return p, nil
+	}
+	return nil, sarama.ErrUnknownTopicOrPartition
+}
+
+func (c *client) WritablePartitions(topic string) ([]int32, error) { return c.Partitions(topic) }
+
+func (*client) Leader(topic string, part int32) (*sarama.Broker, error) {
+	return nil, sarama.ErrLeaderNotAvailable
+}
+
+func (*client) Replicas(topic string, part int32) ([]int32, error) {
+	return nil, sarama.ErrReplicaNotAvailable
+}
+
+func (*client) RefreshMetadata(topics ...string) error { return nil }
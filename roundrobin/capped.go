@@ -0,0 +1,171 @@
+/*
+ A round-robin partitioner which honors a limit on the number of
+ partitions each member accepts
+
+ Each member advertises its limit in the UserData of its JoinGroup
+ metadata, and the leader assigns partitions round-robin skipping
+ the members which are full. Partitions which don't fit anywhere are
+ left unassigned. The leader logs them, and reports them to its
+ callback, so that the shortage can raise an alert (and maybe a
+ scale-up).
+
+ Since the members must agree on the algorithm, this partitioner
+ uses its own protocol name. All members of the group must use it.
+
+  Copyright 2016 MistSys
+*/
+
+package roundrobin
+
+import (
+	"encoding/binary"
+	"log"
+	"sort"
+
+	"github.com/Shopify/sarama"
+)
+
+// name of the protocol
+const capped_name = "cappedroundrobin"
+
+// CapacityShortfall is called by the leader with the partitions (a map of topic -> partitions) which could not be assigned because
+// every member requesting them was full
+type CapacityShortfall func(unassigned map[string][]int32)
+
+// a round-robin partitioner which limits the number of partitions assigned to each member
+type cappedPartitioner struct {
+	max_partitions int
+	shortfall      CapacityShortfall
+}
+
+// NewCapped returns a round-robin partitioner which limits this member to max_partitions partitions across all topics
+// (0 means no limit). If this member is the leader and the members' capacity is insufficient, the partitions which could
+// not be assigned are logged, and shortfall (if not nil) is called with them.
+func NewCapped(max_partitions int, shortfall CapacityShortfall) *cappedPartitioner {
+	return &cappedPartitioner{
+		max_partitions: max_partitions,
+		shortfall:      shortfall,
+	}
+}
+
+func (*cappedPartitioner) Name() string { return capped_name }
+
+func (cp *cappedPartitioner) PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current map[string][]int32) {
+	user_data := make([]byte, 4)
+	binary.BigEndian.PutUint32(user_data, uint32(cp.max_partitions))
+	jreq.AddGroupProtocolMetadata(capped_name,
+		&sarama.ConsumerGroupMemberMetadata{
+			Version:  1,
+			Topics:   topics,
+			UserData: user_data,
+		})
+}
+
+// for each topic in jresp, assign the topic's partitions round-robin across the members requesting each topic which have room for more
+func (cp *cappedPartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error {
+	by_member, err := jresp.GetMembers() // map of member to metadata
+	if err != nil {
+		return err
+	}
+	capacity := make(map[string]int, len(by_member)) // map of member to # of partitions it can still accept, or -1 if unlimited
+	by_topic := make(map[string][]string)            // map of topic to members requesting the topic
+	for member, request := range by_member {
+		if request.Version != 1 {
+			// skip unsupported versions, just like the uncapped partitioner
+			continue
+		}
+		capacity[member] = -1
+		if len(request.UserData) >= 4 {
+			if max := int(binary.BigEndian.Uint32(request.UserData)); max > 0 {
+				capacity[member] = max
+			}
+		}
+		for _, topic := range request.Topics {
+			by_topic[topic] = append(by_topic[topic], member)
+		}
+	}
+
+	// make sure we have fresh metadata for all these topics, and visit them in a fixed order, so that the
+	// capacity used up by earlier topics doesn't depend on the order of a map
+	topics := make([]string, 0, len(by_topic))
+	for t := range by_topic {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	if len(topics) != 0 {
+		err = client.RefreshMetadata(topics...)
+		if err != nil {
+			return err
+		}
+	}
+
+	assignments := make(map[string]map[string][]int32, len(by_member)) // map of member to topics, and topic to partitions
+	var unassigned map[string][]int32
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		members := by_topic[topic]
+		sort.Strings(members)
+
+		m := 0 // the next member in round-robin order
+		for _, p := range partitions {
+			// find the next member with room
+			assigned := false
+			for tries := 0; tries < len(members); tries++ {
+				member := members[m]
+				m = (m + 1) % len(members)
+				if capacity[member] == 0 {
+					continue
+				}
+				if capacity[member] > 0 {
+					capacity[member]--
+				}
+				member_topics, ok := assignments[member]
+				if !ok {
+					member_topics = make(map[string][]int32, len(by_topic))
+					assignments[member] = member_topics
+				}
+				member_topics[topic] = append(member_topics[topic], p)
+				assigned = true
+				break
+			}
+			if !assigned {
+				if unassigned == nil {
+					unassigned = make(map[string][]int32)
+				}
+				unassigned[topic] = append(unassigned[topic], p)
+			}
+		}
+	}
+	if unassigned != nil {
+		// the group needs more members, or larger limits
+		log.Printf("%s partitioner: the members of the group don't have room for all the partitions; leaving %v unassigned", capped_name, unassigned)
+		if cp.shortfall != nil {
+			cp.shortfall(unassigned)
+		}
+	}
+
+	// and encode the assignments in the sync request
+	for member_id, topics := range assignments {
+		sreq.AddGroupAssignmentMember(member_id,
+			&sarama.ConsumerGroupMemberAssignment{
+				Version: 1,
+				Topics:  topics,
+			})
+	}
+
+	return nil
+}
+
+func (cp *cappedPartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	assignments, _, err := cp.ParseSyncUserData(sresp)
+	return assignments, err
+}
+
+// ParseSyncUserData is ParseSync, plus it returns the UserData of the member assignment. The assignments are encoded
+// just like those of the uncapped partitioner.
+func (*cappedPartitioner) ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error) {
+	return RoundRobin.ParseSyncUserData(sresp)
+}
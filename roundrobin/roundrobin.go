@@ -12,6 +12,7 @@ package roundrobin
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/Shopify/sarama"
 )
@@ -83,6 +84,8 @@ func (roundRobinPartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sar
 			continue
 		}
 
+		// sort the members so the assignment doesn't depend on the order of the members in jresp (which is map order)
+		sort.Strings(members)
 		for i := 0; i < n; {
 			for _, member_id := range members {
 				topics, ok := assignments[member_id]
@@ -112,18 +115,24 @@ func (roundRobinPartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sar
 	return nil
 }
 
-func (roundRobinPartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+func (rr roundRobinPartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	assignments, _, err := rr.ParseSyncUserData(sresp)
+	return assignments, err
+}
+
+// ParseSyncUserData is ParseSync, plus it returns the UserData of the member assignment (which this partitioner doesn't use itself, but some other member might have put there)
+func (roundRobinPartitioner) ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error) {
 	if len(sresp.MemberAssignment) == 0 {
 		// in the corner case that we ask for no topics, we get nothing back. However sarama fd498173ae2bf (head of master branch Nov 6th 2016) will return a useless error if we call sresp.GetMemberAssignment() in this case
-		return nil, nil
+		return nil, nil, nil
 	}
 	ma, err := sresp.GetMemberAssignment()
 	//dbgf("MemberAssignment %v", ma)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if ma.Version != 1 {
-		return nil, fmt.Errorf("unsupported MemberAssignment version %d", ma.Version)
+		return nil, nil, fmt.Errorf("unsupported MemberAssignment version %d", ma.Version)
 	}
-	return ma.Topics, nil
+	return ma.Topics, ma.UserData, nil
 }
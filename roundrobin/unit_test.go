@@ -64,8 +64,7 @@ func TestRoundRobin(t *testing.T) {
 	}
 
 	// check the results assigned to each of the 3 consumers
-	// since RR depends on hash order, and that changes, we can't be sure which result each consumer gets,
-	// but there are only 3 possible results
+	// the members are sorted by id before partitions are dealt out, so the results are deterministic
 	var expected = map[int]map[string][]int32{
 		0: map[string][]int32{"topic1": []int32{0, 4, 7}, "topic2": []int32{0}},
 		1: map[string][]int32{"topic1": []int32{1, 5}, "topic2": []int32{1}},
@@ -84,14 +83,39 @@ func TestRoundRobin(t *testing.T) {
 
 		t.Logf("%s assignment %v\n", jreqs[i].MemberId, act)
 
-		for i, ex := range expected {
-			if reflect.DeepEqual(ex, act) {
-				delete(expected, i)
-				goto matched
-			}
+		if !reflect.DeepEqual(expected[i], act) {
+			t.Errorf("Unexpected assignment %v\n(Expected %v)\n", act, expected[i])
 		}
-		t.Errorf("Unexpected assignment %v\n(Expected one of %v)\n", act, expected)
-	matched:
+	}
+}
+
+// a member assignment with UserData (put there by some other framework's leader) should have its UserData returned
+func TestRoundRobinUserData(t *testing.T) {
+	var rr consumer.UserDataPartitioner = roundrobin.RoundRobin
+
+	var sreq sarama.SyncGroupRequest
+	err := sreq.AddGroupAssignmentMember("member0",
+		&sarama.ConsumerGroupMemberAssignment{
+			Version:  1,
+			Topics:   map[string][]int32{"topic1": []int32{0, 2}},
+			UserData: []byte("framework data"),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sresp = sarama.SyncGroupResponse{
+		MemberAssignment: sreq.GroupAssignments["member0"],
+	}
+
+	act, user_data, err := rr.ParseSyncUserData(&sresp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(act, map[string][]int32{"topic1": []int32{0, 2}}) {
+		t.Errorf("Unexpected assignment %v", act)
+	}
+	if string(user_data) != "framework data" {
+		t.Errorf("Unexpected UserData %q", user_data)
 	}
 }
 
@@ -150,3 +174,60 @@ func (*mockClient) RefreshController() (*sarama.Broker, error)
 func (*mockClient) InitProducerID() (*sarama.InitProducerIDResponse, error)          { return nil, nil }
 func (*mockClient) OfflineReplicas(topic string, partitionID int32) ([]int32, error) { return nil, nil }
 func (*mockClient) RefreshBrokers(addrs []string) error                              { return nil }
+
+func TestCapped(t *testing.T) {
+	var mock_client = mockClient{
+		config: sarama.NewConfig(),
+		partitions: map[string][]int32{
+			"topic1": []int32{0, 1, 2, 3, 4, 5, 6, 7},
+			"topic2": []int32{0, 1, 2, 3},
+		},
+	}
+
+	// member0 takes at most 2 partitions, member1 at most 3, and member2 at most 4, so 3 of the 12 partitions don't fit
+	var unassigned map[string][]int32
+	limits := []int{2, 3, 4}
+	var jresp = sarama.JoinGroupResponse{
+		GenerationId:  1,
+		GroupProtocol: "cappedroundrobin",
+		Members:       make(map[string][]byte),
+	}
+	var partitioners []consumer.Partitioner
+	for i, limit := range limits {
+		p := roundrobin.NewCapped(limit, func(u map[string][]int32) { unassigned = u })
+		partitioners = append(partitioners, p)
+		jreq := sarama.JoinGroupRequest{MemberId: fmt.Sprintf("member%d", i)}
+		p.PrepareJoin(&jreq, []string{"topic1", "topic2"}, nil)
+		jresp.Members[jreq.MemberId] = jreq.OrderedGroupProtocols[0].Metadata
+	}
+
+	var sreq sarama.SyncGroupRequest
+	err := partitioners[0].Partition(&sreq, &jresp, &mock_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for i, limit := range limits {
+		act, err := partitioners[i].ParseSync(&sarama.SyncGroupResponse{MemberAssignment: sreq.GroupAssignments[fmt.Sprintf("member%d", i)]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("member%d (limit %d) assignment %v", i, limit, act)
+		n := 0
+		for _, parts := range act {
+			n += len(parts)
+		}
+		if n != limit {
+			t.Errorf("member%d was assigned %d partitions; expected its limit of %d", i, n, limit)
+		}
+		total += n
+	}
+	n := 0
+	for _, parts := range unassigned {
+		n += len(parts)
+	}
+	if total != 9 || n != 3 {
+		t.Errorf("%d partitions assigned and %d reported unassigned; expected 9 and 3", total, n)
+	}
+}
@@ -0,0 +1,45 @@
+package stable
+
+import (
+	"testing"
+)
+
+// test that young partitions aren't moved, even at the expense of balance
+func TestAdjustYoung(t *testing.T) {
+	assignment := map[string][]int32{
+		"member0": []int32{0, 1, 2, 3},
+		"member1": []int32{4, 5},
+		"member2": nil, // a new member
+	}
+	young := map[string]map[int32]bool{
+		"member0": {0: true, 1: true, 2: true},
+		"member1": {4: true, 5: true},
+	}
+
+	adjust_partitioning(assignment, partitionslist{0, 1, 2, 3, 4, 5}, young)
+	t.Logf("assignment = %v", assignment)
+
+	// member2 can only get partition 3, the one partition which isn't young
+	if a := assignment["member2"]; len(a) != 1 || a[0] != 3 {
+		t.Errorf("member2 assigned %v", a)
+	}
+	if a := assignment["member0"]; len(a) != 3 {
+		t.Errorf("member0 assigned %v", a)
+	}
+	if a := assignment["member1"]; len(a) != 2 {
+		t.Errorf("member1 assigned %v", a)
+	}
+
+	// without young partitions the result is balanced
+	assignment = map[string][]int32{
+		"member0": []int32{0, 1, 2, 3},
+		"member1": []int32{4, 5},
+		"member2": nil,
+	}
+	adjust_partitioning(assignment, partitionslist{0, 1, 2, 3, 4, 5}, nil)
+	for m, a := range assignment {
+		if len(a) != 2 {
+			t.Errorf("%s assigned %v", m, a)
+		}
+	}
+}
@@ -10,12 +10,14 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"time"
 )
 
 // data is the extra (UserData) information reported by each member. It contains the current partition assignments of the member
 type data struct {
-	version     uint8              // 1 is the current version
-	assignments map[string][]int32 // map topic -> list of partitions currently assigned to the member
+	version     uint8                      // 1 is the current version
+	assignments map[string][]int32         // map topic -> list of partitions currently assigned to the member
+	held        map[string][]time.Duration // nil, or map topic -> how long the member has held each partition in assignments[topic] (used by the hold time option)
 }
 
 // marshal 'data' into a binary form, to be distributed
@@ -30,6 +32,16 @@ func (d *data) marshal() []byte {
 		buf = appendInt32Slice(buf, partitions)
 	}
 
+	// the hold times were added later. older members ignore them, since they ignore any trailing data
+	buf = appendUint(buf, len(d.held))
+	for topic, held := range d.held {
+		buf = appendString(buf, topic)
+		buf = appendUint(buf, len(held))
+		for _, h := range held {
+			buf = appendUint(buf, int(h/time.Millisecond))
+		}
+	}
+
 	return buf
 }
 
@@ -69,9 +81,61 @@ func (d *data) unmarshal(buf []byte) error {
 		d.assignments[topic] = partitions
 	}
 
+	// older members don't send the hold times, and newer members might send something else we don't understand. in either case we do without
+	if held, err := parseHeld(buf); err == nil && len(held) != 0 {
+		d.held = held
+	}
+
 	return nil
 }
 
+// parse the hold times which follow the assignments
+func parseHeld(buf []byte) (map[string][]time.Duration, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	buf, n, err := parseUint(buf)
+	if err != nil {
+		return nil, err
+	}
+	nn := n
+	if n > 1000 {
+		nn = 1000 // avoid DoS from bad data
+	}
+	held := make(map[string][]time.Duration, nn)
+
+	for n > 0 {
+		n--
+		var topic string
+		buf, topic, err = parseString(buf)
+		if err != nil {
+			return nil, err
+		}
+		var m int
+		buf, m, err = parseUint(buf)
+		if err != nil {
+			return nil, err
+		}
+		mm := m
+		if m > 1000 {
+			mm = 1000
+		}
+		h := make([]time.Duration, 0, mm)
+		for m > 0 {
+			m--
+			var ms int
+			buf, ms, err = parseUint(buf)
+			if err != nil {
+				return nil, err
+			}
+			h = append(h, time.Duration(ms)*time.Millisecond)
+		}
+		held[topic] = h
+	}
+
+	return held, nil
+}
+
 // utility functions
 
 func appendUint(buf []byte, x int) []byte {
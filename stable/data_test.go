@@ -3,6 +3,7 @@ package stable
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDataMarshal(t *testing.T) {
@@ -32,3 +33,37 @@ func TestDataMarshal(t *testing.T) {
 		t.Error("unmarshal(marshal(x)) != x")
 	}
 }
+
+func TestDataMarshalHeld(t *testing.T) {
+	var d = data{
+		version: 1,
+		assignments: map[string][]int32{
+			"topic1": []int32{1, 2},
+		},
+		held: map[string][]time.Duration{
+			"topic1": []time.Duration{0, 90 * time.Second},
+		},
+	}
+
+	var d2 data
+	err := d2.unmarshal(d.marshal())
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(d, d2) {
+		t.Logf("d = %v", d)
+		t.Logf("d2 = %v", d2)
+		t.Error("unmarshal(marshal(x)) != x")
+	}
+
+	// data from members which predate the hold times must still parse
+	old := []byte{1, 1, 6, 't', 'o', 'p', 'i', 'c', '1', 1, 2}
+	var d3 data
+	err = d3.unmarshal(old)
+	if err != nil {
+		t.Error(err)
+	}
+	if d3.held != nil || !reflect.DeepEqual(d3.assignments, map[string][]int32{"topic1": []int32{1}}) {
+		t.Errorf("unmarshal(old) = %v", d3)
+	}
+}
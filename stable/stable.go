@@ -36,6 +36,16 @@
   upgrades, when the set of matched topics is inconsistent across clients,
   the partitioning is correct for everyone)
 
+  Optionally the partitioner can enforce a minimum hold time. Once a
+  member has gained a partition the partition isn't moved to another
+  member until the hold time has passed, even if that leaves the
+  partitions unbalanced for a while. This keeps partitions from
+  ping-ponging between flapping members. The longer the hold time
+  the more stable, and the less balanced, the partitioning is after
+  membership changes. Each member reports in its UserData how long
+  it has held each of its partitions, so the members' clocks need
+  not agree.
+
   Copyright 2016 MistSys
 */
 
@@ -44,6 +54,8 @@ package stable
 import (
 	"fmt"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 )
@@ -52,6 +64,10 @@ import (
 type stablePartitioner struct {
 	consistent bool
 	name       string
+	hold       time.Duration // minimum time a member holds a partition before it can be moved, or 0
+
+	lock     sync.Mutex                     // lock protecting acquired
+	acquired map[string]map[int32]time.Time // map of topic -> partition -> when we were assigned the partition. Used only if hold > 0
 }
 
 // New constructs a new stable partitioner.
@@ -69,6 +85,17 @@ func New(consistent bool) *stablePartitioner {
 	}
 }
 
+// NewWithHoldTime constructs a new stable partitioner which doesn't move a partition away from the member which gained it
+// until it has held the partition for at least hold, all else being equal. Because it remembers when this member gained
+// each partition, each consumer.Client needs its own instance.
+// All members of the group ought to use the same hold time, since the leader's hold time is the one which counts.
+func NewWithHoldTime(consistent bool, hold time.Duration) *stablePartitioner {
+	sp := New(consistent)
+	sp.hold = hold
+	sp.acquired = make(map[string]map[int32]time.Time)
+	return sp
+}
+
 // print a debug message
 func dbgf(format string, args ...interface{}) {
 	//log.Printf(format, args...)
@@ -83,6 +110,9 @@ func (sp *stablePartitioner) PrepareJoin(jreq *sarama.JoinGroupRequest, topics [
 		version:     1,
 		assignments: current_assignments,
 	}
+	if sp.hold > 0 {
+		data.held = sp.heldFor(current_assignments)
+	}
 
 	jreq.AddGroupProtocolMetadata(sp.name,
 		&sarama.ConsumerGroupMemberMetadata{
@@ -105,6 +135,10 @@ func (sp *stablePartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sar
 
 	// invert the data, so we have the requests grouped by topic (they arrived grouped by member, since the kafka broker treats the data from each consumer as an opaque blob, so it couldn't do this step for us)
 	by_topic := make(map[string]map[string][]int32) // map of topic to members and members to current partition assignment
+	var young map[string]map[string]map[int32]bool  // nil, or map of topic to members to the partitions the member has held for less than sp.hold
+	if sp.hold > 0 {
+		young = make(map[string]map[string]map[int32]bool)
+	}
 	for member, request := range by_member {
 		if request.Version != 1 {
 			// skip unsupported versions. we'll only assign to clients we can understand. Since we are such a client
@@ -125,6 +159,20 @@ func (sp *stablePartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sar
 				by_topic[topic] = members
 			}
 			members[member] = data.assignments[topic] // NOTE: might be nil, which is OK. It just means the member wants to consume the partition but isn't doing so currently
+
+			if held := data.held[topic]; young != nil && len(held) == len(data.assignments[topic]) {
+				for i, p := range data.assignments[topic] {
+					if held[i] < sp.hold {
+						if young[topic] == nil {
+							young[topic] = make(map[string]map[int32]bool)
+						}
+						if young[topic][member] == nil {
+							young[topic][member] = make(map[int32]bool)
+						}
+						young[topic][member][p] = true
+					}
+				}
+			}
 		}
 	}
 	dbgf("by_topic = %v", by_topic)
@@ -198,7 +246,7 @@ func (sp *stablePartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sar
 		// adjust the partitioning of each master topic in by_topic
 		for topic, match := range matched_topics {
 			if topic == match {
-				adjust_partitioning(by_topic[topic], partitions_by_topic[topic])
+				adjust_partitioning(by_topic[topic], partitions_by_topic[topic], young[topic])
 			} // else it is not a master topic. once the master has been partitioned we'll simply copy the result
 		}
 
@@ -211,7 +259,7 @@ func (sp *stablePartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sar
 	} else {
 		// partition each topic independantly
 		for topic, members := range by_topic {
-			adjust_partitioning(members, partitions_by_topic[topic])
+			adjust_partitioning(members, partitions_by_topic[topic], young[topic])
 		}
 	}
 
@@ -241,26 +289,75 @@ func (sp *stablePartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sar
 	return nil
 }
 
-func (*stablePartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+func (sp *stablePartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	assignments, _, err := sp.ParseSyncUserData(sresp)
+	return assignments, err
+}
+
+// ParseSyncUserData is ParseSync, plus it returns the UserData of the member assignment
+func (sp *stablePartitioner) ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error) {
 	if len(sresp.MemberAssignment) == 0 {
 		// in the corner case that we ask for no topics, we get nothing back. However sarama fd498173ae2bf (head of master branch Nov 6th 2016) will return a useless error if we call sresp.GetMemberAssignment() in this case
-		return nil, nil
+		return nil, nil, nil
 	}
 	ma, err := sresp.GetMemberAssignment()
 	dbgf("MemberAssignment %v", ma)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if ma.Version != 1 {
-		return nil, fmt.Errorf("unsupported MemberAssignment version %d", ma.Version)
+		return nil, nil, fmt.Errorf("unsupported MemberAssignment version %d", ma.Version)
+	}
+	if sp.hold > 0 {
+		sp.noteAssignments(ma.Topics)
+	}
+	return ma.Topics, ma.UserData, nil
+}
+
+// noteAssignments records when we gained each partition in our new assignments
+func (sp *stablePartitioner) noteAssignments(assignments map[string][]int32) {
+	now := time.Now()
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	acquired := make(map[string]map[int32]time.Time, len(assignments))
+	for topic, partitions := range assignments {
+		acquired[topic] = make(map[int32]time.Time, len(partitions))
+		for _, p := range partitions {
+			if t, ok := sp.acquired[topic][p]; ok {
+				acquired[topic][p] = t
+			} else {
+				acquired[topic][p] = now
+			}
+		}
 	}
-	return ma.Topics, nil
+	sp.acquired = acquired
+}
+
+// heldFor returns how long we've held each partition in assignments. Partitions we don't remember gaining are treated as held long enough to move
+func (sp *stablePartitioner) heldFor(assignments map[string][]int32) map[string][]time.Duration {
+	now := time.Now()
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	held := make(map[string][]time.Duration, len(assignments))
+	for topic, partitions := range assignments {
+		h := make([]time.Duration, len(partitions))
+		for i, p := range partitions {
+			if t, ok := sp.acquired[topic][p]; ok {
+				h[i] = now.Sub(t)
+			} else {
+				h[i] = sp.hold
+			}
+		}
+		held[topic] = h
+	}
+	return held
 }
 
 // ----------------------------------
 
 // adjust_partitioning does the main work. it adjusts the partition assignment map it is passed in-place
-func adjust_partitioning(assignment map[string][]int32, partitions partitionslist) {
+// young is nil, or the map of member to the set of partitions the member has held for too short a time to be moved
+func adjust_partitioning(assignment map[string][]int32, partitions partitionslist, young map[string]map[int32]bool) {
 	dbgf("adjust_partitioning(assignment = %v, partitions = %v)", assignment, partitions)
 	num_members := len(assignment)
 	dbgf("num_members = %v", num_members)
@@ -277,6 +374,13 @@ func adjust_partitioning(assignment map[string][]int32, partitions partitionslis
 	unassigned := make(map[int32]struct{}, len(partitions)) // set of unassigned partition ids
 	claimed := make(map[int32]struct{}, len(partitions))    // set of initially claimed partition ids
 
+	// visit the members and the partitions (which arrive sorted) in sorted order, so the result doesn't depend on map order
+	members := make(memberslist, 0, num_members)
+	for m := range assignment {
+		members = append(members, m)
+	}
+	sort.Sort(members)
+
 	// initially all partitions are unassigned
 	for _, p := range partitions {
 		unassigned[p] = struct{}{}
@@ -288,7 +392,8 @@ func adjust_partitioning(assignment map[string][]int32, partitions partitionslis
 	// (these will happen only in corner cases where kafka is reconfigured,
 	// or clients are confused/out of sync, but it is always a good idea
 	// to check this for sanity before proceeding further)
-	for m, a := range assignment {
+	for _, m := range members {
+		a := assignment[m]
 		for _, p := range a {
 			_, ok := unassigned[p]
 			_, ok2 := claimed[p]
@@ -316,10 +421,25 @@ func adjust_partitioning(assignment map[string][]int32, partitions partitionslis
 	}
 	dbgf("assignment = %v", assignment)
 
-	// let each member keep up to 'high' of its current assignment
-	for m, a := range assignment {
+	// let each member keep up to 'high' of its current assignment (plus any young partitions beyond that)
+	for _, m := range members {
+		a := assignment[m]
 		if len(a) > high {
-			a = a[:high]
+			keep := high
+			if y := young[m]; len(y) != 0 {
+				// keep the young partitions, even if that leaves m overloaded
+				sort.SliceStable(a, func(i, j int) bool { return y[a[i]] && !y[a[j]] })
+				n := 0
+				for _, p := range a {
+					if y[p] {
+						n++
+					}
+				}
+				if n > keep {
+					keep = n
+				}
+			}
+			a = a[:keep]
 			assignment[m] = a
 		}
 		for _, p := range a {
@@ -330,9 +450,13 @@ func adjust_partitioning(assignment map[string][]int32, partitions partitionslis
 	dbgf("unassigned = %v", unassigned)
 
 	// assign the unassigned partitions to any member with < low partitions
-	for p := range unassigned {
+	for _, p := range partitions {
+		if _, ok := unassigned[p]; !ok {
+			continue
+		}
 	unassigned_loop:
-		for m, a := range assignment {
+		for _, m := range members {
+			a := assignment[m]
 			if len(a) < low {
 				a = append(a, p)
 				assignment[m] = a
@@ -346,26 +470,42 @@ func adjust_partitioning(assignment map[string][]int32, partitions partitionslis
 
 	// take partitions from any member with > low partitions to give
 	// to any member with < low partitions
-	for m, a := range assignment {
+	for _, m := range members {
+		a := assignment[m]
 	stealing_from_the_numerous:
 		for len(a) < low {
-			for m2, a2 := range assignment {
+			for _, m2 := range members {
+				a2 := assignment[m2]
 				n := len(a2)
 				if n > low {
-					// take the last partition from m2 and give it to m
+					// take the last partition which isn't young from m2 and give it to m
+					i := n - 1
+					for i >= 0 && young[m2][a2[i]] {
+						i--
+					}
+					if i < 0 {
+						continue
+					}
+					a2[i], a2[n-1] = a2[n-1], a2[i]
 					assignment[m2] = a2[:n-1]
 					a = append(a, a2[n-1])
 					assignment[m] = a
 					continue stealing_from_the_numerous
 				}
 			}
+			// all the partitions which could be taken are too young to move. m remains underloaded for now
+			break
 		}
 	}
 
 	// and finally assign any remaining unassigned partitions to any member with < high partitions
-	for p := range unassigned {
+	for _, p := range partitions {
+		if _, ok := unassigned[p]; !ok {
+			continue
+		}
 	assignment_loop:
-		for m, a := range assignment {
+		for _, m := range members {
+			a := assignment[m]
 			if len(a) < high {
 				a = append(a, p)
 				assignment[m] = a
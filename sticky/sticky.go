@@ -0,0 +1,247 @@
+/*
+  A partitioner which keeps each member's partitions across rebalances,
+  moving only as many partitions as it takes to balance the group.
+
+  It speaks kafka's "sticky" protocol, so it can share a consumer group
+  with java consumers using the StickyAssignor, and with sarama's own
+  ConsumerGroup using sarama.BalanceStrategySticky. The assignment itself
+  is computed by sarama.BalanceStrategySticky.
+
+  Each member reports its current assignment, and the generation in
+  which it was assigned, in the UserData of its JoinGroup metadata. The
+  leader includes the generation in the UserData of each member's
+  assignment, so the members learn it. When two members claim the same
+  partition (because one missed a rebalance) the generations tell the
+  leader which claim is current.
+
+  The stable partitioner is similarly sticky and also balances the
+  group, but it is only understood by this package's clients.
+
+  Copyright 2016 MistSys
+*/
+
+package sticky
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// the name of kafka's sticky protocol
+const name = sarama.StickyBalanceStrategyName
+
+// the generation of an assignment made by no one. it matches what the java client and sarama use
+const no_generation = -1
+
+// sarama.BalanceStrategySticky keeps state while it plans, so plans must be serialized
+var plan_lock sync.Mutex
+
+// a partitioner which keeps each member's partitions where they are as much as it can
+type stickyPartitioner struct {
+	lock       sync.Mutex // lock protecting generation
+	generation int32      // the generation of our last assignment, or no_generation
+}
+
+// New constructs a new sticky partitioner. Because it remembers the generation of its latest assignment, each
+// consumer.Client needs its own instance.
+func New() *stickyPartitioner {
+	return &stickyPartitioner{generation: no_generation}
+}
+
+func (sp *stickyPartitioner) Name() string { return name }
+
+// PrepareJoin proposes the sticky protocol, with our current assignments as UserData
+func (sp *stickyPartitioner) PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current_assignments map[string][]int32) {
+	sp.lock.Lock()
+	generation := sp.generation
+	sp.lock.Unlock()
+
+	jreq.AddGroupProtocolMetadata(name,
+		&sarama.ConsumerGroupMemberMetadata{
+			Version:  1,
+			Topics:   topics,
+			UserData: marshal(current_assignments, generation),
+		})
+}
+
+// Partition has sarama.BalanceStrategySticky plan the assignments, starting from the members' current assignments
+func (sp *stickyPartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error {
+	if jresp.GroupProtocol != name {
+		return fmt.Errorf("sarama.JoinGroupResponse.GroupProtocol %q unexpected; expected %q", jresp.GroupProtocol, name)
+	}
+	by_member, err := jresp.GetMembers() // map of member to ConsumerGroupMemberMetadata
+	if err != nil {
+		return err
+	}
+
+	// gather the partitions of every topic requested by any member
+	var topics []string
+	seen := make(map[string]bool)
+	for _, request := range by_member {
+		for _, topic := range request.Topics {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+	partitions := make(map[string][]int32, len(topics))
+	if len(topics) != 0 {
+		// make sure we have fresh metadata for all these topics
+		err = client.RefreshMetadata(topics...)
+		if err != nil {
+			return err
+		}
+	} // else asking for RefreshMetadata() would refresh all known topics, which is expensive and unnecessary
+	for _, topic := range topics {
+		parts, err := client.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		partitions[topic] = parts
+	}
+
+	plan_lock.Lock()
+	plan, err := sarama.BalanceStrategySticky.Plan(by_member, partitions)
+	plan_lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// and encode the assignments in the sync request, along with the generation in which they were made
+	for member_id := range by_member {
+		topics := plan[member_id]
+		for _, parts := range topics {
+			sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+		}
+		sreq.AddGroupAssignmentMember(member_id,
+			&sarama.ConsumerGroupMemberAssignment{
+				Version:  1,
+				Topics:   topics,
+				UserData: marshal(topics, jresp.GenerationId),
+			})
+	}
+
+	return nil
+}
+
+func (sp *stickyPartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	assignments, _, err := sp.ParseSyncUserData(sresp)
+	return assignments, err
+}
+
+// ParseSyncUserData is ParseSync, plus it returns the UserData of the member assignment
+func (sp *stickyPartitioner) ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error) {
+	if len(sresp.MemberAssignment) == 0 {
+		// in the corner case that we ask for no topics, we get nothing back. However sarama fd498173ae2bf (head of master branch Nov 6th 2016) will return a useless error if we call sresp.GetMemberAssignment() in this case
+		return nil, nil, nil
+	}
+	ma, err := sresp.GetMemberAssignment()
+	if err != nil {
+		return nil, nil, err
+	}
+	// remember the generation of the assignment, so we can report it when we next join. (a leader which doesn't
+	// include the generation leaves us with no_generation, which is fine too)
+	generation := int32(no_generation)
+	if _, g, err := unmarshal(ma.UserData); err == nil {
+		generation = g
+	}
+	sp.lock.Lock()
+	sp.generation = generation
+	sp.lock.Unlock()
+	return ma.Topics, ma.UserData, nil
+}
+
+// ----------------------------------
+
+// marshal encodes assignments and their generation the way kafka's StickyAssignor does in its version 1 UserData:
+// an array of (topic string, array of int32 partitions), followed by the int32 generation
+func marshal(assignments map[string][]int32, generation int32) []byte {
+	topics := make([]string, 0, len(assignments))
+	for topic := range assignments {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics) // so the encoding is deterministic
+
+	var buf []byte
+	buf = appendInt32(buf, int32(len(topics)))
+	for _, topic := range topics {
+		buf = appendInt16(buf, int16(len(topic)))
+		buf = append(buf, topic...)
+		buf = appendInt32(buf, int32(len(assignments[topic])))
+		for _, p := range assignments[topic] {
+			buf = appendInt32(buf, p)
+		}
+	}
+	buf = appendInt32(buf, generation)
+	return buf
+}
+
+var errTruncated = errors.New("truncated sticky UserData")
+
+// unmarshal decodes UserData encoded by marshal. version 0 UserData, which has no generation, is returned with no_generation
+func unmarshal(buf []byte) (map[string][]int32, int32, error) {
+	n, buf, err := int32At(buf)
+	if err != nil {
+		return nil, no_generation, err
+	}
+	assignments := make(map[string][]int32)
+	for i := int32(0); i < n; i++ {
+		if len(buf) < 2 {
+			return nil, no_generation, errTruncated
+		}
+		l := int(binary.BigEndian.Uint16(buf))
+		buf = buf[2:]
+		if len(buf) < l {
+			return nil, no_generation, errTruncated
+		}
+		topic := string(buf[:l])
+		buf = buf[l:]
+		var m int32
+		m, buf, err = int32At(buf)
+		if err != nil {
+			return nil, no_generation, err
+		}
+		if m < 0 || int(m) > len(buf)/4 {
+			return nil, no_generation, errTruncated
+		}
+		parts := make([]int32, m)
+		for j := range parts {
+			parts[j], buf, err = int32At(buf)
+			if err != nil {
+				return nil, no_generation, err
+			}
+		}
+		assignments[topic] = parts
+	}
+	if len(buf) == 0 {
+		return assignments, no_generation, nil
+	}
+	generation, _, err := int32At(buf)
+	return assignments, generation, err
+}
+
+func appendInt16(buf []byte, v int16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	return append(buf, b[:]...)
+}
+
+func appendInt32(buf []byte, v int32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	return append(buf, b[:]...)
+}
+
+// int32At decodes the int32 at the start of buf, and returns it and the rest of buf
+func int32At(buf []byte) (int32, []byte, error) {
+	if len(buf) < 4 {
+		return 0, nil, errTruncated
+	}
+	return int32(binary.BigEndian.Uint32(buf)), buf[4:], nil
+}
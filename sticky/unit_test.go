@@ -0,0 +1,88 @@
+/*
+  A simple kafka consumer-group client
+
+  Copyright 2016 MistSys
+*/
+
+package sticky_test
+
+import (
+	"fmt"
+	"testing"
+
+	consumer "github.com/mistsys/sarama-consumer"
+	"github.com/mistsys/sarama-consumer/partitiontest"
+	"github.com/mistsys/sarama-consumer/sticky"
+)
+
+// count the partitions of topic1 which are assigned to a different member in b than in a
+func moved(a, b map[string]map[string][]int32) int {
+	owner := make(map[int32]string)
+	for member, topics := range a {
+		for _, p := range topics["topic1"] {
+			owner[p] = member
+		}
+	}
+	n := 0
+	for member, topics := range b {
+		for _, p := range topics["topic1"] {
+			if owner[p] != member {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestSticky(t *testing.T) {
+	partitions := map[string][]int32{"topic1": []int32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}}
+	ps := make(map[string]consumer.Partitioner)
+	members := make(map[string][]string)
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("member%d", i)
+		ps[id] = sticky.New()
+		members[id] = []string{"topic1"}
+	}
+
+	a, err := partitiontest.Partition(sticky.New(), members, partitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("3 members:\n%s", partitiontest.Format(a))
+	for member, topics := range a {
+		if len(topics["topic1"]) != 4 {
+			t.Errorf("%s was assigned %v; expected 4 partitions", member, topics["topic1"])
+		}
+	}
+
+	// member1 leaves. only its 4 partitions should move
+	delete(members, "member1")
+	delete(ps, "member1")
+	b, err := partitiontest.Rebalance(ps, members, partitions, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("member1 left:\n%s", partitiontest.Format(b))
+	if n := moved(a, b); n != 4 {
+		t.Errorf("%d partitions moved when member1 left; expected 4", n)
+	}
+
+	// member3 and member4 join. 6 partitions have to move to balance the group
+	for _, id := range []string{"member3", "member4"} {
+		ps[id] = sticky.New()
+		members[id] = []string{"topic1"}
+	}
+	c, err := partitiontest.Rebalance(ps, members, partitions, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("member3 and member4 joined:\n%s", partitiontest.Format(c))
+	if n := moved(b, c); n != 6 {
+		t.Errorf("%d partitions moved when 2 members joined; expected 6", n)
+	}
+	for member, topics := range c {
+		if len(topics["topic1"]) != 3 {
+			t.Errorf("%s was assigned %v; expected 3 partitions", member, topics["topic1"])
+		}
+	}
+}
@@ -0,0 +1,1170 @@
+/*
+  Unit tests of the internals of the consumer group client
+
+  Copyright 2016 MistSys
+*/
+
+package consumer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/mistsys/sarama-consumer/compressed"
+	"github.com/mistsys/sarama-consumer/roundrobin"
+)
+
+func TestJoinGroupRequestTimeouts(t *testing.T) {
+	config := NewConfig()
+	config.Session.Timeout = 10 * time.Second
+	config.Rebalance.Timeout = 45 * time.Second
+
+	// kafka 0.9 has no rebalance timeout
+	sconfig := sarama.NewConfig()
+	sconfig.Version = sarama.V0_9_0_0
+	jreq := newJoinGroupRequest("group", "member", config, sconfig)
+	if jreq.Version != 0 || jreq.RebalanceTimeout != 0 {
+		t.Errorf("0.9 JoinGroupRequest has version %d, rebalance timeout %d", jreq.Version, jreq.RebalanceTimeout)
+	}
+	if jreq.SessionTimeout != 10000 {
+		t.Errorf("0.9 JoinGroupRequest has session timeout %d", jreq.SessionTimeout)
+	}
+
+	// kafka 0.10.1 and later do
+	for _, v := range []sarama.KafkaVersion{sarama.V0_10_1_0, sarama.V2_0_0_0} {
+		sconfig.Version = v
+		jreq = newJoinGroupRequest("group", "member", config, sconfig)
+		if jreq.Version != 1 || jreq.RebalanceTimeout != 45000 || jreq.SessionTimeout != 10000 {
+			t.Errorf("%v JoinGroupRequest has version %d, session timeout %d, rebalance timeout %d", v, jreq.Version, jreq.SessionTimeout, jreq.RebalanceTimeout)
+		}
+	}
+}
+
+// a Partitioner with bugs
+type panickingPartitioner struct{}
+
+func (panickingPartitioner) Name() string { return "panicking" }
+func (panickingPartitioner) PrepareJoin(*sarama.JoinGroupRequest, []string, map[string][]int32) {
+	var m map[string]int
+	m["boom"] = 1 // nil map assignment panics
+}
+func (panickingPartitioner) Partition(*sarama.SyncGroupRequest, *sarama.JoinGroupResponse, sarama.Client) error {
+	panic("Partition")
+}
+func (panickingPartitioner) ParseSync(*sarama.SyncGroupResponse) (map[string][]int32, error) {
+	var a []int32
+	_ = a[1] // index out of range panics
+	return nil, nil
+}
+
+func TestPanickingPartitioner(t *testing.T) {
+	var p panickingPartitioner
+
+	err := prepareJoin(p, &sarama.JoinGroupRequest{}, []string{"topic"}, nil)
+	t.Log(err)
+	if err == nil {
+		t.Error("PrepareJoin panic not converted to an error")
+	}
+
+	err = partitionGroup(p, &sarama.SyncGroupRequest{}, &sarama.JoinGroupResponse{}, nil)
+	t.Log(err)
+	if err == nil {
+		t.Error("Partition panic not converted to an error")
+	}
+
+	a, _, err := parseSync(p, &sarama.SyncGroupResponse{})
+	t.Log(err)
+	if err == nil || a != nil {
+		t.Error("ParseSync panic not converted to an error")
+	}
+}
+
+func TestPublishAssignmentCoalesces(t *testing.T) {
+	con := &consumer{assignment_changes: make(chan Assignment, 1)}
+
+	// nobody reads the 1st change before the 2nd arrives
+	con.publishAssignment(Assignment{Generation: 1, Partitions: []int32{0, 1, 2}, Added: []int32{2}, Removed: []int32{3}})
+	con.publishAssignment(Assignment{Generation: 2, Partitions: []int32{0, 3, 4}, Added: []int32{3, 4}, Removed: []int32{1, 2}})
+
+	a := <-con.AssignmentChanges()
+	// relative to the partitions before the 1st change, {0,1,3}
+	if a.Generation != 2 || !reflect.DeepEqual(a.Added, []int32{4}) || !reflect.DeepEqual(a.Removed, []int32{1}) {
+		t.Errorf("coalesced Assignment %+v", a)
+	}
+
+	select {
+	case a := <-con.AssignmentChanges():
+		t.Errorf("unexpected Assignment %+v", a)
+	default:
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	eb := ExponentialBackoff{Min: 100 * time.Millisecond, Max: time.Second}
+	for attempt, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			d := eb.NextDelay(attempt)
+			if d > max || d < max/2 {
+				t.Fatalf("attempt %d delay %v not in [%v, %v]", attempt, d, max/2, max)
+			}
+		}
+	}
+	if d := eb.NextDelay(1000); d > time.Second {
+		t.Errorf("attempt 1000 delay %v", d)
+	}
+}
+
+func TestStrictOrderDone(t *testing.T) {
+	config := NewConfig()
+	config.StrictOrderDone = true
+	cl := &client{config: config, errors: make(chan error, 10)}
+	con := &consumer{cl: cl, topic: "topic"}
+	part := &partition{con: con, partition: 3, last_done: -1, undone: []int64{10, 11, 13}}
+
+	part.checkDoneOrder(10)
+	part.checkDoneOrder(13) // out of order
+	part.checkDoneOrder(11)
+	part.checkDoneOrder(12) // never delivered
+	if len(part.undone) != 0 {
+		t.Errorf("undone %v", part.undone)
+	}
+	if n := len(cl.errors); n != 2 {
+		t.Errorf("%d errors", n)
+	}
+}
+
+func TestNewClientChecksVersion(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	sconfig := sarama.NewConfig()
+	sconfig.Version = sarama.V0_8_2_0
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, sconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sclient.Close()
+
+	if _, err := NewClient("group", nil, sclient); err == nil {
+		t.Error("NewClient accepted a sarama.Client with a too old version")
+	}
+}
+
+func TestLogAssignments(t *testing.T) {
+	var logged string
+	defer func(orig func(string, ...interface{})) { Logf = orig }(Logf)
+	Logf = func(format string, args ...interface{}) { logged = fmt.Sprintf(format, args...) }
+
+	var jresp = sarama.JoinGroupResponse{
+		Members: map[string][]byte{"member1": nil, "member0": nil, "member2": nil},
+	}
+	var sreq sarama.SyncGroupRequest
+	sreq.AddGroupAssignmentMember("member1", &sarama.ConsumerGroupMemberAssignment{
+		Version: 1,
+		Topics:  map[string][]int32{"topic2": []int32{1}, "topic1": []int32{3, 1}},
+	})
+	sreq.AddGroupAssignmentMember("member0", &sarama.ConsumerGroupMemberAssignment{
+		Version: 1,
+		Topics:  map[string][]int32{"topic1": []int32{0, 2}},
+	})
+
+	logSyncAssignments("group", 7, &jresp, &sreq)
+	t.Log(logged)
+	const expected = "consumer \"group\" generation 7 assignments of 3 members:\n" +
+		"  member0: topic1[0 2]\n" +
+		"  member1: topic1[1 3] topic2[1]\n" +
+		"  member2: (nothing)"
+	if logged != expected {
+		t.Errorf("logged %q, expected %q", logged, expected)
+	}
+}
+
+// partitions which remain assigned across a rebalance (for instance when only the coordinator moved) must be neither added nor removed
+func TestDifference(t *testing.T) {
+	old := map[int32]*partition{0: nil, 2: nil, 3: nil, 5: nil}
+
+	added, removed := difference(old, []int32{5, 3, 2, 0})
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("unchanged assignment added %v, removed %v", added, removed)
+	}
+
+	added, removed = difference(old, []int32{6, 3, 1, 0})
+	if !reflect.DeepEqual(added, []int32{1, 6}) || !reflect.DeepEqual(removed, []int32{2, 5}) {
+		t.Errorf("changed assignment added %v, removed %v", added, removed)
+	}
+}
+
+// a buggy leader assigns this member a partition of a topic it never asked for
+func TestMisassignedTopic(t *testing.T) {
+	var sreq sarama.SyncGroupRequest
+	sreq.AddGroupAssignmentMember("member0", &sarama.ConsumerGroupMemberAssignment{
+		Version: 1,
+		Topics:  map[string][]int32{"topic1": []int32{0, 1}, "other": []int32{3}},
+	})
+	assignments, _, err := parseSync(roundrobin.RoundRobin, &sarama.SyncGroupResponse{MemberAssignment: sreq.GroupAssignments["member0"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unrequested := dropUnrequested(assignments, map[string]bool{"topic1": true, "topic2": true})
+	if !reflect.DeepEqual(unrequested, []string{"other"}) {
+		t.Errorf("unrequested topics %v", unrequested)
+	}
+	if !reflect.DeepEqual(assignments, map[string][]int32{"topic1": []int32{0, 1}}) {
+		t.Errorf("assignments %v", assignments)
+	}
+}
+
+func TestShutdownBarrier(t *testing.T) {
+	con1, con2 := &consumer{topic: "topic1"}, &consumer{topic: "topic2"}
+	b := newShutdownBarrier(map[string]*consumer{"topic1": con1, "topic2": con2})
+
+	b.arrive(con1)
+	b.arrive(con1) // arriving twice counts once
+	select {
+	case <-b.released:
+		t.Fatal("barrier released before every consumer arrived")
+	default:
+	}
+	b.arrive(con2)
+	select {
+	case <-b.released:
+	default:
+		t.Fatal("barrier not released once every consumer arrived")
+	}
+
+	if b := newShutdownBarrier(nil); b == nil {
+		t.Fatal("nil barrier")
+	} else {
+		<-b.released // a barrier with no consumers is already released
+	}
+}
+
+// only the most recent rebalances are remembered
+func TestRebalances(t *testing.T) {
+	cl := &client{}
+	for i := 0; i < max_rebalances+3; i++ {
+		cl.noteRebalance(RebalanceHeartbeat, fmt.Errorf("%d", i))
+	}
+	cl.noteRebalance(RebalanceConsumerAdded, nil)
+	r := cl.Rebalances()
+	if len(r) != max_rebalances {
+		t.Fatalf("%d rebalances remembered; expected %d", len(r), max_rebalances)
+	}
+	if r[0].Err.Error() != "4" || r[len(r)-1].Reason != RebalanceConsumerAdded {
+		t.Errorf("unexpected rebalances %v", r)
+	}
+}
+
+// Done after the consumer has stopped must not block
+func TestDoneAfterClose(t *testing.T) {
+	con := &consumer{
+		topic:   "topic",
+		done:    make(chan *sarama.ConsumerMessage),
+		stopped: make(chan struct{}),
+	}
+	close(con.stopped)
+	returned := make(chan struct{})
+	go func() {
+		con.Done(&sarama.ConsumerMessage{Topic: "topic", Offset: 1})
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("Done blocked after the consumer stopped")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	part := &partition{con: &consumer{closed: make(chan struct{})}}
+	if !part.waitUnthrottled() {
+		t.Fatal("waitUnthrottled failed when not throttled")
+	}
+	if !part.throttle() || part.throttle() {
+		t.Fatal("throttle should report only the first throttling")
+	}
+	waited := make(chan bool)
+	go func() { waited <- part.waitUnthrottled() }()
+	select {
+	case <-waited:
+		t.Fatal("waitUnthrottled returned while throttled")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if !part.unthrottle() || part.unthrottle() {
+		t.Fatal("unthrottle should report only the first unthrottling")
+	}
+	if !<-waited {
+		t.Fatal("waitUnthrottled failed once unthrottled")
+	}
+
+	// closing the consumer releases a throttled partition
+	part.throttle()
+	close(part.con.closed)
+	if part.waitUnthrottled() {
+		t.Fatal("waitUnthrottled succeeded after the consumer closed")
+	}
+}
+
+// committing and then fetching back an offset in either convention must neither reprocess nor skip any message
+func TestCommitLastConsumed(t *testing.T) {
+	for _, last_consumed := range []bool{false, true} {
+		cl := &client{config: NewConfig()}
+		cl.config.CommitLastConsumed = last_consumed
+
+		for _, next := range []int64{1, 2, 1000} {
+			committed, ok := cl.committedOffset(next)
+			if !ok {
+				t.Fatalf("CommitLastConsumed=%v: offset %d not committed", last_consumed, next)
+			}
+			// a java client (kafka's convention) commits the next offset to consume
+			expected := next
+			if last_consumed {
+				expected = next - 1
+			}
+			if committed != expected {
+				t.Errorf("CommitLastConsumed=%v: offset %d committed as %d, expected %d", last_consumed, next, committed, expected)
+			}
+			if fetched := cl.fetchedOffset(committed); fetched != next {
+				t.Errorf("CommitLastConsumed=%v: offset %d committed as %d and fetched back as %d", last_consumed, next, committed, fetched)
+			}
+		}
+
+		// special offsets pass through unchanged
+		for _, special := range []int64{sarama.OffsetNewest, sarama.OffsetOldest} {
+			if fetched := cl.fetchedOffset(special); fetched != special {
+				t.Errorf("CommitLastConsumed=%v: special offset %d fetched as %d", last_consumed, special, fetched)
+			}
+		}
+
+		// a partition where nothing has been consumed has nothing to commit in the last consumed convention
+		if _, ok := cl.committedOffset(0); ok == last_consumed {
+			t.Errorf("CommitLastConsumed=%v: offset 0 committed = %v", last_consumed, ok)
+		}
+	}
+}
+
+func TestPace(t *testing.T) {
+	con := &consumer{closed: make(chan struct{})}
+
+	// without a limit pace never waits
+	var next time.Time
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		con.pace(&next)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("unlimited pace took %v", d)
+	}
+
+	con.SetRateLimit(100)
+	next = time.Time{} // long in the past, so the 1st msg isn't delayed
+	start = time.Now()
+	for i := 0; i < 6; i++ {
+		if !con.pace(&next) {
+			t.Fatal("pace returned false")
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("6 msgs at 100/sec took only %v", d)
+	}
+
+	con.SetRateLimit(0.1)
+	next = time.Now().Add(time.Minute)
+	close(con.closed)
+	if con.pace(&next) {
+		t.Error("pace of a closed consumer returned true")
+	}
+}
+
+func TestCheckStalled(t *testing.T) {
+	var stalls int
+	cl := &client{config: NewConfig(), errors: make(chan error, 10)}
+	cl.config.CommitStalledNotification = func(topic string, partition int32, offset int64, stalled time.Duration) { stalls++ }
+	con := &consumer{cl: cl, topic: "topic", in_order_done: true}
+	part := &partition{con: con, partition: 1, next_commit_offset: 100, last_done: -1}
+	part.delivered_offset = 105 // msgs 100 to 104 are outstanding
+
+	start := time.Now()
+	part.checkStalled(start, time.Minute)
+	part.checkStalled(start.Add(time.Minute), time.Minute)
+	if stalls != 0 {
+		t.Errorf("stall reported too soon")
+	}
+	part.checkStalled(start.Add(2*time.Minute), time.Minute)
+	part.checkStalled(start.Add(3*time.Minute), time.Minute)
+	if stalls != 1 || len(cl.errors) != 1 {
+		t.Errorf("stall reported %d times, with %d errors; expected once", stalls, len(cl.errors))
+	}
+
+	// once the offset advances the watchdog starts over
+	part.next_commit_offset = 103
+	part.checkStalled(start.Add(4*time.Minute), time.Minute)
+	part.checkStalled(start.Add(6*time.Minute), time.Minute)
+	if stalls != 2 {
+		t.Errorf("2nd stall reported %d times", stalls-1)
+	}
+
+	// and a partition with nothing outstanding is never stalled
+	part.next_commit_offset = 105
+	part.checkStalled(start.Add(7*time.Minute), time.Minute)
+	part.checkStalled(start.Add(9*time.Minute), time.Minute)
+	if stalls != 2 {
+		t.Errorf("idle partition reported as stalled")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	cl := &client{config: NewConfig(), errors: make(chan error, 10)}
+	con := &consumer{cl: cl, topic: "topic"}
+
+	if !con.filter(&sarama.ConsumerMessage{}) {
+		t.Error("msg filtered without a Filter")
+	}
+
+	cl.config.Filter = func(msg *sarama.ConsumerMessage) bool { return msg.Offset%2 == 0 }
+	if !con.filter(&sarama.ConsumerMessage{Offset: 2}) || con.filter(&sarama.ConsumerMessage{Offset: 3}) {
+		t.Error("Filter not applied")
+	}
+
+	cl.config.Filter = func(msg *sarama.ConsumerMessage) bool { panic("oops") }
+	if !con.filter(&sarama.ConsumerMessage{Offset: 4}) {
+		t.Error("msg filtered by a panicking Filter")
+	}
+	if len(cl.errors) != 1 {
+		t.Error("Filter panic not reported")
+	}
+}
+
+func TestReportAge(t *testing.T) {
+	cl := &client{config: NewConfig()}
+	con := &consumer{cl: cl, topic: "topic"}
+	var ages []time.Duration
+	cl.config.OnMessageAge = func(topic string, partition int32, age time.Duration) { ages = append(ages, age) }
+
+	con.reportAge(&sarama.ConsumerMessage{Topic: "topic", Timestamp: time.Now().Add(-time.Minute)})
+	con.reportAge(&sarama.ConsumerMessage{Topic: "topic"})                                    // no timestamp
+	con.reportAge(&sarama.ConsumerMessage{Topic: "topic", Timestamp: time.Unix(0, -1000000)}) // -1 ms, also no timestamp
+	if len(ages) != 1 || ages[0] < time.Minute || ages[0] > 2*time.Minute {
+		t.Errorf("unexpected ages %v", ages)
+	}
+}
+
+// a sarama.Client which counts and blocks calls to RefreshCoordinator
+type refreshCountingClient struct {
+	sarama.Client
+	calls   int32
+	release chan struct{}
+}
+
+func (rc *refreshCountingClient) RefreshCoordinator(group string) error {
+	atomic.AddInt32(&rc.calls, 1)
+	<-rc.release
+	return nil
+}
+
+func TestRefreshCoordinatorShared(t *testing.T) {
+	rc := &refreshCountingClient{release: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := refreshCoordinator(rc, "group"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// wait for the 1st refresh to start, and give the others time to join it
+	for atomic.LoadInt32(&rc.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(rc.release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&rc.calls); n != 1 {
+		t.Errorf("%d concurrent refreshes; expected 1", n)
+	}
+
+	// and once it is done the next refresh is a new one
+	refreshCoordinator(rc, "group")
+	if n := atomic.LoadInt32(&rc.calls); n != 2 {
+		t.Errorf("%d refreshes; expected 2", n)
+	}
+}
+
+// a sarama.Client which can't be a map key
+type unhashableClient struct {
+	sarama.Client
+	calls *int32
+	_     []string
+}
+
+func (uc unhashableClient) RefreshCoordinator(group string) error {
+	atomic.AddInt32(uc.calls, 1)
+	return nil
+}
+
+func TestRefreshCoordinatorUnhashable(t *testing.T) {
+	uc := unhashableClient{calls: new(int32)}
+	if err := refreshCoordinator(uc, "group"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(uc.calls); n != 1 {
+		t.Errorf("%d refreshes; expected 1", n)
+	}
+}
+
+func TestRebalanceDelay(t *testing.T) {
+	now := time.Now()
+	joins := []time.Time{now.Add(-90 * time.Second), now.Add(-50 * time.Second), now.Add(-40 * time.Second), now.Add(-10 * time.Second)}
+
+	j, delay := rebalanceDelay(joins, now, 0, time.Minute)
+	if delay != 0 || len(j) != 0 {
+		t.Errorf("disabled circuit breaker delayed %v and kept %d joins", delay, len(j))
+	}
+
+	j, delay = rebalanceDelay(joins, now, 4, time.Minute)
+	if delay != 0 || len(j) != 3 {
+		t.Errorf("3 joins within the window with a limit of 4 delayed %v and kept %d joins", delay, len(j))
+	}
+
+	// with a limit of 2, the join 40s ago must be a minute old before we can join again
+	j, delay = rebalanceDelay(joins, now, 2, time.Minute)
+	if delay != 20*time.Second || len(j) != 3 {
+		t.Errorf("3 joins within the window with a limit of 2 delayed %v and kept %d joins", delay, len(j))
+	}
+}
+
+func TestLastInFetch(t *testing.T) {
+	con := &consumer{}
+	msg := &sarama.ConsumerMessage{Partition: 3, Offset: 10}
+	if con.LastInFetch(msg) {
+		t.Error("LastInFetch before any msg was noted")
+	}
+	con.noteLastInFetch(msg)
+	if !con.LastInFetch(msg) {
+		t.Error("LastInFetch of the noted msg is false")
+	}
+	if con.LastInFetch(&sarama.ConsumerMessage{Partition: 3, Offset: 9}) || con.LastInFetch(&sarama.ConsumerMessage{Partition: 2, Offset: 10}) {
+		t.Error("LastInFetch of other msgs is true")
+	}
+}
+
+func TestCommittedOffsets(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("topic", 0, broker.BrokerID()).
+			SetLeader("topic", 1, broker.BrokerID()).
+			SetLeader("topic", 2, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("group", "topic", 0, 100, "", sarama.ErrNoError).
+			SetOffset("group", "topic", 1, -1, "", sarama.ErrNoError).
+			SetOffset("group", "topic", 2, 300, "", sarama.ErrNoError),
+	})
+
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, NewSaramaConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sclient.Close()
+
+	// no need to run the client; CommittedOffsets doesn't depend on group membership
+	cl := &client{client: sclient, config: NewConfig(), group_name: "group"}
+	offsets, err := cl.CommittedOffsets("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(offsets, map[int32]int64{0: 100, 1: sarama.OffsetNewest, 2: 300}) {
+		t.Errorf("unexpected offsets %v", offsets)
+	}
+}
+
+func TestCopyOffsetsFrom(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("topic", 0, broker.BrokerID()).
+			SetLeader("topic", 1, broker.BrokerID()).
+			SetLeader("topic", 2, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "old", broker).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("old", "topic", 0, 100, "", sarama.ErrNoError).
+			SetOffset("old", "topic", 1, -1, "", sarama.ErrNoError).
+			SetOffset("old", "topic", 2, 300, "", sarama.ErrNoError),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+	})
+
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, NewSaramaConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sclient.Close()
+
+	// a client which isn't running (and so isn't consuming anything, nor a member of the group)
+	cl := &client{client: sclient, config: NewConfig(), group_name: "group", exited: make(chan struct{})}
+	close(cl.exited)
+	if err := cl.CopyOffsetsFrom("group", "topic"); err == nil {
+		t.Error("copying offsets from the group itself didn't fail")
+	}
+	if err := cl.CopyOffsetsFrom("old", "topic"); err != nil {
+		t.Fatal(err)
+	}
+
+	var commits []*sarama.OffsetCommitRequest
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			commits = append(commits, req)
+		}
+	}
+	if len(commits) != 1 {
+		t.Fatalf("%d OffsetCommitRequests sent; expected 1", len(commits))
+	}
+	req := commits[0]
+	if req.ConsumerGroup != "group" || req.ConsumerGroupGeneration != -1 {
+		t.Errorf("offsets committed to group %q generation %d", req.ConsumerGroup, req.ConsumerGroupGeneration)
+	}
+	// partition 1 has no committed offset in the old group, so it must be left alone
+	for p, exp := range map[int32]int64{0: 100, 2: 300} {
+		if offset, _, err := req.Offset("topic", p); err != nil || offset != exp {
+			t.Errorf("partition %d committed at offset %d, %v; expected %d", p, offset, err, exp)
+		}
+	}
+	if _, _, err := req.Offset("topic", 1); err == nil {
+		t.Error("partition 1 was committed")
+	}
+}
+
+func TestCommitBatch(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t).
+			SetError("group", "topic2", 1, sarama.ErrIllegalGeneration),
+	})
+
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, NewSaramaConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sclient.Close()
+	coor, err := sclient.Coordinator("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three consumers, two of which have offsets to commit
+	cl := &client{client: sclient, config: NewConfig(), group_name: "group"}
+	batch := newCommitBatch(cl, 3)
+	var wg sync.WaitGroup
+	for i, topic := range []string{"topic1", "topic2", ""} {
+		wg.Add(1)
+		go func(i int, topic string) {
+			defer wg.Done()
+			if topic == "" {
+				batch.skip()
+				return
+			}
+			if !batch.add(1, "member", coor, topic, []SidechannelOffset{{int32(i), 100}}) {
+				t.Errorf("offsets of %q not added to the batch", topic)
+			}
+		}(i, topic)
+	}
+	wg.Wait()
+	<-batch.sent
+
+	if batch.err != nil {
+		t.Fatal(batch.err)
+	}
+	if batch.ocresp.Errors["topic1"][0] != sarama.ErrNoError || batch.ocresp.Errors["topic2"][1] != sarama.ErrIllegalGeneration {
+		t.Errorf("unexpected OffsetCommitResponse %v", batch.ocresp.Errors)
+	}
+	commits := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			commits++
+		}
+	}
+	if commits != 1 {
+		t.Errorf("%d OffsetCommitRequests sent; expected 1", commits)
+	}
+}
+
+func TestAssignmentTooLarge(t *testing.T) {
+	defer func(orig int32) { sarama.MaxResponseSize = orig }(sarama.MaxResponseSize)
+	sarama.MaxResponseSize = 150 * 1024
+
+	// a synthetic assignment of 50000 partitions is ~200KB
+	parts := make([]int32, 50000)
+	for i := range parts {
+		parts[i] = int32(i)
+	}
+	var sreq sarama.SyncGroupRequest
+	sreq.AddGroupAssignmentMember("member0", &sarama.ConsumerGroupMemberAssignment{
+		Version: 1,
+		Topics:  map[string][]int32{"topic": parts},
+	})
+	err := checkAssignmentSizes(&sreq)
+	t.Log(err)
+	if err == nil {
+		t.Error("oversized assignment not detected")
+	}
+
+	// compressing the assignments fixes it
+	cp := compressed.New(roundrobin.RoundRobin)
+	err = cp.Partition(&sreq, &sarama.JoinGroupResponse{GroupProtocol: cp.Name()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAssignmentSizes(&sreq); err != nil {
+		t.Errorf("compressed assignment of %d bytes still too large: %v", len(sreq.GroupAssignments["member0"]), err)
+	}
+
+	// and the failure to decode a too large response is explained
+	err = syncGroupError(sarama.PacketDecodingError{Info: "message of length 209715200 too large or too small"})
+	t.Log(err)
+	if err == nil || !strings.Contains(err.Error(), "compressed.New") {
+		t.Errorf("too large SyncGroupResponse error not explained: %v", err)
+	}
+	if err := syncGroupError(sarama.ErrOutOfBrokers); err != sarama.ErrOutOfBrokers {
+		t.Errorf("other error altered: %v", err)
+	}
+}
+
+func TestWaitForTopic(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	sconfig := NewSaramaConfig()
+	sconfig.Metadata.Retry.Max = 0
+	sconfig.Metadata.Retry.Backoff = 10 * time.Millisecond
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, sconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sclient.Close()
+	cl := &client{client: sclient, config: NewConfig(), group_name: "group", exited: make(chan struct{})}
+
+	err = cl.waitForTopic("topic", 50*time.Millisecond)
+	t.Log(err)
+	if err == nil {
+		t.Error("waitForTopic of a missing topic succeeded")
+	}
+
+	// and once the topic exists
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("topic", 0, broker.BrokerID()),
+	})
+	err = cl.waitForTopic("topic", time.Second)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOrderMessages(t *testing.T) {
+	p0, p1, p2 := &partition{partition: 0}, &partition{partition: 1}, &partition{partition: 2}
+	t0 := time.Unix(1000, 0)
+	pm := func(part *partition, offset int64, ts int) premessage {
+		return premessage{part: part, msg: &sarama.ConsumerMessage{Partition: part.partition, Offset: offset, Timestamp: t0.Add(time.Duration(ts) * time.Second)}}
+	}
+	// partition 0 is busy, and partition 2's second msg has an older timestamp than its first
+	batch := []premessage{pm(p0, 10, 5), pm(p0, 11, 6), pm(p0, 12, 7), pm(p1, 20, 1), pm(p2, 30, 4), pm(p0, 13, 8), pm(p2, 31, 2)}
+
+	str := func(ordered []premessage) string {
+		var s []string
+		for _, pm := range ordered {
+			s = append(s, fmt.Sprintf("%d/%d", pm.msg.Partition, pm.msg.Offset))
+		}
+		return strings.Join(s, " ")
+	}
+
+	for _, c := range []struct {
+		order    DeliveryOrder
+		expected string
+	}{
+		{DeliverAsArrived, "0/10 0/11 0/12 1/20 2/30 0/13 2/31"},
+		{DeliverRoundRobin, "0/10 1/20 2/30 0/11 2/31 0/12 0/13"},
+		{DeliverByTimestamp, "1/20 2/30 2/31 0/10 0/11 0/12 0/13"}, // 2/31 can't precede 2/30
+	} {
+		if act := str(orderMessages(c.order, batch)); act != c.expected {
+			t.Errorf("order %d delivered %s; expected %s", c.order, act, c.expected)
+		}
+	}
+}
+
+// a client which can't join the group gives up when its context is done
+func TestNewClientContext(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetError(sarama.ErrRebalanceInProgress),
+	})
+
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, NewSaramaConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sclient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	config := NewConfig()
+	config.SidechannelTopic = ""
+	cl, err := NewClientContext(ctx, "group", config, sclient)
+	if err != context.DeadlineExceeded || cl != nil {
+		t.Fatalf("NewClientContext returned %v, %v; expected %v", cl, err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("NewClientContext took %v to give up", d)
+	}
+}
+
+func TestLag(t *testing.T) {
+	s := ConsumerStats{
+		Topic: "topic",
+		Partitions: map[int32]PartitionStats{
+			0: {Committable: 100, HighWaterMark: 150},
+			1: {Committable: 200, HighWaterMark: 190}, // a stale high-water mark
+			2: {Committable: sarama.OffsetNewest, HighWaterMark: 50},
+			3: {Committable: 10, HighWaterMark: -1},
+		},
+	}
+	if lag := s.Lag(); !reflect.DeepEqual(lag, map[int32]int64{0: 50, 1: 0}) {
+		t.Errorf("unexpected lag %v", lag)
+	}
+}
+
+func TestPausePartition(t *testing.T) {
+	con := &consumer{cl: &client{}, closed: make(chan struct{})}
+	con.Pause(1)
+	con.Pause(1)
+	if !con.waitResumed(0) {
+		t.Fatal("waitResumed of an unpaused partition failed")
+	}
+
+	resumed := make(chan bool)
+	go func() { resumed <- con.waitResumed(1) }()
+	select {
+	case <-resumed:
+		t.Fatal("waitResumed of a paused partition returned")
+	case <-time.After(10 * time.Millisecond):
+	}
+	con.Resume(1)
+	if !<-resumed {
+		t.Fatal("waitResumed failed after Resume")
+	}
+	con.Resume(1) // no effect
+
+	con.Pause(2)
+	go func() { resumed <- con.waitResumed(2) }()
+	close(con.closed)
+	if <-resumed {
+		t.Error("waitResumed succeeded after the consumer closed")
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	cl := &client{group_name: "group"}
+	err := cl.makeError("Consume", ErrTopicAlreadyConsumed)
+	err.Topic = "topic"
+	var e error = err
+	if !errors.Is(e, ErrTopicAlreadyConsumed) {
+		t.Errorf("%v is not ErrTopicAlreadyConsumed", e)
+	}
+	if errors.Is(cl.makeError("Consume", sarama.ErrOutOfBrokers), ErrTopicAlreadyConsumed) {
+		t.Error("unrelated error is ErrTopicAlreadyConsumed")
+	}
+	var Err *Error
+	if !errors.As(e, &Err) || Err.Topic != "topic" {
+		t.Errorf("errors.As(%v) failed", e)
+	}
+
+	// broker errors, even those we've explained, can be classified
+	e = cl.makeError("joining group", sessionTimeoutError(sarama.ErrInvalidSessionTimeout, NewConfig()))
+	if !errors.Is(e, sarama.ErrInvalidSessionTimeout) {
+		t.Errorf("%v is not sarama.ErrInvalidSessionTimeout", e)
+	}
+}
+
+// newMockClient returns a mock broker, where each of the partitions of "topic" holds msgs at offsets 0 to msgs-1, and the
+// group "group" always assigns all of them to us, along with a sarama.Client of the broker
+func newMockClient(t testing.TB, partitions int32, msgs int64) (*sarama.MockBroker, sarama.Client) {
+	broker := sarama.NewMockBroker(t, 1)
+	metadata := sarama.NewMockMetadataResponse(t).
+		SetBroker(broker.Addr(), broker.BrokerID())
+	fetch := sarama.NewMockFetchResponse(t, 100).SetVersion(1)
+	offset_fetch := sarama.NewMockOffsetFetchResponse(t)
+	offsets := sarama.NewMockOffsetResponse(t)
+	assigned := make([]int32, partitions)
+	for p := int32(0); p < partitions; p++ {
+		metadata.SetLeader("topic", p, broker.BrokerID())
+		fetch.SetHighWaterMark("topic", p, msgs)
+		for offset := int64(0); offset < msgs; offset++ {
+			fetch.SetMessage("topic", p, offset, sarama.StringEncoder(fmt.Sprintf("msg %d", offset)))
+		}
+		offset_fetch.SetOffset("group", "topic", p, -1, "", sarama.ErrNoError)
+		offsets.SetOffset("topic", p, sarama.OffsetOldest, 0).
+			SetOffset("topic", p, sarama.OffsetNewest, msgs)
+		assigned[p] = p
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGenerationId(1).
+			SetGroupProtocol(string(roundrobin.RoundRobin)).
+			SetMemberId("member").
+			SetLeaderId("leader"),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).
+			SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{
+				Version: 1,
+				Topics:  map[string][]int32{"topic": assigned},
+			}),
+		"HeartbeatRequest":    sarama.NewMockHeartbeatResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+		"OffsetFetchRequest":  offset_fetch,
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"OffsetRequest":       offsets,
+		"FetchRequest":        fetch,
+	})
+
+	sconfig := NewSaramaConfig()
+	sconfig.Version = MinVersion // the version of the mock fetch and offset responses
+	sconfig.Consumer.Offsets.Initial = sarama.OffsetOldest
+	sclient, err := sarama.NewClient([]string{broker.Addr()}, sconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker, sclient
+}
+
+func TestRewind(t *testing.T) {
+	for _, in_order_done := range []bool{false, true} {
+		t.Run(fmt.Sprintf("InOrderDone=%v", in_order_done), func(t *testing.T) {
+			testRewind(t, in_order_done)
+		})
+	}
+}
+
+func testRewind(t *testing.T, in_order_done bool) {
+	broker, sclient := newMockClient(t, 1, 5)
+	defer broker.Close()
+	defer sclient.Close()
+
+	config := NewConfig()
+	config.SidechannelTopic = ""
+	config.InOrderDone = in_order_done
+	config.JoinOnlyWhenConsuming = true // so the one assignment the mock broker knows matches what we consume
+	cl, err := NewClient("group", config, sclient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	con, err := cl.Consume("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(expected ...int64) {
+		for _, exp := range expected {
+			select {
+			case msg := <-con.Messages():
+				if msg.Offset != exp {
+					t.Fatalf("received offset %d; expected %d", msg.Offset, exp)
+				}
+				con.Done(msg)
+			case err := <-cl.Errors():
+				t.Fatal(err)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("offset %d wasn't received", exp)
+			}
+		}
+	}
+	receive(0, 1, 2, 3, 4)
+
+	// the Done() of the last msg might not have been processed yet
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = con.Rewind(3)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(2, 3, 4)
+}
+
+// while the added partitions wait out the SettleDelay the rest of the consumer keeps working
+func TestSettleDelay(t *testing.T) {
+	broker, sclient := newMockClient(t, 1, 5)
+	defer broker.Close()
+	defer sclient.Close()
+
+	const delay = time.Second
+	config := NewConfig()
+	config.SidechannelTopic = ""
+	config.JoinOnlyWhenConsuming = true
+	config.Rebalance.SettleDelay = delay
+	cl, err := NewClient("group", config, sclient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	con, err := cl.Consume("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-con.AssignmentChanges():
+	case err := <-cl.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no assignment")
+	}
+	assigned := time.Now()
+	con.Stats()
+	if d := time.Since(assigned); d >= delay/2 {
+		t.Errorf("Stats took %v while settling", d)
+	}
+
+	select {
+	case msg := <-con.Messages():
+		if d := time.Since(assigned); d < delay/2 {
+			t.Errorf("msg %d received %v after the assignment; expected no sooner than %v", msg.Offset, d, delay)
+		}
+	case err := <-cl.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no msg was received")
+	}
+}
+
+func TestCloseDiscards(t *testing.T) {
+	for _, in_order_done := range []bool{false, true} {
+		t.Run(fmt.Sprintf("InOrderDone=%v", in_order_done), func(t *testing.T) {
+			testCloseDiscards(t, in_order_done)
+		})
+	}
+}
+
+func testCloseDiscards(t *testing.T, in_order_done bool) {
+	broker, sclient := newMockClient(t, 1, 5)
+	defer broker.Close()
+	defer sclient.Close()
+
+	config := NewConfig()
+	config.SidechannelTopic = ""
+	config.InOrderDone = in_order_done
+	config.JoinOnlyWhenConsuming = true
+	config.Close.GracePeriod = time.Minute
+	cl, err := NewClient("group", config, sclient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	con, err := cl.Consume("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-con.Messages():
+		con.Done(msg)
+	case err := <-cl.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no msg was received")
+	}
+	// wait for the rest of the msgs to be buffered in Messages
+	deadline := time.Now().Add(5 * time.Second)
+	for len(con.Messages()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Close discards the buffered msgs, and mustn't wait the GracePeriod for them to be Done()
+	start := time.Now()
+	con.Close()
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+}
+
+// measure the throughput of the msgs of several partitions with various sizes of the queue between the partitions and consumer.run
+func BenchmarkPartitionBufferSize(b *testing.B) {
+	const partitions = 8
+	for _, size := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("PartitionBufferSize=%d", size), func(b *testing.B) {
+			broker, sclient := newMockClient(b, partitions, int64(b.N+partitions-1)/partitions)
+			defer broker.Close()
+			defer sclient.Close()
+
+			config := NewConfig()
+			config.SidechannelTopic = ""
+			config.JoinOnlyWhenConsuming = true
+			config.PartitionBufferSize = size
+			cl, err := NewClient("group", config, sclient)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer cl.Close()
+
+			b.ResetTimer()
+			con, err := cl.Consume("topic")
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < b.N; i++ {
+				select {
+				case msg := <-con.Messages():
+					con.Done(msg)
+				case err := <-cl.Errors():
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+		})
+	}
+}
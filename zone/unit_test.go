@@ -0,0 +1,176 @@
+/*
+  A simple kafka consumer-group client
+
+  Copyright 2016 MistSys
+*/
+
+package zone_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	consumer "github.com/mistsys/sarama-consumer"
+	"github.com/mistsys/sarama-consumer/zone"
+)
+
+// the zone of each broker, by address
+var broker_zones = map[string]string{
+	"broker-a:9092": "a",
+	"broker-b:9092": "b",
+	"broker-c:9092": "c",
+}
+
+func brokerZone(broker *sarama.Broker) string { return broker_zones[broker.Addr()] }
+
+// join the members, each labeled with its zone, and return each member's assignment
+func partition(t *testing.T, member_zones []string, mock_client *mockClient) map[string]map[string][]int32 {
+	var jresp = sarama.JoinGroupResponse{
+		GenerationId:  1,
+		GroupProtocol: "zonepreferring",
+		Members:       make(map[string][]byte),
+	}
+	var partitioners []consumer.Partitioner
+	for i, z := range member_zones {
+		p := zone.New(z, brokerZone)
+		partitioners = append(partitioners, p)
+		jreq := sarama.JoinGroupRequest{MemberId: fmt.Sprintf("member%d", i)}
+		p.PrepareJoin(&jreq, []string{"topic1"}, nil)
+		jresp.Members[jreq.MemberId] = jreq.OrderedGroupProtocols[0].Metadata
+	}
+
+	var sreq sarama.SyncGroupRequest
+	err := partitioners[0].Partition(&sreq, &jresp, mock_client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assignments := make(map[string]map[string][]int32)
+	for i, p := range partitioners {
+		member := fmt.Sprintf("member%d", i)
+		act, err := p.ParseSync(&sarama.SyncGroupResponse{MemberAssignment: sreq.GroupAssignments[member]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("%s (zone %q) assignment %v", member, member_zones[i], act)
+		assignments[member] = act
+	}
+	return assignments
+}
+
+// 9 partitions, led round-robin by brokers in zones a, b and c
+func newMockClient() *mockClient {
+	leaders := make(map[int32]*sarama.Broker)
+	var partitions []int32
+	for p := int32(0); p < 9; p++ {
+		partitions = append(partitions, p)
+		leaders[p] = sarama.NewBroker(fmt.Sprintf("broker-%c:9092", 'a'+p%3))
+	}
+	return &mockClient{
+		config:     sarama.NewConfig(),
+		partitions: map[string][]int32{"topic1": partitions},
+		leaders:    leaders,
+	}
+}
+
+// check each member's partitions are led by brokers in zone (or any zone, if zone is ""), and return how many partitions the member was assigned
+func check(t *testing.T, mock_client *mockClient, member string, assignment map[string][]int32, zone string) int {
+	for _, p := range assignment["topic1"] {
+		if z := brokerZone(mock_client.leaders[p]); zone != "" && z != zone {
+			t.Errorf("%s was assigned partition %d in zone %q; expected zone %q", member, p, z, zone)
+		}
+	}
+	return len(assignment["topic1"])
+}
+
+func TestZonePreferring(t *testing.T) {
+	mock_client := newMockClient()
+	assignments := partition(t, []string{"a", "b", "c"}, mock_client)
+	for i, z := range []string{"a", "b", "c"} {
+		member := fmt.Sprintf("member%d", i)
+		if n := check(t, mock_client, member, assignments[member], z); n != 3 {
+			t.Errorf("%s was assigned %d partitions; expected 3", member, n)
+		}
+	}
+}
+
+// with no members in zone c, and two in zone a, zone c's partitions must still be assigned, and the loads kept balanced
+func TestZonePreferringFallback(t *testing.T) {
+	mock_client := newMockClient()
+	assignments := partition(t, []string{"a", "a", "b"}, mock_client)
+	total := 0
+	for i := range []string{"a", "a", "b"} {
+		member := fmt.Sprintf("member%d", i)
+		n := check(t, mock_client, member, assignments[member], "")
+		if n != 3 {
+			t.Errorf("%s was assigned %d partitions; expected 3", member, n)
+		}
+		total += n
+	}
+	if total != 9 {
+		t.Errorf("%d partitions were assigned; expected 9", total)
+	}
+	// member2 is the only member in zone b, so it must have all of zone b's partitions
+	check(t, mock_client, "member2", assignments["member2"], "b")
+}
+
+// mock sarama.Client which implements the metadata API sufficiently for our unit test purposes
+type mockClient struct {
+	config     *sarama.Config
+	partitions map[string][]int32
+	leaders    map[int32]*sarama.Broker
+}
+
+func (mc *mockClient) Config() *sarama.Config {
+	return mc.config
+}
+
+func (mc *mockClient) Brokers() []*sarama.Broker {
+	return nil
+}
+
+func (mc *mockClient) Topics() ([]string, error) {
+	var topics = make([]string, 0, len(mc.partitions))
+	for t := range mc.partitions {
+		topics = append(topics, t)
+	}
+	return topics, nil
+}
+
+func (mc *mockClient) Partitions(topic string) ([]int32, error) {
+	if p, ok := mc.partitions[topic]; ok {
+		return p, nil
+	}
+	return nil, sarama.ErrUnknownTopicOrPartition
+}
+
+func (mc *mockClient) WritablePartitions(topic string) ([]int32, error) {
+	return mc.Partitions(topic)
+}
+
+func (mc *mockClient) Leader(topic string, part int32) (*sarama.Broker, error) {
+	if b, ok := mc.leaders[part]; ok {
+		return b, nil
+	}
+	return nil, sarama.ErrBrokerNotAvailable
+}
+func (*mockClient) Replicas(topic string, part int32) ([]int32, error) {
+	return nil, sarama.ErrNotEnoughReplicas
+}
+func (*mockClient) RefreshMetadata(topics ...string) error                        { return nil }
+func (*mockClient) GetOffset(topic string, part int32, time int64) (int64, error) { return 0, nil }
+func (*mockClient) Coordinator(group string) (*sarama.Broker, error) {
+	return nil, sarama.ErrBrokerNotAvailable
+}
+func (*mockClient) RefreshCoordinator(group string) error { return nil }
+func (*mockClient) Close() error                          { return nil }
+func (*mockClient) Closed() bool                          { return false }
+func (*mockClient) InSyncReplicas(string, int32) ([]int32, error) {
+	return nil, sarama.ErrNotEnoughReplicas
+}
+func (*mockClient) Controller() (*sarama.Broker, error)                              { return nil, nil }
+func (*mockClient) RefreshController() (*sarama.Broker, error)                       { return nil, nil }
+func (*mockClient) InitProducerID() (*sarama.InitProducerIDResponse, error)          { return nil, nil }
+func (*mockClient) OfflineReplicas(topic string, partitionID int32) ([]int32, error) { return nil, nil }
+func (*mockClient) RefreshBrokers(addrs []string) error                              { return nil }
@@ -0,0 +1,200 @@
+/*
+ A partitioner which prefers to assign partitions to members in the
+ same zone as the partition's leader
+
+ Each member is labeled with a zone (any string, for instance an
+ availability zone) which it advertises in its UserData. The leader
+ looks up the zone of each partition's leading broker, and assigns
+ the partition to the least loaded member in that zone, which saves
+ the cost of fetching across zones. The members' loads are kept
+ balanced: once every member in a zone has its share of the topic's
+ partitions, or when a zone has no members at all, partitions go to
+ the least loaded member of any zone.
+
+ The zone of a broker is determined by a function supplied by the
+ application. By default it is the broker's rack (broker.rack in the
+ broker's configuration), which requires sarama.Config.Version >=
+ V0_10_0_0.
+
+  Copyright 2016 MistSys
+*/
+
+package zone
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Shopify/sarama"
+)
+
+// BrokerZone returns the zone of a broker, or "" if it is unknown
+type BrokerZone func(broker *sarama.Broker) string
+
+// the default BrokerZone is the broker's rack
+func brokerRack(broker *sarama.Broker) string { return broker.Rack() }
+
+// a partitioner which prefers members in the same zone as each partition's leader
+type zonePartitioner struct {
+	zone        string     // this member's zone
+	broker_zone BrokerZone // function mapping brokers to zones
+}
+
+// name of the protocol
+const name = "zonepreferring"
+
+// New returns a zone preferring partitioner for a member in zone. broker_zone maps brokers to zones; if it is nil
+// the brokers' racks are used. Only the leader uses broker_zone, but since any member can be the leader they should
+// all be given the same function.
+func New(zone string, broker_zone BrokerZone) *zonePartitioner {
+	if broker_zone == nil {
+		broker_zone = brokerRack
+	}
+	return &zonePartitioner{
+		zone:        zone,
+		broker_zone: broker_zone,
+	}
+}
+
+func (*zonePartitioner) Name() string { return name }
+
+func (zp *zonePartitioner) PrepareJoin(jreq *sarama.JoinGroupRequest, topics []string, current map[string][]int32) {
+	jreq.AddGroupProtocolMetadata(name,
+		&sarama.ConsumerGroupMemberMetadata{
+			Version:  1,
+			Topics:   topics,
+			UserData: []byte(zp.zone),
+		})
+}
+
+// for each topic in jresp, assign the topic's partitions to the members requesting the topic, preferring the members in the zone of each partition's leader
+func (zp *zonePartitioner) Partition(sreq *sarama.SyncGroupRequest, jresp *sarama.JoinGroupResponse, client sarama.Client) error {
+	by_member, err := jresp.GetMembers() // map of member to metadata
+	if err != nil {
+		return err
+	}
+	zones := make(map[string]string, len(by_member)) // map of member to its zone
+	by_topic := make(map[string][]string)            // map of topic to members requesting the topic
+	for member, request := range by_member {
+		if request.Version != 1 {
+			// skip unsupported versions, just like the roundrobin partitioner
+			continue
+		}
+		zones[member] = string(request.UserData)
+		for _, topic := range request.Topics {
+			by_topic[topic] = append(by_topic[topic], member)
+		}
+	}
+
+	// make sure we have fresh metadata for all these topics
+	if len(by_topic) != 0 {
+		topics := make([]string, 0, len(by_topic))
+		for t := range by_topic {
+			topics = append(topics, t)
+		}
+		err = client.RefreshMetadata(topics...)
+		if err != nil {
+			return err
+		}
+	}
+
+	assignments := make(map[string]map[string][]int32, len(by_member)) // map of member to topics, and topic to partitions
+	for topic, members := range by_topic {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		leader_zones := make(map[int32]string, len(partitions))
+		for _, p := range partitions {
+			if broker, err := client.Leader(topic, p); err == nil {
+				leader_zones[p] = zp.broker_zone(broker)
+			} // else the partition is offline or the leader unknown; any member will do
+		}
+		for member, parts := range assign(partitions, leader_zones, members, zones) {
+			topics, ok := assignments[member]
+			if !ok {
+				topics = make(map[string][]int32, len(by_topic))
+				assignments[member] = topics
+			}
+			topics[topic] = parts
+		}
+	}
+
+	// and encode the assignments in the sync request
+	for member_id, topics := range assignments {
+		sreq.AddGroupAssignmentMember(member_id,
+			&sarama.ConsumerGroupMemberAssignment{
+				Version: 1,
+				Topics:  topics,
+			})
+	}
+
+	return nil
+}
+
+func (zp *zonePartitioner) ParseSync(sresp *sarama.SyncGroupResponse) (map[string][]int32, error) {
+	assignments, _, err := zp.ParseSyncUserData(sresp)
+	return assignments, err
+}
+
+// ParseSyncUserData is ParseSync, plus it returns the UserData of the member assignment (which this partitioner doesn't use itself, but some other member might have put there)
+func (*zonePartitioner) ParseSyncUserData(sresp *sarama.SyncGroupResponse) (map[string][]int32, []byte, error) {
+	if len(sresp.MemberAssignment) == 0 {
+		// we asked for no topics, and got nothing back
+		return nil, nil, nil
+	}
+	ma, err := sresp.GetMemberAssignment()
+	if err != nil {
+		return nil, nil, err
+	}
+	if ma.Version != 1 {
+		return nil, nil, fmt.Errorf("unsupported MemberAssignment version %d", ma.Version)
+	}
+	return ma.Topics, ma.UserData, nil
+}
+
+// ----------------------------------
+
+// assign the partitions to the members, preferring the members in each partition's leader's zone. returns a map of member -> partitions
+func assign(partitions []int32, leader_zones map[int32]string, members []string, zones map[string]string) map[string][]int32 {
+	if len(members) == 0 || len(partitions) == 0 {
+		return nil
+	}
+	// visit the members and the partitions in a fixed order so the results are deterministic
+	sort.Strings(members)
+	sorted := make([]int32, len(partitions))
+	copy(sorted, partitions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	max_load := (len(sorted) + len(members) - 1) / len(members) // each member's fair share, rounded up
+	loads := make(map[string]int, len(members))
+	assignment := make(map[string][]int32, len(members))
+
+	// least loaded member in zone (any zone if zone is ""), or "" if there is none with room
+	least_loaded := func(zone string) string {
+		best := ""
+		for _, m := range members {
+			if zone != "" && zones[m] != zone {
+				continue
+			}
+			if loads[m] < max_load && (best == "" || loads[m] < loads[best]) {
+				best = m
+			}
+		}
+		return best
+	}
+
+	for _, p := range sorted {
+		m := ""
+		if zone := leader_zones[p]; zone != "" {
+			m = least_loaded(zone)
+		}
+		if m == "" {
+			// no member in the zone has room. fall back to any member. since max_load*len(members) >= len(partitions) there always is one
+			m = least_loaded("")
+		}
+		loads[m]++
+		assignment[m] = append(assignment[m], p)
+	}
+	return assignment
+}